@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"shared/auth"
+)
+
+// Access control for the HTTP API. Every route but /auth/, /schemas/,
+// /registry/ and the health and metrics endpoints needs a token or API key
+// (see shared/auth); the helpers below then keep callers to their own data
+// unless they hold the admin role.
+
+// scopeToCaller restricts endpoints filtered by ?user_id= to the caller:
+// a user's request is answered for their own user_id, and asking for
+// anyone else's is forbidden. Admins may name any user, or none.
+func scopeToCaller(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := auth.FromContext(r.Context())
+		if p.IsAdmin() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		q := r.URL.Query()
+		if userID := q.Get("user_id"); userID != "" && userID != p.UserID {
+			http.Error(w, "Forbidden: you may only read your own data", http.StatusForbidden)
+			return
+		}
+		q.Set("user_id", p.UserID)
+
+		scoped := r.Clone(r.Context())
+		scoped.URL.RawQuery = q.Encode()
+		next.ServeHTTP(w, scoped)
+	})
+}
+
+// ownUserPath restricts /users/{id}/... to its owner and admins. The
+// profile and saved locations are named by account, and the caller must be
+// signed in to it; the stats and track are named by user_id.
+func ownUserPath(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := auth.FromContext(r.Context())
+		id, rest, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/users/"), "/"), "/")
+		allowed := p.CanAccess(id)
+		if rest == "" || rest == "locations" || strings.HasPrefix(rest, "locations/") {
+			allowed = p.IsAdmin() || (id != "" && id == p.Account)
+		}
+		if !allowed {
+			http.Error(w, "Forbidden: you may only access your own account", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ownSessionPath restricts /sessions/{id}/... to the caller's own sessions.
+// Session IDs are only unique per user, so the session is looked up under
+// ?user_id=, which scopeToCaller sets for users; admins must name the user.
+func ownSessionPath(next http.Handler) http.Handler {
+	return scopeToCaller(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("user_id") == "" {
+			http.Error(w, "user_id is required", http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// adminWrites lets any caller read but only admins change a resource
+func adminWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := auth.FromContext(r.Context())
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !p.IsAdmin() {
+			http.Error(w, "admin role required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"shared/auth"
+)
+
+// echoQuery answers with the query string the wrapped handler received
+var echoQuery = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(r.URL.RawQuery))
+})
+
+var (
+	alice = auth.Principal{UserID: "alice", Role: auth.RoleUser}
+	admin = auth.Principal{UserID: "root", Role: auth.RoleAdmin}
+)
+
+// serveAs sends a GET for target through h on behalf of p
+func serveAs(h http.Handler, p auth.Principal, target string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r = r.WithContext(auth.NewContext(r.Context(), p))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestScopeToCaller(t *testing.T) {
+	tests := []struct {
+		name       string
+		caller     auth.Principal
+		target     string
+		wantStatus int
+		wantQuery  string
+	}{
+		{"user without user_id", alice, "/events?limit=5", http.StatusOK, "limit=5&user_id=alice"},
+		{"user naming themselves", alice, "/events?user_id=alice", http.StatusOK, "user_id=alice"},
+		{"user naming another", alice, "/events?user_id=bob", http.StatusForbidden, ""},
+		{"user repeating user_id", alice, "/events?user_id=alice&user_id=bob", http.StatusOK, "user_id=alice"},
+		{"admin without user_id", admin, "/events?limit=5", http.StatusOK, "limit=5"},
+		{"admin naming a user", admin, "/events?user_id=bob", http.StatusOK, "user_id=bob"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveAs(scopeToCaller(echoQuery), tt.caller, tt.target)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK && w.Body.String() != tt.wantQuery {
+				t.Errorf("handler saw query %q, want %q", w.Body.String(), tt.wantQuery)
+			}
+		})
+	}
+}
+
+func TestOwnUserPath(t *testing.T) {
+	// alice's account owns the events of the simulated user "runner"
+	account := auth.Principal{UserID: "runner", Role: auth.RoleUser, Account: "alice"}
+
+	tests := []struct {
+		name       string
+		caller     auth.Principal
+		target     string
+		wantStatus int
+	}{
+		{"own profile", account, "/users/alice", http.StatusOK},
+		{"own profile with slash", account, "/users/alice/", http.StatusOK},
+		{"own saved locations", account, "/users/alice/locations/park", http.StatusOK},
+		{"own stats", account, "/users/runner/stats", http.StatusOK},
+		{"own track", account, "/users/runner/track.gpx", http.StatusOK},
+		{"profile by user_id", account, "/users/runner", http.StatusForbidden},
+		{"stats by account", account, "/users/alice/stats", http.StatusForbidden},
+		{"another profile", account, "/users/bob", http.StatusForbidden},
+		{"another's track", account, "/users/bob/track.gpx", http.StatusForbidden},
+		{"prefix of own name", account, "/users/ali/locations", http.StatusForbidden},
+		{"no user", account, "/users/", http.StatusForbidden},
+		{"api key profile", alice, "/users/alice", http.StatusForbidden},
+		{"api key stats", alice, "/users/alice/stats", http.StatusOK},
+		{"admin reading another", admin, "/users/bob/track.geojson", http.StatusOK},
+		{"admin reading a profile", admin, "/users/bob/locations", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveAs(ownUserPath(echoQuery), tt.caller, tt.target)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestOwnSessionPath(t *testing.T) {
+	tests := []struct {
+		name       string
+		caller     auth.Principal
+		target     string
+		wantStatus int
+		wantQuery  string
+	}{
+		{"own session", alice, "/sessions/s1/stats", http.StatusOK, "user_id=alice"},
+		{"another's session", alice, "/sessions/s1/stats?user_id=bob", http.StatusForbidden, ""},
+		{"admin naming the user", admin, "/sessions/s1/points?user_id=bob", http.StatusOK, "user_id=bob"},
+		{"admin without user_id", admin, "/sessions/s1/points", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveAs(ownSessionPath(echoQuery), tt.caller, tt.target)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK && w.Body.String() != tt.wantQuery {
+				t.Errorf("handler saw query %q, want %q", w.Body.String(), tt.wantQuery)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+
+	"shared/auth"
+	"shared/events"
+)
+
+// Config holds the consumer's runtime settings. See shared/config for how
+// flags, environment variables and the optional config file are applied.
+type Config struct {
+	Broker           string            `json:"broker" env:"KAFKA_BOOTSTRAP" flag:"broker" usage:"Kafka bootstrap servers"`
+	GroupID          string            `json:"group_id" env:"KAFKA_GROUP_ID" flag:"group-id" usage:"Kafka consumer group ID"`
+	CoordinatesTopic string            `json:"coordinates_topic" env:"COORDINATES_TOPIC" flag:"coordinates-topic" usage:"topic carrying CoordinateEvents"`
+	LocationsTopic   string            `json:"locations_topic" env:"LOCATIONS_TOPIC" flag:"locations-topic" usage:"topic carrying LocationEvents"`
+	SessionsTopic    string            `json:"sessions_topic" env:"SESSIONS_TOPIC" flag:"sessions-topic" usage:"topic carrying session start/end events"`
+	DLQTopic         string            `json:"dlq_topic" env:"DLQ_TOPIC" flag:"dlq-topic" usage:"dead-letter topic for messages that fail to decode or store"`
+	GeofenceTopic    string            `json:"geofence_topic" env:"GEOFENCE_TOPIC" flag:"geofence-topic" usage:"topic receiving geofence enter/exit events"`
+	UsersTopic       string            `json:"users_topic" env:"USERS_TOPIC" flag:"users-topic" usage:"topic receiving user account change events"`
+	EventFormat      string            `json:"event_format" env:"EVENT_FORMAT" flag:"event-format" usage:"wire format of published geofence events: json, protobuf or avro (all are read)"`
+	SchemaRegistry   string            `json:"schema_registry" env:"SCHEMA_REGISTRY" flag:"schema-registry" usage:"JSON file holding registered Protobuf/Avro schemas (in memory if unset)"`
+	Storage          string            `json:"storage" env:"STORAGE" flag:"storage" usage:"storage backend: sqlite or mongodb"`
+	DBPath           string            `json:"db_path" env:"DB_PATH" flag:"db" usage:"SQLite database path"`
+	MongoURI         string            `json:"mongo_uri" env:"MONGO_URI" flag:"mongo-uri" usage:"MongoDB connection string" secret:"true"`
+	MongoDatabase    string            `json:"mongo_database" env:"MONGO_DATABASE" flag:"mongo-database" usage:"MongoDB database name"`
+	MongoMigrate     bool              `json:"mongo_migrate" env:"MONGO_MIGRATE" flag:"mongo-migrate" usage:"apply pending MongoDB schema migrations on startup instead of refusing to start"`
+	HTTPAddr         string            `json:"http_addr" env:"HTTP_ADDR" flag:"http-addr" usage:"HTTP listen address"`
+	AuthKey          string            `json:"auth_key" env:"AUTH_KEY" flag:"auth-key" usage:"key signing the API tokens issued by /auth/login, at least 32 bytes" secret:"true"`
+	TokenTTL         time.Duration     `json:"token_ttl" env:"TOKEN_TTL" flag:"token-ttl" usage:"how long an API token stays valid"`
+	APIKeys          map[string]string `json:"api_keys" env:"API_KEYS" flag:"api-keys" usage:"static API keys as key=user_id[:role],key=user_id[:role]" secret:"true"`
+	CORSOrigins      []string          `json:"cors_origins" env:"CORS_ORIGINS" flag:"cors-origins" usage:"origins allowed to call the API from a browser (* for any)"`
+	BatchSize        int               `json:"batch_size" env:"BATCH_SIZE" flag:"batch-size" usage:"maximum messages written per storage batch"`
+	BatchTimeout     time.Duration     `json:"batch_timeout" env:"BATCH_TIMEOUT" flag:"batch-timeout" usage:"maximum time a message waits before its batch is written"`
+	ShutdownTimeout  time.Duration     `json:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" flag:"shutdown-timeout" usage:"how long shutdown waits for HTTP requests and pending writes"`
+	KafkaOverrides   map[string]string `json:"kafka_overrides" env:"KAFKA_CONFIG" flag:"kafka-config" usage:"extra librdkafka settings as key=value,key=value"`
+}
+
+// defaultConfig returns the settings used when nothing is overridden
+func defaultConfig() Config {
+	return Config{
+		Broker:           "kafka:9092",
+		GroupID:          "gps-consumer",
+		CoordinatesTopic: "coordinates",
+		LocationsTopic:   "locations",
+		SessionsTopic:    "sessions",
+		DLQTopic:         "coordinates.dlq",
+		GeofenceTopic:    "geofence-events",
+		UsersTopic:       "users",
+		EventFormat:      events.FormatJSON,
+		Storage:          StorageSQLite,
+		DBPath:           "/db/gps.db",
+		MongoURI:         "mongodb://localhost:27017",
+		MongoDatabase:    "gps",
+		MongoMigrate:     true,
+		HTTPAddr:         ":8082",
+		TokenTTL:         24 * time.Hour,
+		APIKeys:          map[string]string{},
+		CORSOrigins:      []string{"http://localhost:3000"},
+		BatchSize:        500,
+		BatchTimeout:     250 * time.Millisecond,
+		ShutdownTimeout:  10 * time.Second,
+		KafkaOverrides:   map[string]string{},
+	}
+}
+
+// Validate checks that required settings are present and distinct
+func (c *Config) Validate() error {
+	required := []struct{ name, value string }{
+		{"broker", c.Broker},
+		{"group_id", c.GroupID},
+		{"coordinates_topic", c.CoordinatesTopic},
+		{"locations_topic", c.LocationsTopic},
+		{"sessions_topic", c.SessionsTopic},
+		{"dlq_topic", c.DLQTopic},
+		{"geofence_topic", c.GeofenceTopic},
+		{"users_topic", c.UsersTopic},
+		{"http_addr", c.HTTPAddr},
+		{"auth_key", c.AuthKey},
+	}
+	switch c.Storage {
+	case StorageSQLite:
+		required = append(required, struct{ name, value string }{"db_path", c.DBPath})
+	case StorageMongoDB:
+		required = append(required,
+			struct{ name, value string }{"mongo_uri", c.MongoURI},
+			struct{ name, value string }{"mongo_database", c.MongoDatabase},
+		)
+	default:
+		return fmt.Errorf("storage must be %s or %s", StorageSQLite, StorageMongoDB)
+	}
+	for _, r := range required {
+		if r.value == "" {
+			return fmt.Errorf("%s must not be empty", r.name)
+		}
+	}
+
+	if !events.ValidFormat(c.EventFormat) {
+		return fmt.Errorf("event_format must be one of %s", strings.Join(events.Formats, ", "))
+	}
+
+	if len(c.AuthKey) < auth.MinKeyLen {
+		return fmt.Errorf("auth_key must be at least %d bytes", auth.MinKeyLen)
+	}
+	if c.TokenTTL <= 0 {
+		return fmt.Errorf("token_ttl must be positive")
+	}
+
+	if c.BatchSize <= 0 {
+		return fmt.Errorf("batch_size must be positive")
+	}
+	if c.BatchTimeout <= 0 {
+		return fmt.Errorf("batch_timeout must be positive")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return fmt.Errorf("shutdown_timeout must be positive")
+	}
+
+	seen := map[string]bool{}
+	for _, topic := range []string{c.CoordinatesTopic, c.LocationsTopic, c.SessionsTopic, c.DLQTopic, c.GeofenceTopic, c.UsersTopic} {
+		if seen[topic] {
+			return fmt.Errorf("coordinates, locations, sessions, dlq, geofence and users topics must be distinct")
+		}
+		seen[topic] = true
+	}
+	return nil
+}
+
+// consumerConfig builds the librdkafka consumer configuration, applying overrides last
+func (c *Config) consumerConfig() *kafka.ConfigMap {
+	cm := &kafka.ConfigMap{
+		"bootstrap.servers": c.Broker,
+		"group.id":          c.GroupID,
+		"auto.offset.reset": "earliest",
+		// Offsets are committed explicitly once messages are stored
+		"enable.auto.commit": false,
+	}
+	for k, v := range c.KafkaOverrides {
+		cm.SetKey(k, v)
+	}
+	return cm
+}
+
+// producerConfig builds the librdkafka configuration for the DLQ, geofence and user event producers
+func (c *Config) producerConfig() *kafka.ConfigMap {
+	cm := &kafka.ConfigMap{
+		"bootstrap.servers": c.Broker,
+	}
+	for k, v := range c.KafkaOverrides {
+		cm.SetKey(k, v)
+	}
+	return cm
+}
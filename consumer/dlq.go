@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+// Headers attached to every dead-lettered message
+const (
+	dlqHeaderError     = "dlq.error"
+	dlqHeaderTopic     = "dlq.original.topic"
+	dlqHeaderPartition = "dlq.original.partition"
+	dlqHeaderOffset    = "dlq.original.offset"
+	dlqHeaderTimestamp = "dlq.original.timestamp"
+	dlqHeaderFailedAt  = "dlq.failed_at"
+
+	// dlqReadTimeout bounds how long a send, inspect or replay waits for the broker
+	dlqReadTimeout = 10 * time.Second
+)
+
+// DeadLetter is a failed message as shown by GET /dlq
+type DeadLetter struct {
+	DLQPartition int32  `json:"dlq_partition"`
+	DLQOffset    int64  `json:"dlq_offset"`
+	Topic        string `json:"topic"`
+	Partition    string `json:"partition"`
+	Offset       string `json:"offset"`
+	Timestamp    string `json:"timestamp,omitempty"`
+	FailedAt     string `json:"failed_at"`
+	Error        string `json:"error"`
+	Key          string `json:"key,omitempty"`
+	Value        string `json:"value"`
+
+	// ValueEncoding is "base64" when Value holds a binary (Protobuf or Avro) message
+	ValueEncoding string `json:"value_encoding,omitempty"`
+}
+
+// DeadLetterQueue forwards messages the consumer could not decode or store
+// to a Kafka topic, and reads them back for inspection and replay
+type DeadLetterQueue struct {
+	cfg      *Config
+	producer *kafka.Producer
+}
+
+// NewDeadLetterQueue creates the DLQ producer and starts draining its delivery reports
+func NewDeadLetterQueue(cfg *Config) (*DeadLetterQueue, error) {
+	p, err := kafka.NewProducer(cfg.producerConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for e := range p.Events() {
+			if m, ok := e.(*kafka.Message); ok && m.TopicPartition.Error != nil {
+				log.Printf("DLQ delivery failed: %v\n", m.TopicPartition.Error)
+			}
+		}
+	}()
+
+	return &DeadLetterQueue{cfg: cfg, producer: p}, nil
+}
+
+// Close flushes pending dead letters and closes the producer, reporting any
+// message that could not be delivered within timeout
+func (q *DeadLetterQueue) Close(timeout time.Duration) error {
+	remaining := q.producer.Flush(int(timeout.Milliseconds()))
+	q.producer.Close()
+	if remaining > 0 {
+		return fmt.Errorf("%d DLQ messages not delivered", remaining)
+	}
+	return nil
+}
+
+// Send forwards a failed message to the DLQ topic with headers describing the
+// failure, and waits for the broker to acknowledge it
+func (q *DeadLetterQueue) Send(msg *kafka.Message, cause error) error {
+	topic := ""
+	if msg.TopicPartition.Topic != nil {
+		topic = *msg.TopicPartition.Topic
+	}
+
+	headers := []kafka.Header{
+		{Key: dlqHeaderError, Value: []byte(cause.Error())},
+		{Key: dlqHeaderTopic, Value: []byte(topic)},
+		{Key: dlqHeaderPartition, Value: []byte(strconv.Itoa(int(msg.TopicPartition.Partition)))},
+		{Key: dlqHeaderOffset, Value: []byte(strconv.FormatInt(int64(msg.TopicPartition.Offset), 10))},
+		{Key: dlqHeaderFailedAt, Value: []byte(time.Now().UTC().Format(time.RFC3339))},
+	}
+	if !msg.Timestamp.IsZero() {
+		headers = append(headers, kafka.Header{Key: dlqHeaderTimestamp, Value: []byte(msg.Timestamp.UTC().Format(time.RFC3339))})
+	}
+
+	delivery := make(chan kafka.Event, 1)
+	err := q.producer.Produce(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &q.cfg.DLQTopic, Partition: kafka.PartitionAny},
+		Key:            msg.Key,
+		Value:          msg.Value,
+		Headers:        headers,
+	}, delivery)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case e := <-delivery:
+		if m, ok := e.(*kafka.Message); ok && m.TopicPartition.Error != nil {
+			return m.TopicPartition.Error
+		}
+	case <-time.After(dlqReadTimeout):
+		return fmt.Errorf("timed out waiting for DLQ delivery")
+	}
+
+	log.Printf("Dead-lettered %s [%d] @ %v: %v\n", topic, msg.TopicPartition.Partition, msg.TopicPartition.Offset, cause)
+	return nil
+}
+
+// read consumes the DLQ from the given group's committed position (or the
+// beginning) up to the current end of every partition, calling fn for each
+// message. The consumer is returned so the caller can commit if it wants to.
+func (q *DeadLetterQueue) read(groupID string, limit int, fn func(*kafka.Message) error) (*kafka.Consumer, error) {
+	cm := q.cfg.consumerConfig()
+	cm.SetKey("group.id", groupID)
+	cm.SetKey("enable.auto.commit", false)
+
+	c, err := kafka.NewConsumer(cm)
+	if err != nil {
+		return nil, err
+	}
+
+	md, err := c.GetMetadata(&q.cfg.DLQTopic, false, int(dlqReadTimeout.Milliseconds()))
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	tm, ok := md.Topics[q.cfg.DLQTopic]
+	if !ok || tm.Error.Code() == kafka.ErrUnknownTopicOrPart {
+		// Nothing has been dead-lettered yet
+		return c, nil
+	}
+
+	// Start from the committed offset, and stop at the current high watermark
+	var assign kafka.TopicPartitions
+	earliest := map[int32]kafka.Offset{}
+	remaining := map[int32]kafka.Offset{}
+	for _, p := range tm.Partitions {
+		low, high, err := c.QueryWatermarkOffsets(q.cfg.DLQTopic, p.ID, int(dlqReadTimeout.Milliseconds()))
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		assign = append(assign, kafka.TopicPartition{Topic: &q.cfg.DLQTopic, Partition: p.ID})
+		earliest[p.ID] = kafka.Offset(low)
+		remaining[p.ID] = kafka.Offset(high)
+	}
+
+	committed, err := c.Committed(assign, int(dlqReadTimeout.Milliseconds()))
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	for i := range committed {
+		if committed[i].Offset < earliest[committed[i].Partition] {
+			committed[i].Offset = earliest[committed[i].Partition]
+		}
+		if committed[i].Offset >= remaining[committed[i].Partition] {
+			delete(remaining, committed[i].Partition)
+		}
+	}
+	if err := c.Assign(committed); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	count := 0
+	deadline := time.Now().Add(dlqReadTimeout)
+	for len(remaining) > 0 && (limit <= 0 || count < limit) && time.Now().Before(deadline) {
+		ev := c.Poll(100)
+		msg, ok := ev.(*kafka.Message)
+		if !ok {
+			continue
+		}
+		if err := fn(msg); err != nil {
+			return c, err
+		}
+		count++
+		if msg.TopicPartition.Offset+1 >= remaining[msg.TopicPartition.Partition] {
+			delete(remaining, msg.TopicPartition.Partition)
+		}
+	}
+	return c, nil
+}
+
+// getDLQ handles the HTTP endpoint for inspecting dead-lettered messages
+func getDLQ(q *DeadLetterQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limitNum := 50 // default limit
+		if limit := r.URL.Query().Get("limit"); limit != "" {
+			if n, err := strconv.Atoi(limit); err == nil && n > 0 {
+				limitNum = n
+			}
+		}
+
+		// A throwaway group that never commits always reads from the beginning
+		groupID := fmt.Sprintf("%s-dlq-inspect-%d", q.cfg.GroupID, time.Now().UnixNano())
+		letters := []DeadLetter{}
+		c, err := q.read(groupID, limitNum, func(msg *kafka.Message) error {
+			letters = append(letters, toDeadLetter(msg))
+			return nil
+		})
+		if c != nil {
+			c.Close()
+		}
+		if err != nil {
+			log.Printf("Error reading DLQ: %v\n", err)
+			http.Error(w, "Error reading DLQ", http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(letters)
+	}
+}
+
+// replayDLQ handles POST /dlq/replay: it re-injects dead letters into their
+// original topics and commits the replay group's position so each message
+// is replayed once
+func replayDLQ(q *DeadLetterQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+
+		limitNum := 0 // replay everything by default
+		if limit := r.URL.Query().Get("limit"); limit != "" {
+			if n, err := strconv.Atoi(limit); err == nil && n > 0 {
+				limitNum = n
+			}
+		}
+
+		replayed := 0
+		next := map[int32]kafka.TopicPartition{}
+		c, err := q.read(q.cfg.GroupID+"-dlq-replay", limitNum, func(msg *kafka.Message) error {
+			topic := headerValue(msg, dlqHeaderTopic)
+			if topic == "" {
+				return fmt.Errorf("message at offset %v has no %s header", msg.TopicPartition.Offset, dlqHeaderTopic)
+			}
+
+			err := q.producer.Produce(&kafka.Message{
+				TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+				Key:            msg.Key,
+				Value:          msg.Value,
+			}, nil)
+			if err != nil {
+				return err
+			}
+
+			replayed++
+			tp := msg.TopicPartition
+			tp.Offset++
+			next[tp.Partition] = tp
+			return nil
+		})
+		if c != nil {
+			defer c.Close()
+		}
+
+		// Only advance the replay group past messages that were re-produced
+		if remaining := q.producer.Flush(int(dlqReadTimeout.Milliseconds())); remaining > 0 {
+			err = fmt.Errorf("%d replayed messages not delivered", remaining)
+		} else if c != nil && len(next) > 0 {
+			offsets := make([]kafka.TopicPartition, 0, len(next))
+			for _, tp := range next {
+				offsets = append(offsets, tp)
+			}
+			if _, cerr := c.CommitOffsets(offsets); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+
+		if err != nil {
+			log.Printf("Error replaying DLQ: %v\n", err)
+			http.Error(w, "Error replaying DLQ: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		log.Printf("Replayed %d messages from DLQ\n", replayed)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"replayed": replayed})
+	}
+}
+
+// toDeadLetter converts a DLQ message into its API representation
+func toDeadLetter(msg *kafka.Message) DeadLetter {
+	dl := DeadLetter{
+		DLQPartition: msg.TopicPartition.Partition,
+		DLQOffset:    int64(msg.TopicPartition.Offset),
+		Topic:        headerValue(msg, dlqHeaderTopic),
+		Partition:    headerValue(msg, dlqHeaderPartition),
+		Offset:       headerValue(msg, dlqHeaderOffset),
+		Timestamp:    headerValue(msg, dlqHeaderTimestamp),
+		FailedAt:     headerValue(msg, dlqHeaderFailedAt),
+		Error:        headerValue(msg, dlqHeaderError),
+		Key:          string(msg.Key),
+		Value:        string(msg.Value),
+	}
+	// Framed binary messages start with a zero magic byte
+	if len(msg.Value) > 0 && (msg.Value[0] == 0 || !utf8.Valid(msg.Value)) {
+		dl.Value = base64.StdEncoding.EncodeToString(msg.Value)
+		dl.ValueEncoding = "base64"
+	}
+	return dl
+}
+
+// headerValue returns the value of the named message header, or ""
+func headerValue(msg *kafka.Message, key string) string {
+	for _, h := range msg.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// trackSegment is the ordered list of points recorded for one session
+type trackSegment struct {
+	SessionID string
+	Points    []CoordinateEvent
+}
+
+// GPX 1.1 document structure (only the elements we emit)
+type gpxDoc struct {
+	XMLName xml.Name `xml:"gpx"`
+	Version string   `xml:"version,attr"`
+	Creator string   `xml:"creator,attr"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Tracks  []gpxTrk `xml:"trk"`
+}
+
+type gpxTrk struct {
+	Name     string      `xml:"name"`
+	Segments []gpxTrkSeg `xml:"trkseg"`
+}
+
+type gpxTrkSeg struct {
+	Points []gpxTrkPt `xml:"trkpt"`
+}
+
+type gpxTrkPt struct {
+	Lat  float64  `xml:"lat,attr"`
+	Lon  float64  `xml:"lon,attr"`
+	Ele  *float64 `xml:"ele,omitempty"`
+	Time string   `xml:"time,omitempty"`
+}
+
+// GeoJSON structures for a FeatureCollection of session tracks
+type geoJSONCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   geoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+// exportTrack handles /users/{id}/track.gpx and /users/{id}/track.geojson
+func exportTrack(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Expect /users/{id}/track.{gpx,geojson}
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/users/"), "/"), "/")
+		if len(parts) != 2 || parts[0] == "" {
+			http.NotFound(w, r)
+			return
+		}
+		userID, file := parts[0], parts[1]
+		if file != "track.gpx" && file != "track.geojson" {
+			http.NotFound(w, r)
+			return
+		}
+
+		from, to, err := parseTimeRange(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		segments, err := loadTrack(r.Context(), store, userID, from, to)
+		if err != nil {
+			log.Printf("Error querying database: %v\n", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		if file == "track.gpx" {
+			writeGPX(w, userID, segments)
+		} else {
+			writeGeoJSON(w, userID, segments)
+		}
+	}
+}
+
+// loadTrack reads a user's coordinates in time order, grouped by session
+func loadTrack(ctx context.Context, store Store, userID, from, to string) ([]trackSegment, error) {
+	points, err := store.Track(ctx, userID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []trackSegment{}
+	index := map[string]int{}
+	for _, event := range points {
+		i, ok := index[event.SessionID]
+		if !ok {
+			i = len(segments)
+			index[event.SessionID] = i
+			segments = append(segments, trackSegment{SessionID: event.SessionID})
+		}
+		segments[i].Points = append(segments[i].Points, event)
+	}
+	return segments, nil
+}
+
+// writeGPX renders the track as a GPX 1.1 document with one segment per session
+func writeGPX(w http.ResponseWriter, userID string, segments []trackSegment) {
+	trk := gpxTrk{Name: userID}
+	for _, seg := range segments {
+		var s gpxTrkSeg
+		for _, p := range seg.Points {
+			s.Points = append(s.Points, gpxTrkPt{Lat: p.Lat, Lon: p.Lon, Ele: p.Ele, Time: p.Timestamp})
+		}
+		trk.Segments = append(trk.Segments, s)
+	}
+
+	doc := gpxDoc{
+		Version: "1.1",
+		Creator: "garmin-mock",
+		Xmlns:   "http://www.topografix.com/GPX/1/1",
+		Tracks:  []gpxTrk{trk},
+	}
+
+	w.Header().Set("Content-Type", "application/gpx+xml")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": userID + ".gpx"}))
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		log.Printf("Error encoding GPX: %v\n", err)
+	}
+}
+
+// writeGeoJSON renders the track as a FeatureCollection with one feature per session
+func writeGeoJSON(w http.ResponseWriter, userID string, segments []trackSegment) {
+	collection := geoJSONCollection{Type: "FeatureCollection", Features: []geoJSONFeature{}}
+	for _, seg := range segments {
+		coords := make([][2]float64, 0, len(seg.Points))
+		times := make([]string, 0, len(seg.Points))
+		for _, p := range seg.Points {
+			coords = append(coords, [2]float64{p.Lon, p.Lat})
+			times = append(times, p.Timestamp)
+		}
+
+		// A LineString needs two positions; a lone fix is exported as a Point
+		geometry := geoJSONGeometry{Type: "LineString", Coordinates: coords}
+		if len(coords) == 1 {
+			geometry = geoJSONGeometry{Type: "Point", Coordinates: coords[0]}
+		}
+
+		collection.Features = append(collection.Features, geoJSONFeature{
+			Type:     "Feature",
+			Geometry: geometry,
+			Properties: map[string]interface{}{
+				"user_id":    userID,
+				"session_id": seg.SessionID,
+				"start_time": times[0],
+				"end_time":   times[len(times)-1],
+				"times":      times,
+			},
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/geo+json")
+	json.NewEncoder(w).Encode(collection)
+}
@@ -0,0 +1,87 @@
+package main
+
+import "math"
+
+const earthRadiusMeters = 6371000.0
+
+// haversine returns the great-circle distance between two points in metres
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	phi1 := lat1 * math.Pi / 180
+	phi2 := lat2 * math.Pi / 180
+	dPhi := phi2 - phi1
+	dLambda := (lon2 - lon1) * math.Pi / 180
+
+	h := math.Sin(dPhi/2)*math.Sin(dPhi/2) +
+		math.Cos(phi1)*math.Cos(phi2)*math.Sin(dLambda/2)*math.Sin(dLambda/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Sqrt(h))
+}
+
+// circleBBox returns the box enclosing a circle, used to prefilter by an index
+// before the exact distance check
+func circleBBox(center Point, radiusM float64) BoundingBox {
+	// Degrees of latitude are ~111 km everywhere; longitude shrinks with cos(lat)
+	dLat := radiusM / earthRadiusMeters * 180 / math.Pi
+	dLon := 180.0
+	if c := math.Cos(center.Lat * math.Pi / 180); c > 1e-6 {
+		dLon = math.Min(dLat/c, 180)
+	}
+	return BoundingBox{
+		MinLat: center.Lat - dLat, MaxLat: center.Lat + dLat,
+		MinLon: center.Lon - dLon, MaxLon: center.Lon + dLon,
+	}
+}
+
+// polygonBBox returns the box enclosing a polygon
+func polygonBBox(polygon []Point) BoundingBox {
+	bbox := BoundingBox{MinLat: 90, MinLon: 180, MaxLat: -90, MaxLon: -180}
+	for _, p := range polygon {
+		bbox.MinLat = math.Min(bbox.MinLat, p.Lat)
+		bbox.MinLon = math.Min(bbox.MinLon, p.Lon)
+		bbox.MaxLat = math.Max(bbox.MaxLat, p.Lat)
+		bbox.MaxLon = math.Max(bbox.MaxLon, p.Lon)
+	}
+	return bbox
+}
+
+// polygonContains reports whether a position lies inside a polygon by ray
+// casting. Treating lat/lon as planar is fine at city scale.
+func polygonContains(polygon []Point, lat, lon float64) bool {
+	inside := false
+	n := len(polygon)
+	for i, j := 0, n-1; i < n; j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a.Lat > lat) != (b.Lat > lat) &&
+			lon < (b.Lon-a.Lon)*(lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// polygonSelfIntersects reports whether any two non-adjacent edges of a
+// polygon cross, which MongoDB rejects and ray casting answers arbitrarily for
+func polygonSelfIntersects(polygon []Point) bool {
+	n := len(polygon)
+	for i := 0; i < n; i++ {
+		for j := i + 2; j < n; j++ {
+			if i == 0 && j == n-1 {
+				continue // the closing edge shares a vertex with the first
+			}
+			if segmentsCross(polygon[i], polygon[i+1], polygon[j], polygon[(j+1)%n]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// segmentsCross reports whether segments ab and cd cross at a single interior point
+func segmentsCross(a, b, c, d Point) bool {
+	orient := func(p, q, r Point) float64 {
+		return (q.Lon-p.Lon)*(r.Lat-p.Lat) - (q.Lat-p.Lat)*(r.Lon-p.Lon)
+	}
+	d1, d2 := orient(c, d, a), orient(c, d, b)
+	d3, d4 := orient(a, b, c), orient(a, b, d)
+	return ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) &&
+		((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0))
+}
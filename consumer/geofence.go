@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+
+	"shared/events"
+)
+
+const (
+	GeofenceCircle  = "circle"
+	GeofencePolygon = "polygon"
+
+	GeofenceEnter = events.GeofenceEnter
+	GeofenceExit  = events.GeofenceExit
+)
+
+// Point is a latitude/longitude pair
+type Point struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// Geofence is a named circular or polygonal area
+type Geofence struct {
+	ID        int64   `json:"id"`
+	Name      string  `json:"name"`
+	Type      string  `json:"type"`
+	Center    *Point  `json:"center,omitempty"`   // circle only
+	RadiusM   float64 `json:"radius_m,omitempty"` // circle only
+	Polygon   []Point `json:"polygon,omitempty"`  // polygon only, implicitly closed
+	CreatedAt string  `json:"created_at,omitempty"`
+
+	bbox BoundingBox // cheap prefilter for Contains
+}
+
+// GeofenceEvent records a user entering or leaving a geofence
+type GeofenceEvent = events.GeofenceEvent
+
+// validate checks a fence's geometry and fills in its bounding box
+func (g *Geofence) validate() error {
+	g.Name = strings.TrimSpace(g.Name)
+	if g.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+
+	switch g.Type {
+	case GeofenceCircle:
+		if g.Center == nil {
+			return fmt.Errorf("center is required for a circle")
+		}
+		if err := validPoint(*g.Center); err != nil {
+			return fmt.Errorf("center: %w", err)
+		}
+		if g.RadiusM <= 0 {
+			return fmt.Errorf("radius_m must be positive")
+		}
+		g.Polygon = nil
+		g.bbox = circleBBox(*g.Center, g.RadiusM)
+
+	case GeofencePolygon:
+		if len(g.Polygon) < 3 {
+			return fmt.Errorf("polygon needs at least 3 points")
+		}
+		g.Center, g.RadiusM = nil, 0
+		for i, p := range g.Polygon {
+			if err := validPoint(p); err != nil {
+				return fmt.Errorf("polygon[%d]: %w", i, err)
+			}
+		}
+		g.bbox = polygonBBox(g.Polygon)
+
+	default:
+		return fmt.Errorf("type must be %q or %q", GeofenceCircle, GeofencePolygon)
+	}
+	return nil
+}
+
+// validPoint checks that a point is a real position
+func validPoint(p Point) error {
+	if p.Lat < -90 || p.Lat > 90 {
+		return fmt.Errorf("lat must be between -90 and 90")
+	}
+	if p.Lon < -180 || p.Lon > 180 {
+		return fmt.Errorf("lon must be between -180 and 180")
+	}
+	return nil
+}
+
+// Contains reports whether a position lies inside the fence
+func (g *Geofence) Contains(lat, lon float64) bool {
+	if lat < g.bbox.MinLat || lat > g.bbox.MaxLat || lon < g.bbox.MinLon || lon > g.bbox.MaxLon {
+		return false
+	}
+	if g.Type == GeofenceCircle {
+		return haversine(g.Center.Lat, g.Center.Lon, lat, lon) <= g.RadiusM
+	}
+	return polygonContains(g.Polygon, lat, lon)
+}
+
+// Geofencer keeps the fences in memory, evaluates stored coordinates against
+// them and publishes the resulting enter/exit events
+type Geofencer struct {
+	cfg        *Config
+	store      Store
+	producer   *kafka.Producer
+	serializer *events.Serializer
+
+	mu     sync.RWMutex
+	fences map[int64]*Geofence
+}
+
+// NewGeofencer loads the stored fences and creates the event producer
+func NewGeofencer(cfg *Config, store Store, serializer *events.Serializer) (*Geofencer, error) {
+	g := &Geofencer{cfg: cfg, store: store, serializer: serializer, fences: map[int64]*Geofence{}}
+
+	fences, err := store.Geofences(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	for _, fence := range fences {
+		if err := fence.validate(); err != nil {
+			return nil, fmt.Errorf("geofence %d: %w", fence.ID, err)
+		}
+		g.fences[fence.ID] = fence
+	}
+
+	p, err := kafka.NewProducer(cfg.producerConfig())
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for e := range p.Events() {
+			if m, ok := e.(*kafka.Message); ok && m.TopicPartition.Error != nil {
+				log.Printf("Geofence event delivery failed: %v\n", m.TopicPartition.Error)
+			}
+		}
+	}()
+	g.producer = p
+
+	log.Printf("Loaded %d geofences\n", len(g.fences))
+	return g, nil
+}
+
+// Close flushes pending geofence events and closes the producer
+func (g *Geofencer) Close(timeout time.Duration) error {
+	remaining := g.producer.Flush(int(timeout.Milliseconds()))
+	g.producer.Close()
+	if remaining > 0 {
+		return fmt.Errorf("%d geofence events not delivered", remaining)
+	}
+	return nil
+}
+
+// Evaluate compares a stored coordinate with every fence and records an
+// event wherever the user's inside/outside state changes. It runs inside the
+// ingest batch so state and events commit with the coordinate.
+func (g *Geofencer) Evaluate(b Batch, event CoordinateEvent) ([]GeofenceEvent, error) {
+	// Fences the user was inside last time must be checked for exits even
+	// when the new point is far away
+	wasInside, err := b.InsideGeofences(event.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	g.mu.RLock()
+	changed := []*Geofence{}
+	for id, fence := range g.fences {
+		if fence.Contains(event.Lat, event.Lon) != wasInside[id] {
+			changed = append(changed, fence)
+		}
+	}
+	g.mu.RUnlock()
+	sort.Slice(changed, func(i, j int) bool { return changed[i].ID < changed[j].ID })
+
+	events := []GeofenceEvent{}
+	for _, fence := range changed {
+		ge := GeofenceEvent{
+			Type:         GeofenceEnter,
+			GeofenceID:   fence.ID,
+			GeofenceName: fence.Name,
+			UserID:       event.UserID,
+			SessionID:    event.SessionID,
+			Lat:          event.Lat,
+			Lon:          event.Lon,
+			Timestamp:    event.Timestamp,
+		}
+		if wasInside[fence.ID] {
+			ge.Type = GeofenceExit
+		}
+
+		if err := b.SetGeofenceState(event.UserID, fence.ID, ge.Type == GeofenceEnter, event.Timestamp); err != nil {
+			return nil, err
+		}
+		if err := b.InsertGeofenceEvent(ge); err != nil {
+			return nil, err
+		}
+		events = append(events, ge)
+	}
+	return events, nil
+}
+
+// Publish produces committed geofence events to the geofence topic
+func (g *Geofencer) Publish(events []GeofenceEvent) {
+	for _, ge := range events {
+		data, err := g.serializer.Marshal(&ge)
+		if err != nil {
+			log.Printf("Error marshaling geofence event: %v\n", err)
+			continue
+		}
+
+		err = g.producer.Produce(&kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &g.cfg.GeofenceTopic, Partition: kafka.PartitionAny},
+			Key:            []byte(ge.UserID),
+			Value:          data,
+		}, nil)
+		if err != nil {
+			log.Printf("Error producing geofence event: %v\n", err)
+			continue
+		}
+		log.Printf("Geofence %s: UserID=%s, Geofence=%s\n", ge.Type, ge.UserID, ge.GeofenceName)
+	}
+}
+
+// list returns the fences ordered by ID
+func (g *Geofencer) list() []Geofence {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	fences := make([]Geofence, 0, len(g.fences))
+	for _, fence := range g.fences {
+		fences = append(fences, *fence)
+	}
+	sort.Slice(fences, func(i, j int) bool { return fences[i].ID < fences[j].ID })
+	return fences
+}
+
+// get returns one fence
+func (g *Geofencer) get(id int64) (Geofence, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	fence, ok := g.fences[id]
+	if !ok {
+		return Geofence{}, false
+	}
+	return *fence, true
+}
+
+// save inserts a new fence (ID 0) or replaces an existing one
+func (g *Geofencer) save(ctx context.Context, fence Geofence) (Geofence, error) {
+	// The store is written without holding mu: the ingest transaction
+	// holds SQLite's write lock while it waits for mu in Evaluate
+	if fence.ID == 0 {
+		fence.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+		id, err := g.store.InsertGeofence(ctx, fence)
+		if err != nil {
+			return fence, err
+		}
+		fence.ID = id
+	} else {
+		existing, ok := g.get(fence.ID)
+		if !ok {
+			return fence, errNotFound
+		}
+		fence.CreatedAt = existing.CreatedAt
+		if err := g.store.UpdateGeofence(ctx, fence); err != nil {
+			return fence, err
+		}
+	}
+
+	stored := fence
+	g.mu.Lock()
+	g.fences[fence.ID] = &stored
+	g.mu.Unlock()
+	return fence, nil
+}
+
+// remove deletes a fence and forgets which users were inside it
+func (g *Geofencer) remove(ctx context.Context, id int64) error {
+	if _, ok := g.get(id); !ok {
+		return errNotFound
+	}
+	if err := g.store.DeleteGeofence(ctx, id); err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	delete(g.fences, id)
+	g.mu.Unlock()
+	return nil
+}
+
+// geofences handles /geofences (list, create) and /geofences/{id} (get, replace, delete)
+func geofences(g *Geofencer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/geofences"), "/")
+		if rest == "" {
+			switch r.Method {
+			case http.MethodGet:
+				writeJSON(w, http.StatusOK, g.list())
+			case http.MethodPost:
+				saveGeofence(w, r, g, 0)
+			default:
+				http.Error(w, "GET or POST only", http.StatusMethodNotAllowed)
+			}
+			return
+		}
+
+		id, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil || id <= 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			fence, ok := g.get(id)
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			writeJSON(w, http.StatusOK, fence)
+		case http.MethodPut:
+			saveGeofence(w, r, g, id)
+		case http.MethodDelete:
+			if err := g.remove(r.Context(), id); err == errNotFound {
+				http.NotFound(w, r)
+			} else if err != nil {
+				log.Printf("Error deleting geofence: %v\n", err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+			} else {
+				w.WriteHeader(http.StatusNoContent)
+			}
+		default:
+			http.Error(w, "GET, PUT or DELETE only", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// saveGeofence decodes, validates and stores a fence from the request body
+func saveGeofence(w http.ResponseWriter, r *http.Request, g *Geofencer, id int64) {
+	var fence Geofence
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&fence); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := fence.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fence.ID = id
+
+	saved, err := g.save(r.Context(), fence)
+	if err == errNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Error saving geofence: %v\n", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if id == 0 {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, saved)
+}
+
+// getGeofenceEvents handles the HTTP endpoint for listing enter/exit events
+func getGeofenceEvents(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get query parameters
+		userID := r.URL.Query().Get("user_id")
+		geofenceID := r.URL.Query().Get("geofence_id")
+		limitNum, err := parseLimit(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		from, to, err := parseTimeRange(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		q := GeofenceEventQuery{UserID: userID, From: from, To: to, Limit: limitNum}
+		if geofenceID != "" {
+			if q.GeofenceID, err = strconv.ParseInt(geofenceID, 10, 64); err != nil || q.GeofenceID <= 0 {
+				http.Error(w, "invalid geofence_id", http.StatusBadRequest)
+				return
+			}
+		}
+
+		events, err := store.GeofenceEvents(r.Context(), q)
+		if err != nil {
+			log.Printf("Error querying database: %v\n", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		// Return JSON response
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(events)
+	}
+}
+
+// writeJSON writes v as a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
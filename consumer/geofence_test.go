@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestGeofenceContains(t *testing.T) {
+	circle := &Geofence{Name: "Hyde Park", Type: GeofenceCircle, Center: &Point{Lat: 51.5073, Lon: -0.1657}, RadiusM: 500}
+	// An L-shaped block, so the notch at its top right is inside the
+	// bounding box but outside the fence
+	polygon := &Geofence{Name: "Block", Type: GeofencePolygon, Polygon: []Point{
+		{Lat: 0, Lon: 0}, {Lat: 0, Lon: 2}, {Lat: 1, Lon: 2}, {Lat: 1, Lon: 1}, {Lat: 2, Lon: 1}, {Lat: 2, Lon: 0},
+	}}
+	for _, g := range []*Geofence{circle, polygon} {
+		if err := g.validate(); err != nil {
+			t.Fatalf("validate %s: %v", g.Name, err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		fence    *Geofence
+		lat, lon float64
+		want     bool
+	}{
+		{"circle centre", circle, 51.5073, -0.1657, true},
+		{"circle 300m north", circle, 51.5100, -0.1657, true},
+		{"circle 600m north", circle, 51.5127, -0.1657, false},
+		{"circle corner of its box", circle, 51.5115, -0.1590, false},
+		{"circle far away", circle, 48.8566, 2.3522, false},
+		{"polygon inside", polygon, 0.5, 0.5, true},
+		{"polygon inside the foot", polygon, 0.5, 1.5, true},
+		{"polygon notch", polygon, 1.5, 1.5, false},
+		{"polygon outside its box", polygon, 3, 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.fence.Contains(tt.lat, tt.lon); got != tt.want {
+				t.Errorf("Contains(%v, %v) = %v, want %v", tt.lat, tt.lon, got, tt.want)
+			}
+		})
+	}
+}
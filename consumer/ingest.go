@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+
+	"shared/events"
+)
+
+// retryDelay is how long the poll loop backs off after a batch could not be written
+var retryDelay = time.Second
+
+// Ingester writes batches of Kafka messages to the store as one Batch and
+// commits their offsets once the batch is durable
+type Ingester struct {
+	cfg        *Config
+	store      Store
+	serializer *events.Serializer
+	hub        *StreamHub
+	dlq        *DeadLetterQueue
+	stats      *IngestStats
+	metrics    *Metrics
+	geofencer  *Geofencer
+}
+
+// offsetCommitter is the part of *kafka.Consumer that Flush commits and
+// rewinds offsets with
+type offsetCommitter interface {
+	CommitOffsets(offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error)
+	Seek(partition kafka.TopicPartition, ignoredTimeoutMs int) error
+}
+
+// partitionKey identifies a partition across topics: the consumer reads
+// several topics, and their partition numbers overlap
+type partitionKey struct {
+	topic     string
+	partition int32
+}
+
+func keyOf(tp kafka.TopicPartition) partitionKey {
+	return partitionKey{topic: *tp.Topic, partition: tp.Partition}
+}
+
+// failedMessage is a message that could not be stored and must be dead-lettered
+type failedMessage struct {
+	msg *kafka.Message
+	err error
+}
+
+// Flush stores a batch and commits its offsets. Messages that fail on their
+// own are dead-lettered; if the batch as a whole cannot be written, every
+// partition is rewound so the batch is redelivered. The returned error
+// reports messages that were not stored and committed.
+func (in *Ingester) Flush(c offsetCommitter, batch []*kafka.Message) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	start := time.Now()
+
+	b, err := in.store.Begin(context.Background())
+	if err != nil {
+		log.Printf("Error starting transaction: %v\n", err)
+		in.rewind(c, batch)
+		return err
+	}
+
+	published := []CoordinateEvent{}
+	crossings := []GeofenceEvent{}
+	failed := []failedMessage{}
+
+	for _, msg := range batch {
+		// A savepoint per message lets one bad message fail without
+		// discarding the rest of the batch
+		if err := b.Savepoint(); err != nil {
+			log.Printf("Error creating savepoint: %v\n", err)
+			b.Rollback()
+			in.rewind(c, batch)
+			return err
+		}
+
+		var event *CoordinateEvent
+		var fenced []GeofenceEvent
+		var err error
+		switch *msg.TopicPartition.Topic {
+		case in.cfg.CoordinatesTopic:
+			event, err = storeCoordinate(in.serializer, b, msg)
+			if err == nil && event != nil {
+				fenced, err = in.geofencer.Evaluate(b, *event)
+			}
+		case in.cfg.LocationsTopic:
+			err = storeLocation(in.serializer, b, msg)
+		case in.cfg.SessionsTopic:
+			err = storeSession(in.serializer, b, msg.Value)
+		default:
+			log.Printf("Ignoring message from unexpected topic: %s\n", *msg.TopicPartition.Topic)
+		}
+
+		if err != nil {
+			log.Printf("Error storing message from %s: %v\n", *msg.TopicPartition.Topic, err)
+			b.RollbackTo()
+			failed = append(failed, failedMessage{msg: msg, err: err})
+		} else if event != nil {
+			published = append(published, *event)
+			crossings = append(crossings, fenced...)
+		}
+		b.Release()
+	}
+
+	if err := b.Commit(); err != nil {
+		log.Printf("Error committing batch of %d messages: %v\n", len(batch), err)
+		in.rewind(c, batch)
+		return err
+	}
+
+	// Dead-letter individual failures. A partition whose failure cannot be
+	// dead-lettered is committed only up to that message and rewound to it.
+	blocked := map[partitionKey]kafka.TopicPartition{}
+	for _, f := range failed {
+		p := keyOf(f.msg.TopicPartition)
+		if _, ok := blocked[p]; ok {
+			continue
+		}
+		if err := in.dlq.Send(f.msg, f.err); err != nil {
+			log.Printf("Error dead-lettering message, will retry: %v\n", err)
+			blocked[p] = f.msg.TopicPartition
+		}
+	}
+
+	// Commit the next offset to read for every partition in the batch
+	next := map[partitionKey]kafka.TopicPartition{}
+	for _, msg := range batch {
+		tp := msg.TopicPartition
+		key := keyOf(tp)
+		if b, ok := blocked[key]; ok {
+			next[key] = b
+			continue
+		}
+		tp.Offset++
+		if cur, ok := next[key]; !ok || tp.Offset > cur.Offset {
+			next[key] = tp
+		}
+	}
+	offsets := make([]kafka.TopicPartition, 0, len(next))
+	for _, tp := range next {
+		offsets = append(offsets, tp)
+	}
+	_, commitErr := c.CommitOffsets(offsets)
+	if commitErr != nil {
+		log.Printf("Error committing offsets %v: %v\n", offsets, commitErr)
+	}
+	for _, tp := range blocked {
+		if err := c.Seek(tp, 0); err != nil {
+			log.Printf("Error seeking to %v: %v\n", tp, err)
+		}
+	}
+
+	// Only announce rows once they are committed
+	for _, event := range published {
+		in.hub.Publish(event)
+	}
+	in.geofencer.Publish(crossings)
+
+	dropped := map[*kafka.Message]bool{}
+	for _, f := range failed {
+		dropped[f.msg] = true
+		in.metrics.dropped.Inc(*f.msg.TopicPartition.Topic)
+	}
+	for _, msg := range batch {
+		if !dropped[msg] {
+			in.metrics.stored.Inc(*msg.TopicPartition.Topic)
+		}
+	}
+	in.metrics.batchDuration.Observe(time.Since(start).Seconds())
+	in.stats.Record(len(batch), len(failed), time.Since(start))
+	log.Printf("Stored batch: %d messages (%d failed) in %v\n", len(batch), len(failed), time.Since(start))
+
+	if len(blocked) > 0 {
+		time.Sleep(retryDelay)
+		return fmt.Errorf("%d partitions waiting to dead-letter a message", len(blocked))
+	}
+	if commitErr != nil {
+		return fmt.Errorf("committing offsets: %w", commitErr)
+	}
+	return nil
+}
+
+// rewind seeks every partition in the batch back to its first message so the
+// whole batch is redelivered, then backs off briefly
+func (in *Ingester) rewind(c offsetCommitter, batch []*kafka.Message) {
+	first := map[partitionKey]kafka.TopicPartition{}
+	for _, msg := range batch {
+		tp := msg.TopicPartition
+		key := keyOf(tp)
+		if cur, ok := first[key]; !ok || tp.Offset < cur.Offset {
+			first[key] = tp
+		}
+	}
+	for _, tp := range first {
+		if err := c.Seek(tp, 0); err != nil {
+			log.Printf("Error seeking to %v: %v\n", tp, err)
+		}
+	}
+	time.Sleep(retryDelay)
+}
+
+// IngestStats tracks ingestion throughput and batch write latency
+type IngestStats struct {
+	mu           sync.Mutex
+	started      time.Time
+	lastFlush    time.Time
+	messages     int64
+	failed       int64
+	batches      int64
+	lastBatch    int
+	lastLatency  time.Duration
+	maxLatency   time.Duration
+	totalLatency time.Duration
+	rate         float64 // exponentially weighted messages per second
+}
+
+// NewIngestStats creates an empty stats tracker
+func NewIngestStats() *IngestStats {
+	now := time.Now()
+	return &IngestStats{started: now, lastFlush: now}
+}
+
+// Record adds one flushed batch to the statistics
+func (s *IngestStats) Record(size, failed int, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if elapsed := now.Sub(s.lastFlush).Seconds(); elapsed > 0 {
+		instant := float64(size) / elapsed
+		if s.batches == 0 {
+			s.rate = instant
+		} else {
+			s.rate = 0.8*s.rate + 0.2*instant
+		}
+	}
+	s.lastFlush = now
+
+	s.messages += int64(size)
+	s.failed += int64(failed)
+	s.batches++
+	s.lastBatch = size
+	s.lastLatency = latency
+	s.totalLatency += latency
+	if latency > s.maxLatency {
+		s.maxLatency = latency
+	}
+}
+
+// IngestSnapshot is the JSON form of IngestStats
+type IngestSnapshot struct {
+	Messages       int64   `json:"messages"`
+	Failed         int64   `json:"failed"`
+	Batches        int64   `json:"batches"`
+	MessagesPerSec float64 `json:"messages_per_sec"`
+	AvgPerSec      float64 `json:"avg_messages_per_sec"`
+	LastBatchSize  int     `json:"last_batch_size"`
+	LastBatchMs    float64 `json:"last_batch_ms"`
+	AvgBatchMs     float64 `json:"avg_batch_ms"`
+	MaxBatchMs     float64 `json:"max_batch_ms"`
+}
+
+// Snapshot returns a consistent copy of the statistics
+func (s *IngestStats) Snapshot() IngestSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := IngestSnapshot{
+		Messages:       s.messages,
+		Failed:         s.failed,
+		Batches:        s.batches,
+		MessagesPerSec: s.rate,
+		LastBatchSize:  s.lastBatch,
+		LastBatchMs:    ms(s.lastLatency),
+		MaxBatchMs:     ms(s.maxLatency),
+	}
+	if uptime := time.Since(s.started).Seconds(); uptime > 0 {
+		snap.AvgPerSec = float64(s.messages) / uptime
+	}
+	if s.batches > 0 {
+		snap.AvgBatchMs = ms(s.totalLatency) / float64(s.batches)
+	}
+	return snap
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// getIngestStats handles the HTTP endpoint for ingestion statistics
+func getIngestStats(stats *IngestStats) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats.Snapshot())
+	}
+}
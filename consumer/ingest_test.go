@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+
+	"shared/events"
+)
+
+// newTestSerializer returns a JSON serializer over an in-memory registry
+func newTestSerializer(t *testing.T) *events.Serializer {
+	t.Helper()
+	reg, err := events.OpenRegistry("")
+	if err != nil {
+		t.Fatalf("OpenRegistry: %v", err)
+	}
+	ser, err := events.NewSerializer(events.FormatJSON, reg)
+	if err != nil {
+		t.Fatalf("NewSerializer: %v", err)
+	}
+	return ser
+}
+
+// fakeConsumer records the offsets Flush commits and seeks to
+type fakeConsumer struct {
+	committed []kafka.TopicPartition
+	seeks     []kafka.TopicPartition
+}
+
+func (c *fakeConsumer) CommitOffsets(offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error) {
+	c.committed = append(c.committed, offsets...)
+	return offsets, nil
+}
+
+func (c *fakeConsumer) Seek(tp kafka.TopicPartition, _ int) error {
+	c.seeks = append(c.seeks, tp)
+	return nil
+}
+
+// failingStore makes Begin, a Savepoint or Commit fail
+type failingStore struct {
+	Store
+	failBegin, failSavepoint, failCommit bool
+}
+
+var errInjected = errors.New("injected failure")
+
+func (s *failingStore) Begin(ctx context.Context) (Batch, error) {
+	if s.failBegin {
+		return nil, errInjected
+	}
+	b, err := s.Store.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &failingBatch{Batch: b, store: s}, nil
+}
+
+type failingBatch struct {
+	Batch
+	store *failingStore
+}
+
+func (b *failingBatch) Savepoint() error {
+	if b.store.failSavepoint {
+		return errInjected
+	}
+	return b.Batch.Savepoint()
+}
+
+func (b *failingBatch) Commit() error {
+	if b.store.failCommit {
+		b.Batch.Rollback()
+		return errInjected
+	}
+	return b.Batch.Commit()
+}
+
+// mixedBatch returns messages from all three topics, every one on partition 0
+func mixedBatch(t *testing.T, cfg *Config, ser *events.Serializer) []*kafka.Message {
+	t.Helper()
+	msg := func(topic *string, offset int64, e events.Event) *kafka.Message {
+		data, err := ser.Marshal(e)
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		return &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: topic, Partition: 0, Offset: kafka.Offset(offset)},
+			Value:          data,
+		}
+	}
+	ts := "2026-10-16T10:00:00Z"
+	return []*kafka.Message{
+		msg(&cfg.SessionsTopic, 3, &SessionEvent{Type: events.SessionStart, SessionID: "s1", UserID: "u1", Activity: "running", Timestamp: ts}),
+		msg(&cfg.CoordinatesTopic, 40, &CoordinateEvent{UserID: "u1", SessionID: "s1", Lat: 51.5, Lon: -0.1, Timestamp: ts}),
+		msg(&cfg.LocationsTopic, 7, &LocationEvent{UserID: "u1", Location: "Park", Lat: 51.5, Lon: -0.1, Timestamp: ts}),
+		msg(&cfg.CoordinatesTopic, 41, &CoordinateEvent{UserID: "u1", SessionID: "s1", Lat: 51.501, Lon: -0.1, Timestamp: "2026-10-16T10:00:05Z"}),
+		msg(&cfg.SessionsTopic, 4, &SessionEvent{Type: events.SessionEnd, SessionID: "s1", UserID: "u1", Activity: "running", Timestamp: "2026-10-16T10:00:05Z"}),
+	}
+}
+
+// offsetsByTopic flattens recorded positions for comparison
+func offsetsByTopic(tps []kafka.TopicPartition) map[string]kafka.Offset {
+	out := map[string]kafka.Offset{}
+	for _, tp := range tps {
+		if _, dup := out[*tp.Topic]; dup {
+			out[*tp.Topic+" (again)"] = tp.Offset
+			continue
+		}
+		out[*tp.Topic] = tp.Offset
+	}
+	return out
+}
+
+func TestFlushMixedTopics(t *testing.T) {
+	retryDelay = 0
+
+	tests := []struct {
+		name          string
+		store         failingStore
+		wantErr       bool
+		wantCommitted map[string]kafka.Offset
+		wantSeeks     map[string]kafka.Offset
+	}{
+		{
+			name:          "commits the next offset of every topic",
+			wantCommitted: map[string]kafka.Offset{"coordinates": 42, "locations": 8, "sessions": 5},
+			wantSeeks:     map[string]kafka.Offset{},
+		},
+		{
+			name:          "begin fails",
+			store:         failingStore{failBegin: true},
+			wantErr:       true,
+			wantCommitted: map[string]kafka.Offset{},
+			wantSeeks:     map[string]kafka.Offset{"coordinates": 40, "locations": 7, "sessions": 3},
+		},
+		{
+			name:          "savepoint fails",
+			store:         failingStore{failSavepoint: true},
+			wantErr:       true,
+			wantCommitted: map[string]kafka.Offset{},
+			wantSeeks:     map[string]kafka.Offset{"coordinates": 40, "locations": 7, "sessions": 3},
+		},
+		{
+			name:          "commit fails",
+			store:         failingStore{failCommit: true},
+			wantErr:       true,
+			wantCommitted: map[string]kafka.Offset{},
+			wantSeeks:     map[string]kafka.Offset{"coordinates": 40, "locations": 7, "sessions": 3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			ser := newTestSerializer(t)
+			store := tt.store
+			store.Store = newTestStore(t)
+			in := &Ingester{
+				cfg:        &cfg,
+				store:      &store,
+				serializer: ser,
+				hub:        NewStreamHub(),
+				stats:      NewIngestStats(),
+				metrics:    NewMetrics(),
+				geofencer:  &Geofencer{cfg: &cfg, store: &store, serializer: ser, fences: map[int64]*Geofence{}},
+			}
+			c := &fakeConsumer{}
+
+			err := in.Flush(c, mixedBatch(t, &cfg, ser))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Flush error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := offsetsByTopic(c.committed); !reflect.DeepEqual(got, tt.wantCommitted) {
+				t.Errorf("committed %v, want %v", got, tt.wantCommitted)
+			}
+			if got := offsetsByTopic(c.seeks); !reflect.DeepEqual(got, tt.wantSeeks) {
+				t.Errorf("seeked to %v, want %v", got, tt.wantSeeks)
+			}
+		})
+	}
+}
+
+func TestFlushRedelivery(t *testing.T) {
+	cfg := defaultConfig()
+	ser := newTestSerializer(t)
+	store := newTestStore(t)
+	in := &Ingester{
+		cfg:        &cfg,
+		store:      store,
+		serializer: ser,
+		hub:        NewStreamHub(),
+		stats:      NewIngestStats(),
+		metrics:    NewMetrics(),
+		geofencer:  &Geofencer{cfg: &cfg, store: store, serializer: ser, fences: map[int64]*Geofence{}},
+	}
+
+	batch := mixedBatch(t, &cfg, ser)
+	for i := 0; i < 2; i++ {
+		if err := in.Flush(&fakeConsumer{}, batch); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+
+	ctx := context.Background()
+	coords, _, err := store.Coordinates(ctx, CoordinateQuery{Limit: 10})
+	if err != nil {
+		t.Fatalf("Coordinates: %v", err)
+	}
+	locations, err := store.Locations(ctx, "", 10)
+	if err != nil {
+		t.Fatalf("Locations: %v", err)
+	}
+	totals, err := store.SessionTotals(ctx, "u1", "s1")
+	if err != nil {
+		t.Fatalf("SessionTotals: %v", err)
+	}
+	if len(coords) != 2 || len(locations) != 1 || totals.Totals.points.Int64 != 2 {
+		t.Errorf("after redelivery: %d coordinates, %d locations, %d session points; want 2, 1, 2",
+			len(coords), len(locations), totals.Totals.points.Int64)
+	}
+}
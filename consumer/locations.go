@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+
+	"shared/events"
+)
+
+// LocationEvent represents a named place check-in event
+type LocationEvent = events.LocationEvent
+
+// getLocations handles the HTTP endpoint for retrieving location events
+func getLocations(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get query parameters
+		userID := r.URL.Query().Get("user_id")
+		limitNum, err := parseLimit(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		events, err := store.Locations(r.Context(), userID, limitNum)
+		if err != nil {
+			log.Printf("Error querying database: %v\n", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		// Return JSON response
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(events)
+	}
+}
+
+// storeLocation decodes a location message and stores it, skipping
+// messages already stored from the same Kafka position
+func storeLocation(ser *events.Serializer, b Batch, msg *kafka.Message) error {
+	var event LocationEvent
+	if err := ser.Unmarshal(msg.Value, &event); err != nil {
+		return err
+	}
+	ts, err := events.NormalizeTimestamp(event.Timestamp)
+	if err != nil {
+		return err
+	}
+	event.Timestamp = ts
+
+	stored, err := b.InsertLocation(event, positionOf(msg))
+	if err != nil {
+		return err
+	}
+	if !stored {
+		log.Printf("Skipping duplicate location at %v\n", msg.TopicPartition)
+		return nil
+	}
+
+	log.Printf("Stored location: UserID=%s, Location=%s\n", event.UserID, event.Location)
+	return nil
+}
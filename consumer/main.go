@@ -1,93 +1,125 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
+	"path"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
-	_ "github.com/mattn/go-sqlite3"
-)
 
-const (
-	KafkaBroker = "kafka:9092"
-	KafkaTopic  = "coordinates"
-	DBPath      = "/db/gps.db"
+	"shared/auth"
+	"shared/config"
+	"shared/events"
+	"shared/health"
+	"shared/metrics"
 )
 
 // CoordinateEvent represents a GPS coordinate event
-type CoordinateEvent struct {
-	UserID    string  `json:"user_id"`
-	SessionID string  `json:"session_id,omitempty"`
-	Lat       float64 `json:"lat"`
-	Lon       float64 `json:"lon"`
-	Timestamp string  `json:"timestamp"`
-}
+type CoordinateEvent = events.CoordinateEvent
 
-// getEvents handles the HTTP endpoint for retrieving events
-func getEvents(db *sql.DB) http.HandlerFunc {
+// getEvents handles the HTTP endpoint for retrieving events.
+// Results are paged with an opaque cursor: when more rows match, the
+// X-Next-Cursor response header carries the token to pass as ?cursor=.
+func getEvents(store Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Enable CORS
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET")
-
 		// Get query parameters
-		userID := r.URL.Query().Get("user_id")
-		limit := r.URL.Query().Get("limit")
-		limitNum := 50 // default limit
+		q := r.URL.Query()
+		userID := q.Get("user_id")
+		sessionID := q.Get("session_id")
+		limitNum, err := parseLimit(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		from, to, err := parseTimeRange(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		if limit != "" {
-			if n, err := strconv.Atoi(limit); err == nil && n > 0 {
-				limitNum = n
+		var bbox *BoundingBox
+		if v := q.Get("bbox"); v != "" {
+			if bbox, err = parseBBox(v); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
 			}
 		}
 
-		// Build query
-		query := `
-			SELECT user_id, session_id, lat, lon, timestamp
-			FROM coordinates
-			WHERE 1=1
-		`
-		args := []interface{}{}
+		var near *GeoCircle
+		if v := q.Get("near"); v != "" {
+			if near, err = parseNear(v, q.Get("radius")); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		} else if q.Get("radius") != "" {
+			http.Error(w, "radius requires near", http.StatusBadRequest)
+			return
+		}
 
-		if userID != "" {
-			query += " AND user_id = ?"
-			args = append(args, userID)
+		var polygon []Point
+		if v := q.Get("polygon"); v != "" {
+			if polygon, err = parsePolygon(v); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		ascending := false
+		switch q.Get("order") {
+		case "", "desc":
+		case "asc":
+			ascending = true
+		default:
+			http.Error(w, "invalid order: must be asc or desc", http.StatusBadRequest)
+			return
 		}
 
-		query += " ORDER BY timestamp DESC LIMIT ?"
-		args = append(args, limitNum)
+		var after *cursor
+		if v := q.Get("cursor"); v != "" {
+			c, err := decodeCursor(v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			after = &c
+		}
 
-		// Execute query
-		rows, err := db.Query(query, args...)
+		events, next, err := store.Coordinates(r.Context(), CoordinateQuery{
+			UserID:    userID,
+			SessionID: sessionID,
+			From:      from,
+			To:        to,
+			BBox:      bbox,
+			Near:      near,
+			Polygon:   polygon,
+			Ascending: ascending,
+			After:     after,
+			Limit:     limitNum,
+		})
+		if errors.Is(err, errInvalidCursor) || errors.Is(err, errInvalidPolygon) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		if err != nil {
 			log.Printf("Error querying database: %v\n", err)
 			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
 		}
-		defer rows.Close()
-
-		// Collect results
-		events := []CoordinateEvent{}
-		for rows.Next() {
-			var event CoordinateEvent
-			err := rows.Scan(
-				&event.UserID,
-				&event.SessionID,
-				&event.Lat,
-				&event.Lon,
-				&event.Timestamp,
-			)
-			if err != nil {
-				log.Printf("Error scanning row: %v\n", err)
-				continue
-			}
-			events = append(events, event)
+
+		if next != nil {
+			w.Header().Set("X-Next-Cursor", encodeCursor(*next))
 		}
 
 		// Return JSON response
@@ -96,108 +128,445 @@ func getEvents(db *sql.DB) http.HandlerFunc {
 	}
 }
 
+// storeCoordinate decodes a coordinate message, inserts it and updates its
+// session totals and daily statistics. A redelivered message is recognised
+// by its Kafka position and skipped, in which case the returned event is nil.
+func storeCoordinate(ser *events.Serializer, b Batch, msg *kafka.Message) (*CoordinateEvent, error) {
+	var event CoordinateEvent
+	if err := ser.Unmarshal(msg.Value, &event); err != nil {
+		return nil, err
+	}
+	ts, err := events.NormalizeTimestamp(event.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+	event.Timestamp = ts
+
+	// Measure the movement since the session's previous fix before storing
+	seg, err := sessionSegment(b, event)
+	if err != nil {
+		return nil, fmt.Errorf("reading session %s: %w", event.SessionID, err)
+	}
+
+	pos := positionOf(msg)
+	stored, err := b.InsertCoordinate(event, seg, pos)
+	if err != nil {
+		return nil, err
+	}
+	if !stored {
+		log.Printf("Skipping duplicate event at %v\n", msg.TopicPartition)
+		return nil, nil
+	}
+
+	if event.SessionID != "" {
+		if err := b.UpdateSession(event, seg, pos); err != nil {
+			return nil, fmt.Errorf("updating session %s: %w", event.SessionID, err)
+		}
+	}
+	if err := b.UpdateDailyStats(event, seg, pos); err != nil {
+		return nil, fmt.Errorf("updating daily stats for %s: %w", event.UserID, err)
+	}
+	return &event, nil
+}
+
+// getSchema serves the JSON Schema of each event type: /schemas/ lists the
+// documents and /schemas/{name}.json returns one
+func getSchema() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/schemas/"), "/")
+		if name == "" {
+			entries, err := fs.ReadDir(events.Schemas, "schema")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			names := []string{}
+			for _, e := range entries {
+				names = append(names, e.Name())
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"schema_version": events.SchemaVersion,
+				"schemas":        names,
+			})
+			return
+		}
+
+		data, err := fs.ReadFile(events.Schemas, path.Join("schema", path.Base(name)))
+		if err != nil {
+			http.Error(w, "Schema not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/schema+json")
+		w.Write(data)
+	}
+}
+
 func main() {
-	// Initialize SQLite database
-	db, err := sql.Open("sqlite3", DBPath)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "set-role" {
+		if err := runSetRole(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bind-user" {
+		if err := runBindUser(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Load configuration from flags, environment and optional config file
+	cfg := defaultConfig()
+	loader := config.Register(flag.CommandLine, &cfg)
+	flag.Parse()
+	if err := loader.Load(); err != nil {
+		log.Fatal(err)
+	}
+	if loader.PrintRequested() {
+		loader.Print(os.Stdout)
+		return
+	}
+
+	// Runs after every other deferred cleanup, so the exit status can report
+	// messages lost during shutdown
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
+	// Open the configured storage backend, creating its schema on first use
+	store, err := openStore(context.Background(), &cfg)
 	if err != nil {
-		log.Fatal("Failed to open database:", err)
+		log.Fatal("Failed to open storage:", err)
 	}
-	defer db.Close()
+	defer store.Close()
+	log.Printf("Storing events in %s\n", cfg.Storage)
 
-	// Create table if not exists
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS coordinates (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id TEXT NOT NULL,
-			session_id TEXT,
-			lat REAL NOT NULL,
-			lon REAL NOT NULL,
-			timestamp TEXT NOT NULL
-		)
-	`)
+	// Messages are read in any wire format; Protobuf and Avro schemas are
+	// looked up in the registry shared with the producer
+	registry, err := events.OpenRegistry(cfg.SchemaRegistry)
 	if err != nil {
-		log.Fatal("Failed to create table:", err)
+		log.Fatal("Failed to open schema registry:", err)
+	}
+	serializer, err := events.NewSerializer(cfg.EventFormat, registry)
+	if err != nil {
+		log.Fatal("Failed to register event schemas:", err)
 	}
 
 	// Initialize Kafka consumer
-	c, err := kafka.NewConsumer(&kafka.ConfigMap{
-		"bootstrap.servers":  KafkaBroker,
-		"group.id":          "gps-consumer",
-		"auto.offset.reset": "earliest",
-	})
+	c, err := kafka.NewConsumer(cfg.consumerConfig())
 	if err != nil {
 		log.Fatal("Failed to create consumer:", err)
 	}
-	defer c.Close()
 
-	// Subscribe to topic
-	err = c.SubscribeTopics([]string{KafkaTopic}, nil)
+	// Subscribe to topics
+	topics := []string{cfg.CoordinatesTopic, cfg.LocationsTopic, cfg.SessionsTopic}
+	err = c.SubscribeTopics(topics, nil)
 	if err != nil {
-		log.Fatal("Failed to subscribe to topic:", err)
+		log.Fatal("Failed to subscribe to topics:", err)
 	}
-	log.Printf("Subscribed to topic: %s\n", KafkaTopic)
+	log.Printf("Subscribed to topics: %v\n", topics)
+
+	// Messages that cannot be decoded or stored go to the dead-letter topic
+	dlq, err := NewDeadLetterQueue(&cfg)
+	if err != nil {
+		log.Fatal("Failed to create DLQ producer:", err)
+	}
+
+	// Stored coordinates are checked against geofences for enter/exit events
+	geofencer, err := NewGeofencer(&cfg, store, serializer)
+	if err != nil {
+		log.Fatal("Failed to load geofences:", err)
+	}
+
+	// API callers authenticate with tokens issued at login or API keys
+	authn, err := auth.New(cfg.AuthKey, cfg.TokenTTL, cfg.APIKeys)
+	if err != nil {
+		log.Fatal("Invalid auth configuration:", err)
+	}
+	cors, err := auth.NewCORS(cfg.CORSOrigins, "X-Next-Cursor")
+	if err != nil {
+		log.Fatal("Invalid CORS configuration:", err)
+	}
+
+	// Account changes are published to the users topic
+	accounts, err := NewAccounts(&cfg, store, authn, serializer)
+	if err != nil {
+		log.Fatal("Failed to create user event producer:", err)
+	}
+	// Tokens act with their account's current role and user_id
+	authn.ResolveAccounts(accounts.Resolve)
 
 	// Setup HTTP server
-	http.HandleFunc("/events", getEvents(db))
+	hub := NewStreamHub()
+	stats := NewIngestStats()
+	m := NewMetrics()
+	m.registerLag(c)
+	checker := health.NewChecker(readyTimeout)
+	readinessChecks(checker, c, store)
+	http.Handle("/events", authn.Require(scopeToCaller(getEvents(store))))
+	http.Handle("/events/stream", authn.RequireStream(scopeToCaller(streamEvents(hub))))
+	http.Handle("/locations", authn.Require(scopeToCaller(getLocations(store))))
+	http.Handle("/sessions", authn.Require(scopeToCaller(getSessions(store))))
+	http.Handle("/sessions/", authn.Require(ownSessionPath(sessionResource(store))))
+	http.Handle("/users/", authn.Require(ownUserPath(userResource(store, accounts))))
+	http.Handle("/geofences", authn.Require(adminWrites(geofences(geofencer))))
+	http.Handle("/geofences/", authn.Require(adminWrites(geofences(geofencer))))
+	http.Handle("/geofence-events", authn.Require(scopeToCaller(getGeofenceEvents(store))))
+	http.Handle("/dlq", authn.RequireAdmin(getDLQ(dlq)))
+	http.Handle("/dlq/replay", authn.RequireAdmin(replayDLQ(dlq)))
+	http.Handle("/stats/ingest", authn.RequireAdmin(getIngestStats(stats)))
+	http.HandleFunc("/auth/", authResource(accounts))
+	http.HandleFunc("/schemas/", getSchema())
+	http.HandleFunc("/registry/", registryResource(registry))
+	http.HandleFunc("/healthz", health.Healthz)
+	http.HandleFunc("/readyz", checker.Readyz())
+	http.Handle("/metrics", m.registry.Handler())
+	srv := &http.Server{
+		Addr:    cfg.HTTPAddr,
+		Handler: cors.Handler(metrics.InstrumentMux(m.httpDuration, http.DefaultServeMux)),
+	}
+	srv.RegisterOnShutdown(hub.Close) // live streams never go idle on their own
 	go func() {
-		log.Printf("🚀 HTTP server running on :8082\n")
-		if err := http.ListenAndServe(":8082", nil); err != nil {
+		log.Printf("🚀 HTTP server running on %s\n", cfg.HTTPAddr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatal("HTTP server error:", err)
 		}
 	}()
 
 	// Handle graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	// Prepare insert statement
-	stmt, err := db.Prepare(`
-		INSERT INTO coordinates (user_id, session_id, lat, lon, timestamp)
-		VALUES (?, ?, ?, ?, ?)
-	`)
-	if err != nil {
-		log.Fatal("Failed to prepare statement:", err)
+	ingester := &Ingester{
+		cfg:        &cfg,
+		store:      store,
+		serializer: serializer,
+		hub:        hub,
+		dlq:        dlq,
+		stats:      stats,
+		metrics:    m,
+		geofencer:  geofencer,
 	}
-	defer stmt.Close()
+
+	// Accumulate messages and write them in one transaction once the batch
+	// is full or its oldest message has waited BatchTimeout
+	batch := make([]*kafka.Message, 0, cfg.BatchSize)
+	var batchStart time.Time
 
 	running := true
 	for running {
 		select {
-		case sig := <-sigChan:
-			log.Printf("Caught signal %v: terminating\n", sig)
+		case <-ctx.Done():
+			log.Println("Caught signal: terminating")
 			running = false
 		default:
-			ev := c.Poll(100) // 100ms timeout
-			if ev == nil {
-				continue
+			timeout := 100 * time.Millisecond
+			if len(batch) > 0 {
+				if remaining := cfg.BatchTimeout - time.Since(batchStart); remaining < timeout {
+					timeout = remaining
+				}
 			}
 
-			switch e := ev.(type) {
-			case *kafka.Message:
-				var event CoordinateEvent
-				if err := json.Unmarshal(e.Value, &event); err != nil {
-					log.Printf("Error unmarshaling message: %v\n", err)
-					continue
-				}
+			if timeout > 0 {
+				switch e := c.Poll(int(timeout.Milliseconds())).(type) {
+				case *kafka.Message:
+					m.consumed.Inc(*e.TopicPartition.Topic)
+					if len(batch) == 0 {
+						batchStart = time.Now()
+					}
+					batch = append(batch, e)
 
-				// Insert into SQLite
-				_, err = stmt.Exec(
-					event.UserID,
-					event.SessionID,
-					event.Lat,
-					event.Lon,
-					event.Timestamp,
-				)
-				if err != nil {
-					log.Printf("Error inserting into database: %v\n", err)
-					continue
+				case kafka.Error:
+					log.Printf("Kafka error: %v\n", e)
 				}
+			}
 
-				log.Printf("Stored event: UserID=%s, Lat=%f, Lon=%f\n", event.UserID, event.Lat, event.Lon)
-
-			case kafka.Error:
-				log.Printf("Kafka error: %v\n", e)
+			if len(batch) >= cfg.BatchSize || (len(batch) > 0 && time.Since(batchStart) >= cfg.BatchTimeout) {
+				ingester.Flush(c, batch)
+				batch = batch[:0]
 			}
 		}
 	}
+
+	stop()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	// Let in-flight requests (including DLQ replays) finish before the
+	// Kafka clients go away
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("HTTP server shutdown: %v\n", err)
+	}
+
+	// Write and commit whatever was still waiting
+	if err := ingester.Flush(c, batch); err != nil {
+		log.Printf("Final batch of %d messages not stored, it will be redelivered on restart: %v\n", len(batch), err)
+		exitCode = 1
+	}
+
+	// Close leaves the consumer group so partitions are rebalanced immediately
+	if err := c.Close(); err != nil {
+		log.Printf("Error closing consumer: %v\n", err)
+		exitCode = 1
+	}
+	if err := dlq.Close(cfg.ShutdownTimeout); err != nil {
+		log.Printf("Error closing DLQ producer: %v\n", err)
+		exitCode = 1
+	}
+	if err := geofencer.Close(cfg.ShutdownTimeout); err != nil {
+		log.Printf("Error closing geofence producer: %v\n", err)
+		exitCode = 1
+	}
+	if err := accounts.Close(cfg.ShutdownTimeout); err != nil {
+		log.Printf("Error closing user event producer: %v\n", err)
+		exitCode = 1
+	}
+	log.Println("Shutdown complete")
+}
+
+// runMigrate implements `consumer migrate [-dry-run] [flags]`: it brings the
+// configured store's schema up to date and exits. It takes the same
+// configuration as the service.
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	cfg := defaultConfig()
+	loader := config.Register(flags, &cfg)
+	dryRun := flags.Bool("dry-run", false, "list the pending migrations without applying them")
+	flags.Parse(args)
+	if err := loader.Load(); err != nil {
+		return err
+	}
+	if loader.PrintRequested() {
+		loader.Print(os.Stdout)
+		return nil
+	}
+
+	ctx := context.Background()
+	switch cfg.Storage {
+	case StorageMongoDB:
+		client, err := InitMongo(ctx, cfg.MongoURI)
+		if err != nil {
+			return err
+		}
+		defer client.Disconnect(ctx)
+
+		n, err := MigrateMongo(ctx, client.Database(cfg.MongoDatabase), *dryRun)
+		if err != nil {
+			return err
+		}
+		switch {
+		case n == 0:
+			log.Printf("Schema is up to date")
+		case *dryRun:
+			log.Printf("%d migrations pending", n)
+		default:
+			log.Printf("Applied %d migrations", n)
+		}
+		return nil
+
+	default:
+		// SQLite migrates in place each time it is opened
+		if *dryRun {
+			return fmt.Errorf("-dry-run is only supported with %s storage", StorageMongoDB)
+		}
+		store, err := OpenSQLiteStore(cfg.DBPath)
+		if err != nil {
+			return err
+		}
+		log.Printf("Schema is up to date")
+		return store.Close()
+	}
+}
+
+// runSetRole implements `consumer set-role [flags] <username> <user|admin>`:
+// it grants or revokes the admin role of a registered account, which
+// applies to the account's tokens at once. It takes the same configuration
+// as the service.
+func runSetRole(args []string) error {
+	flags := flag.NewFlagSet("set-role", flag.ExitOnError)
+	cfg := defaultConfig()
+	loader := config.Register(flags, &cfg)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: consumer set-role [flags] <username> <%s|%s>\n", auth.RoleUser, auth.RoleAdmin)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if err := loader.Load(); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	username, role := flags.Arg(0), flags.Arg(1)
+	if role != auth.RoleUser && role != auth.RoleAdmin {
+		return fmt.Errorf("role must be %s or %s", auth.RoleUser, auth.RoleAdmin)
+	}
+
+	ctx := context.Background()
+	store, err := openStore(ctx, &cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	err = store.SetRole(ctx, username, role)
+	if err == errNotFound {
+		return fmt.Errorf("no account named %s", username)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("%s now has the %s role", username, role)
+	return nil
+}
+
+// runBindUser implements `consumer bind-user [flags] <username> <user_id>`:
+// it makes a registered account the owner of the events stored under
+// user_id, such as a simulated user's, in place of the user_id it was
+// registered with. The account's tokens act for the new user_id at once.
+func runBindUser(args []string) error {
+	flags := flag.NewFlagSet("bind-user", flag.ExitOnError)
+	cfg := defaultConfig()
+	loader := config.Register(flags, &cfg)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: consumer bind-user [flags] <username> <user_id>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if err := loader.Load(); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 || flags.Arg(1) == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	username, userID := flags.Arg(0), flags.Arg(1)
+
+	ctx := context.Background()
+	store, err := openStore(ctx, &cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	err = store.BindUser(ctx, username, userID)
+	if err == errNotFound {
+		return fmt.Errorf("no account named %s", username)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("%s now owns the events of user_id %s", username, userID)
+	return nil
 }
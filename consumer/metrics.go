@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+
+	"shared/health"
+	"shared/metrics"
+)
+
+// readyTimeout bounds how long /readyz waits for each check
+const readyTimeout = 2 * time.Second
+
+// Metrics are the Prometheus metrics exposed on /metrics
+type Metrics struct {
+	registry      *metrics.Registry
+	consumed      *metrics.Counter
+	stored        *metrics.Counter
+	dropped       *metrics.Counter
+	batchDuration *metrics.Histogram
+	httpDuration  *metrics.Histogram
+}
+
+// NewMetrics registers the consumer's metrics on a new registry
+func NewMetrics() *Metrics {
+	reg := metrics.NewRegistry()
+	return &Metrics{
+		registry: reg,
+		consumed: reg.NewCounter("gps_consumer_messages_consumed_total",
+			"Messages read from Kafka.", "topic"),
+		stored: reg.NewCounter("gps_consumer_messages_stored_total",
+			"Messages written to the store, including redeliveries recognised as duplicates.", "topic"),
+		dropped: reg.NewCounter("gps_consumer_messages_dropped_total",
+			"Messages that could not be stored and were sent to the dead-letter topic.", "topic"),
+		batchDuration: reg.NewHistogram("gps_consumer_batch_duration_seconds",
+			"Time to write and commit one batch.", metrics.DefBuckets),
+		httpDuration: reg.NewHistogram("gps_consumer_http_request_duration_seconds",
+			"HTTP request latency.", metrics.DefBuckets, "handler", "method", "code"),
+	}
+}
+
+// registerLag exposes how far behind the high watermark the consumer is on
+// each assigned partition. Both values come from librdkafka's cached state,
+// so scraping does not call the broker.
+func (m *Metrics) registerLag(c *kafka.Consumer) {
+	m.registry.NewGaugeFunc("gps_consumer_lag",
+		"Messages between the consumer position and the partition high watermark.",
+		[]string{"topic", "partition"},
+		func(emit func(float64, ...string)) {
+			assigned, err := c.Assignment()
+			if err != nil || len(assigned) == 0 {
+				return
+			}
+			positions, err := c.Position(assigned)
+			if err != nil {
+				return
+			}
+			for _, tp := range positions {
+				if tp.Topic == nil || tp.Offset < 0 {
+					// Nothing consumed yet on this partition
+					continue
+				}
+				_, high, err := c.GetWatermarkOffsets(*tp.Topic, tp.Partition)
+				if err != nil || high < 0 {
+					continue
+				}
+				lag := high - int64(tp.Offset)
+				if lag < 0 {
+					lag = 0
+				}
+				emit(float64(lag), *tp.Topic, strconv.Itoa(int(tp.Partition)))
+			}
+		})
+}
+
+// readinessChecks registers the conditions under which the consumer can do useful work
+func readinessChecks(checker *health.Checker, c *kafka.Consumer, store Store) {
+	checker.Add("kafka", func(ctx context.Context) error {
+		_, err := c.GetMetadata(nil, false, timeoutMs(ctx))
+		return err
+	})
+
+	checker.Add("database", store.CheckWritable)
+
+	checker.Add("partitions", func(ctx context.Context) error {
+		assigned, err := c.Assignment()
+		if err != nil {
+			return err
+		}
+		if len(assigned) == 0 {
+			return fmt.Errorf("no partitions assigned")
+		}
+		return nil
+	})
+}
+
+// timeoutMs converts the time left on ctx into a librdkafka timeout
+func timeoutMs(ctx context.Context) int {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return int(readyTimeout.Milliseconds())
+	}
+	if ms := int(time.Until(deadline).Milliseconds()); ms > 0 {
+		return ms
+	}
+	return 1
+}
@@ -0,0 +1,1176 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+
+	"shared/auth"
+	"shared/events"
+)
+
+// MongoStore keeps events in MongoDB. The collections, their validators and
+// indexes are created by the versioned migrations in mongo_migrate.go; the
+// collections without a validator are otherwise created on first write.
+//
+// Coordinates carry a GeoJSON point in location for the 2dsphere index, and
+// timestamps are stored as BSON dates, so they come back normalised to UTC.
+//
+// A standalone mongod has no transactions, so a Batch writes each document
+// as it goes: Savepoint, RollbackTo, Commit and Rollback do nothing. A
+// batch that fails part-way keeps what it wrote, and its redelivered
+// coordinates and check-ins are recognised by their Kafka position.
+type MongoStore struct {
+	client *mongo.Client
+
+	coordinates    *mongo.Collection
+	locations      *mongo.Collection
+	sessions       *mongo.Collection
+	dailyStats     *mongo.Collection
+	geofences      *mongo.Collection
+	geofenceState  *mongo.Collection
+	geofenceEvents *mongo.Collection
+	counters       *mongo.Collection
+	users          *mongo.Collection
+}
+
+// geoPoint is a GeoJSON point, the shape 2dsphere indexes expect
+type geoPoint struct {
+	Type        string     `bson:"type"`
+	Coordinates [2]float64 `bson:"coordinates"` // longitude, latitude
+}
+
+// pointAt returns the GeoJSON point at a position
+func pointAt(lat, lon float64) geoPoint {
+	return geoPoint{Type: "Point", Coordinates: [2]float64{lon, lat}}
+}
+
+// mongoPosition is a kafkaPosition as stored on a document
+type mongoPosition struct {
+	Topic     string `bson:"topic"`
+	Partition int32  `bson:"partition"`
+	Offset    int64  `bson:"offset"`
+}
+
+// coordinateDoc is a document in the coordinates collection. Latitude,
+// longitude, location, altitude, speed and timestamp are the fields its
+// validator knows.
+type coordinateDoc struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	UserID    string             `bson:"user_id"`
+	SessionID string             `bson:"session_id"`
+	Latitude  float64            `bson:"latitude"`
+	Longitude float64            `bson:"longitude"`
+	Location  geoPoint           `bson:"location"`
+	Altitude  *float64           `bson:"altitude,omitempty"`
+	Speed     float64            `bson:"speed"` // over the segment leading here, 0 if stopped
+	Timestamp time.Time          `bson:"timestamp"`
+	SegmentM  float64            `bson:"segment_m"`
+	MovingS   float64            `bson:"moving_s"`
+	EleDeltaM *float64           `bson:"ele_delta_m,omitempty"`
+	Kafka     mongoPosition      `bson:"kafka"`
+}
+
+func (d coordinateDoc) event() CoordinateEvent {
+	return CoordinateEvent{
+		UserID:    d.UserID,
+		SessionID: d.SessionID,
+		Lat:       d.Latitude,
+		Lon:       d.Longitude,
+		Timestamp: formatTime(d.Timestamp),
+		Ele:       d.Altitude,
+	}
+}
+
+// locationDoc is a check-in in the locations collection, shaped to its validator
+type locationDoc struct {
+	Name        string        `bson:"name"`
+	Coordinates latLon        `bson:"coordinates"`
+	Location    geoPoint      `bson:"location"`
+	UserID      string        `bson:"user_id"`
+	SessionID   string        `bson:"session_id"`
+	CreatedAt   time.Time     `bson:"created_at"`
+	Kafka       mongoPosition `bson:"kafka"`
+}
+
+type latLon struct {
+	Latitude  float64 `bson:"latitude"`
+	Longitude float64 `bson:"longitude"`
+}
+
+// sessionDoc is a document in the sessions collection, keyed by user and
+// session ID
+type sessionDoc struct {
+	SessionID   string     `bson:"session_id"`
+	UserID      string     `bson:"user_id"`
+	Activity    string     `bson:"activity"`
+	StartTime   *time.Time `bson:"start_time"`
+	EndTime     *time.Time `bson:"end_time"`
+	PointCount  int64      `bson:"point_count"`
+	DistanceM   float64    `bson:"distance_m"`
+	MinLat      *float64   `bson:"min_lat"`
+	MinLon      *float64   `bson:"min_lon"`
+	MaxLat      *float64   `bson:"max_lat"`
+	MaxLon      *float64   `bson:"max_lon"`
+	LastLat     *float64   `bson:"last_lat"`
+	LastLon     *float64   `bson:"last_lon"`
+	LastTime    *time.Time `bson:"last_time"`
+	LastEle     *float64   `bson:"last_ele"`
+	MovingS     float64    `bson:"moving_s"`
+	MaxSpeedMps float64    `bson:"max_speed_mps"`
+	EleGainM    float64    `bson:"ele_gain_m"`
+	EleLossM    float64    `bson:"ele_loss_m"`
+	MinEle      *float64   `bson:"min_ele"`
+	MaxEle      *float64   `bson:"max_ele"`
+}
+
+// geofenceDoc is a document in the geofences collection
+type geofenceDoc struct {
+	ID        int64   `bson:"_id"`
+	Name      string  `bson:"name"`
+	Type      string  `bson:"type"`
+	Center    *Point  `bson:"center,omitempty"`
+	RadiusM   float64 `bson:"radius_m,omitempty"`
+	Polygon   []Point `bson:"polygon,omitempty"`
+	CreatedAt string  `bson:"created_at"`
+}
+
+// geofenceEventDoc is a document in the geofence_events collection
+type geofenceEventDoc struct {
+	Type         string    `bson:"type"`
+	GeofenceID   int64     `bson:"geofence_id"`
+	GeofenceName string    `bson:"geofence_name"`
+	UserID       string    `bson:"user_id"`
+	SessionID    string    `bson:"session_id"`
+	Lat          float64   `bson:"lat"`
+	Lon          float64   `bson:"lon"`
+	Location     geoPoint  `bson:"location"`
+	Timestamp    time.Time `bson:"timestamp"`
+}
+
+// userDoc is a document in the users collection
+type userDoc struct {
+	Username       string                 `bson:"username"`
+	UserID         string                 `bson:"user_id,omitempty"`
+	Email          string                 `bson:"email"`
+	PasswordHash   string                 `bson:"password_hash"`
+	Role           string                 `bson:"role,omitempty"`
+	FullName       string                 `bson:"full_name,omitempty"`
+	Bio            string                 `bson:"bio,omitempty"`
+	ProfilePic     string                 `bson:"profile_pic,omitempty"`
+	Preferences    map[string]interface{} `bson:"preferences,omitempty"`
+	SavedLocations []string               `bson:"saved_locations"`
+	CreatedAt      time.Time              `bson:"created_at"`
+	UpdatedAt      *time.Time             `bson:"updated_at,omitempty"`
+	LastLogin      *time.Time             `bson:"last_login,omitempty"`
+}
+
+// statsDoc is the result of the $group stages behind DailyStats and RawStats
+type statsDoc struct {
+	Points   int64    `bson:"points"`
+	Distance float64  `bson:"distance"`
+	Moving   float64  `bson:"moving"`
+	MaxSpeed float64  `bson:"max_speed"`
+	Gain     float64  `bson:"gain"`
+	Loss     float64  `bson:"loss"`
+	MinEle   *float64 `bson:"min_ele"`
+	MaxEle   *float64 `bson:"max_ele"`
+	MinLat   *float64 `bson:"min_lat"`
+	MinLon   *float64 `bson:"min_lon"`
+	MaxLat   *float64 `bson:"max_lat"`
+	MaxLon   *float64 `bson:"max_lon"`
+}
+
+func (d statsDoc) row() statsRow {
+	return statsRow{
+		points:   sql.NullInt64{Int64: d.Points, Valid: true},
+		distance: validFloat(d.Distance),
+		moving:   validFloat(d.Moving),
+		maxSpeed: validFloat(d.MaxSpeed),
+		gain:     validFloat(d.Gain),
+		loss:     validFloat(d.Loss),
+		minEle:   nullFloat(d.MinEle),
+		maxEle:   nullFloat(d.MaxEle),
+		minLat:   nullFloat(d.MinLat),
+		minLon:   nullFloat(d.MinLon),
+		maxLat:   nullFloat(d.MaxLat),
+		maxLon:   nullFloat(d.MaxLon),
+	}
+}
+
+func validFloat(f float64) sql.NullFloat64 {
+	return sql.NullFloat64{Float64: f, Valid: true}
+}
+
+func nullFloat(p *float64) sql.NullFloat64 {
+	if p == nil {
+		return sql.NullFloat64{}
+	}
+	return validFloat(*p)
+}
+
+// OpenMongoStore connects to MongoDB and brings its schema up to date. With
+// migrate false it applies nothing and fails if any migration is pending.
+func OpenMongoStore(ctx context.Context, uri, database string, migrate bool) (*MongoStore, error) {
+	client, err := InitMongo(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	db := client.Database(database)
+
+	if migrate {
+		_, err = MigrateMongo(ctx, db, false)
+	} else {
+		var pending []mongoMigration
+		if pending, err = PendingMigrations(ctx, db); err == nil && len(pending) > 0 {
+			err = fmt.Errorf("%d schema migrations pending; run the migrate command", len(pending))
+		}
+	}
+	if err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+
+	return &MongoStore{
+		client:         client,
+		coordinates:    db.Collection("coordinates"),
+		locations:      db.Collection("locations"),
+		sessions:       db.Collection("sessions"),
+		dailyStats:     db.Collection("user_daily_stats"),
+		geofences:      db.Collection("geofences"),
+		geofenceState:  db.Collection("geofence_state"),
+		geofenceEvents: db.Collection("geofence_events"),
+		counters:       db.Collection("counters"),
+		users:          db.Collection("users"),
+	}, nil
+}
+
+// Close disconnects from MongoDB
+func (s *MongoStore) Close() error {
+	return s.client.Disconnect(context.Background())
+}
+
+// CheckWritable pings the primary, the only member that accepts writes
+func (s *MongoStore) CheckWritable(ctx context.Context) error {
+	return s.client.Ping(ctx, readpref.Primary())
+}
+
+// Begin returns a batch that writes straight through
+func (s *MongoStore) Begin(ctx context.Context) (Batch, error) {
+	return &mongoBatch{s: s, ctx: ctx}, nil
+}
+
+// parseTime parses an RFC3339 timestamp for storage as a BSON date
+func parseTime(ts string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		return t, fmt.Errorf("invalid timestamp %q: %w", ts, err)
+	}
+	return t, nil
+}
+
+// formatTime formats a stored BSON date in events.TimestampLayout, the form
+// the SQLite store keeps event timestamps in
+func formatTime(t time.Time) string {
+	return t.UTC().Format(events.TimestampLayout)
+}
+
+// timeRange adds from <= field <= to to filter; empty bounds are open.
+// The bounds come from parseTimeRange and are known to parse.
+func timeRange(filter bson.M, field, from, to string) {
+	r := bson.M{}
+	if t, err := parseTime(from); err == nil {
+		r["$gte"] = t
+	}
+	if t, err := parseTime(to); err == nil {
+		r["$lte"] = t
+	}
+	if len(r) > 0 {
+		filter[field] = r
+	}
+}
+
+// Coordinates pages through the coordinates collection with keyset pagination
+func (s *MongoStore) Coordinates(ctx context.Context, q CoordinateQuery) ([]CoordinateEvent, *cursor, error) {
+	filter := bson.M{}
+	if q.UserID != "" {
+		filter["user_id"] = q.UserID
+	}
+	if q.SessionID != "" {
+		filter["session_id"] = q.SessionID
+	}
+	timeRange(filter, "timestamp", q.From, q.To)
+	if q.BBox != nil {
+		filter["latitude"] = bson.M{"$gte": q.BBox.MinLat, "$lte": q.BBox.MaxLat}
+		filter["longitude"] = bson.M{"$gte": q.BBox.MinLon, "$lte": q.BBox.MaxLon}
+	}
+	// $geoWithin on location is answered from the 2dsphere index
+	var geo bson.A
+	if q.Near != nil {
+		center := pointAt(q.Near.Center.Lat, q.Near.Center.Lon)
+		geo = append(geo, bson.M{"location": bson.M{"$geoWithin": bson.M{
+			"$centerSphere": bson.A{center.Coordinates, q.Near.RadiusM / earthRadiusMeters},
+		}}})
+	}
+	if q.Polygon != nil {
+		ring := make([][2]float64, 0, len(q.Polygon)+1)
+		for _, p := range q.Polygon {
+			ring = append(ring, pointAt(p.Lat, p.Lon).Coordinates)
+		}
+		ring = append(ring, ring[0])
+		geo = append(geo, bson.M{"location": bson.M{"$geoWithin": bson.M{
+			"$geometry": bson.M{"type": "Polygon", "coordinates": bson.A{ring}},
+		}}})
+	}
+	if len(geo) > 0 {
+		filter["$and"] = geo
+	}
+
+	// Keyset pagination on (timestamp, _id) so pages never overlap
+	order, cmp := -1, "$lt"
+	if q.Ascending {
+		order, cmp = 1, "$gt"
+	}
+	if q.After != nil {
+		oid, err := primitive.ObjectIDFromHex(q.After.OID)
+		if err != nil {
+			return nil, nil, errInvalidCursor
+		}
+		t, err := parseTime(q.After.Timestamp)
+		if err != nil {
+			return nil, nil, errInvalidCursor
+		}
+		filter["$or"] = bson.A{
+			bson.M{"timestamp": bson.M{cmp: t}},
+			bson.M{"timestamp": t, "_id": bson.M{cmp: oid}},
+		}
+	}
+
+	// Fetch one extra document to learn whether another page exists
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: order}, {Key: "_id", Value: order}}).
+		SetLimit(int64(q.Limit + 1))
+	var docs []coordinateDoc
+	if err := s.find(ctx, s.coordinates, filter, opts, &docs); err != nil {
+		// BadValue: a polygon MongoDB cannot build a loop from
+		var serr mongo.ServerError
+		if q.Polygon != nil && errors.As(err, &serr) && serr.HasErrorCode(2) {
+			return nil, nil, fmt.Errorf("%w: %v", errInvalidPolygon, err)
+		}
+		return nil, nil, err
+	}
+
+	events := make([]CoordinateEvent, 0, len(docs))
+	for i, d := range docs {
+		if i == q.Limit {
+			last := docs[i-1]
+			return events, &cursor{Timestamp: formatTime(last.Timestamp), OID: last.ID.Hex()}, nil
+		}
+		events = append(events, d.event())
+	}
+	return events, nil, nil
+}
+
+// find runs a query and decodes every result into results
+func (s *MongoStore) find(ctx context.Context, coll *mongo.Collection, filter interface{}, opts *options.FindOptions, results interface{}) error {
+	cur, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return err
+	}
+	return cur.All(ctx, results)
+}
+
+// Locations returns the latest check-ins, optionally for one user
+func (s *MongoStore) Locations(ctx context.Context, userID string, limit int) ([]LocationEvent, error) {
+	filter := bson.M{}
+	if userID != "" {
+		filter["user_id"] = userID
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(int64(limit))
+	var docs []locationDoc
+	if err := s.find(ctx, s.locations, filter, opts, &docs); err != nil {
+		return nil, err
+	}
+
+	events := make([]LocationEvent, 0, len(docs))
+	for _, d := range docs {
+		events = append(events, LocationEvent{
+			UserID:    d.UserID,
+			SessionID: d.SessionID,
+			Location:  d.Name,
+			Lat:       d.Coordinates.Latitude,
+			Lon:       d.Coordinates.Longitude,
+			Timestamp: formatTime(d.CreatedAt),
+		})
+	}
+	return events, nil
+}
+
+// Sessions returns the latest sessions, optionally for one user
+func (s *MongoStore) Sessions(ctx context.Context, userID string, limit int) ([]Session, error) {
+	filter := bson.M{}
+	if userID != "" {
+		filter["user_id"] = userID
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "start_time", Value: -1}}).SetLimit(int64(limit))
+	var docs []sessionDoc
+	if err := s.find(ctx, s.sessions, filter, opts, &docs); err != nil {
+		return nil, err
+	}
+
+	sessions := make([]Session, 0, len(docs))
+	for _, d := range docs {
+		session := Session{
+			ID:         d.SessionID,
+			UserID:     d.UserID,
+			Activity:   d.Activity,
+			StartTime:  formatOptionalTime(d.StartTime),
+			EndTime:    formatOptionalTime(d.EndTime),
+			PointCount: int(d.PointCount),
+			DistanceM:  d.DistanceM,
+		}
+		if d.MinLat != nil && d.MinLon != nil && d.MaxLat != nil && d.MaxLon != nil {
+			session.BBox = &BoundingBox{MinLat: *d.MinLat, MinLon: *d.MinLon, MaxLat: *d.MaxLat, MaxLon: *d.MaxLon}
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// formatOptionalTime formats a date that may not be set yet
+func formatOptionalTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return formatTime(*t)
+}
+
+// formatAccountTime formats an account date, which may not be set yet, as
+// the RFC3339 seconds the SQLite store keeps for accounts
+func formatAccountTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// SessionPoints returns a session's fixes in time order
+func (s *MongoStore) SessionPoints(ctx context.Context, userID, sessionID string) ([]CoordinateEvent, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}})
+	return s.findCoordinates(ctx, bson.M{"user_id": userID, "session_id": sessionID}, opts)
+}
+
+// Track returns a user's fixes in time order, optionally within a time range
+func (s *MongoStore) Track(ctx context.Context, userID, from, to string) ([]CoordinateEvent, error) {
+	filter := bson.M{"user_id": userID}
+	timeRange(filter, "timestamp", from, to)
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}})
+	return s.findCoordinates(ctx, filter, opts)
+}
+
+func (s *MongoStore) findCoordinates(ctx context.Context, filter bson.M, opts *options.FindOptions) ([]CoordinateEvent, error) {
+	var docs []coordinateDoc
+	if err := s.find(ctx, s.coordinates, filter, opts, &docs); err != nil {
+		return nil, err
+	}
+	points := make([]CoordinateEvent, 0, len(docs))
+	for _, d := range docs {
+		points = append(points, d.event())
+	}
+	return points, nil
+}
+
+// SessionTotals reads a session's running totals
+func (s *MongoStore) SessionTotals(ctx context.Context, userID, sessionID string) (sessionTotals, error) {
+	var d sessionDoc
+	err := s.sessions.FindOne(ctx, sessionFilter(userID, sessionID)).Decode(&d)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return sessionTotals{}, errNotFound
+	}
+	if err != nil {
+		return sessionTotals{}, err
+	}
+
+	return sessionTotals{
+		UserID:    d.UserID,
+		Activity:  d.Activity,
+		StartTime: formatOptionalTime(d.StartTime),
+		EndTime:   formatOptionalTime(d.EndTime),
+		LastTime:  formatOptionalTime(d.LastTime),
+		Totals: statsRow{
+			points:   sql.NullInt64{Int64: d.PointCount, Valid: true},
+			distance: validFloat(d.DistanceM),
+			moving:   validFloat(d.MovingS),
+			maxSpeed: validFloat(d.MaxSpeedMps),
+			gain:     validFloat(d.EleGainM),
+			loss:     validFloat(d.EleLossM),
+			minEle:   nullFloat(d.MinEle),
+			maxEle:   nullFloat(d.MaxEle),
+			minLat:   nullFloat(d.MinLat),
+			minLon:   nullFloat(d.MinLon),
+			maxLat:   nullFloat(d.MaxLat),
+			maxLon:   nullFloat(d.MaxLon),
+		},
+	}, nil
+}
+
+// aggregateStats runs a pipeline ending in a single-document $group into statsDoc
+func (s *MongoStore) aggregateStats(ctx context.Context, coll *mongo.Collection, pipeline mongo.Pipeline) (statsRow, error) {
+	cur, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return statsRow{}, err
+	}
+	var docs []statsDoc
+	if err := cur.All(ctx, &docs); err != nil {
+		return statsRow{}, err
+	}
+	if len(docs) == 0 {
+		// Nothing matched; add ignores a row without points
+		return statsRow{}, nil
+	}
+	return docs[0].row(), nil
+}
+
+// DailyStats sums a user's rollups for days in [fromDay, toDay); empty bounds are open
+func (s *MongoStore) DailyStats(ctx context.Context, userID, fromDay, toDay string) (statsRow, error) {
+	match := bson.M{"user_id": userID}
+	day := bson.M{}
+	if fromDay != "" {
+		day["$gte"] = fromDay
+	}
+	if toDay != "" {
+		day["$lt"] = toDay
+	}
+	if len(day) > 0 {
+		match["day"] = day
+	}
+
+	return s.aggregateStats(ctx, s.dailyStats, mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{
+			"_id":       nil,
+			"points":    bson.M{"$sum": "$point_count"},
+			"distance":  bson.M{"$sum": "$distance_m"},
+			"moving":    bson.M{"$sum": "$moving_s"},
+			"max_speed": bson.M{"$max": "$max_speed_mps"},
+			"gain":      bson.M{"$sum": "$ele_gain_m"},
+			"loss":      bson.M{"$sum": "$ele_loss_m"},
+			"min_ele":   bson.M{"$min": "$min_ele"},
+			"max_ele":   bson.M{"$max": "$max_ele"},
+			"min_lat":   bson.M{"$min": "$min_lat"},
+			"min_lon":   bson.M{"$min": "$min_lon"},
+			"max_lat":   bson.M{"$max": "$max_lat"},
+			"max_lon":   bson.M{"$max": "$max_lon"},
+		}}},
+	})
+}
+
+// RawStats sums a user's coordinates with from <= timestamp < to (or <= to
+// when toInclusive), for the partial days at the edges of a range
+func (s *MongoStore) RawStats(ctx context.Context, userID, from, to string, toInclusive bool) (statsRow, error) {
+	t0, err := parseTime(from)
+	if err != nil {
+		return statsRow{}, err
+	}
+	t1, err := parseTime(to)
+	if err != nil {
+		return statsRow{}, err
+	}
+	upper := "$lt"
+	if toInclusive {
+		upper = "$lte"
+	}
+
+	return s.aggregateStats(ctx, s.coordinates, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"user_id":   userID,
+			"timestamp": bson.M{"$gte": t0, upper: t1},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":       nil,
+			"points":    bson.M{"$sum": 1},
+			"distance":  bson.M{"$sum": "$segment_m"},
+			"moving":    bson.M{"$sum": "$moving_s"},
+			"max_speed": bson.M{"$max": "$speed"},
+			// $max ignores a missing ele_delta_m, leaving 0
+			"gain":    bson.M{"$sum": bson.M{"$max": bson.A{"$ele_delta_m", 0}}},
+			"loss":    bson.M{"$sum": bson.M{"$max": bson.A{bson.M{"$multiply": bson.A{-1, "$ele_delta_m"}}, 0}}},
+			"min_ele": bson.M{"$min": "$altitude"},
+			"max_ele": bson.M{"$max": "$altitude"},
+			"min_lat": bson.M{"$min": "$latitude"},
+			"min_lon": bson.M{"$min": "$longitude"},
+			"max_lat": bson.M{"$max": "$latitude"},
+			"max_lon": bson.M{"$max": "$longitude"},
+		}}},
+	})
+}
+
+// GeofenceEvents returns the latest enter/exit events matching q
+func (s *MongoStore) GeofenceEvents(ctx context.Context, q GeofenceEventQuery) ([]GeofenceEvent, error) {
+	filter := bson.M{}
+	if q.UserID != "" {
+		filter["user_id"] = q.UserID
+	}
+	if q.GeofenceID != 0 {
+		filter["geofence_id"] = q.GeofenceID
+	}
+	timeRange(filter, "timestamp", q.From, q.To)
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}).
+		SetLimit(int64(q.Limit))
+	var docs []geofenceEventDoc
+	if err := s.find(ctx, s.geofenceEvents, filter, opts, &docs); err != nil {
+		return nil, err
+	}
+
+	events := make([]GeofenceEvent, 0, len(docs))
+	for _, d := range docs {
+		events = append(events, GeofenceEvent{
+			Type:         d.Type,
+			GeofenceID:   d.GeofenceID,
+			GeofenceName: d.GeofenceName,
+			UserID:       d.UserID,
+			SessionID:    d.SessionID,
+			Lat:          d.Lat,
+			Lon:          d.Lon,
+			Timestamp:    formatTime(d.Timestamp),
+		})
+	}
+	return events, nil
+}
+
+// Geofences loads every stored fence
+func (s *MongoStore) Geofences(ctx context.Context) ([]*Geofence, error) {
+	var docs []geofenceDoc
+	if err := s.find(ctx, s.geofences, bson.M{}, options.Find(), &docs); err != nil {
+		return nil, err
+	}
+	fences := make([]*Geofence, 0, len(docs))
+	for _, d := range docs {
+		fences = append(fences, &Geofence{
+			ID:        d.ID,
+			Name:      d.Name,
+			Type:      d.Type,
+			Center:    d.Center,
+			RadiusM:   d.RadiusM,
+			Polygon:   d.Polygon,
+			CreatedAt: d.CreatedAt,
+		})
+	}
+	return fences, nil
+}
+
+// geofenceDocOf returns the document stored for a fence
+func geofenceDocOf(fence Geofence) geofenceDoc {
+	return geofenceDoc{
+		ID:        fence.ID,
+		Name:      fence.Name,
+		Type:      fence.Type,
+		Center:    fence.Center,
+		RadiusM:   fence.RadiusM,
+		Polygon:   fence.Polygon,
+		CreatedAt: fence.CreatedAt,
+	}
+}
+
+// InsertGeofence stores a new fence under the next ID from the counters
+// collection, keeping the integer IDs the API and geofence events use
+func (s *MongoStore) InsertGeofence(ctx context.Context, fence Geofence) (int64, error) {
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := s.counters.FindOneAndUpdate(ctx,
+		bson.M{"_id": "geofences"},
+		bson.M{"$inc": bson.M{"seq": int64(1)}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&counter)
+	if err != nil {
+		return 0, err
+	}
+
+	fence.ID = counter.Seq
+	if _, err := s.geofences.InsertOne(ctx, geofenceDocOf(fence)); err != nil {
+		return 0, err
+	}
+	return fence.ID, nil
+}
+
+// UpdateGeofence replaces a stored fence
+func (s *MongoStore) UpdateGeofence(ctx context.Context, fence Geofence) error {
+	res, err := s.geofences.ReplaceOne(ctx, bson.M{"_id": fence.ID}, geofenceDocOf(fence))
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// DeleteGeofence removes a fence, then which users were inside it
+func (s *MongoStore) DeleteGeofence(ctx context.Context, id int64) error {
+	res, err := s.geofences.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return errNotFound
+	}
+	_, err = s.geofenceState.DeleteMany(ctx, bson.M{"geofence_id": id})
+	return err
+}
+
+// InsertUser stores a new account; the unique username and email indexes
+// turn a taken one into errUserExists
+func (s *MongoStore) InsertUser(ctx context.Context, user User) error {
+	created, err := parseTime(user.CreatedAt)
+	if err != nil {
+		return err
+	}
+	doc := userDoc{
+		Username:       user.Username,
+		UserID:         user.UserID,
+		Email:          user.Email,
+		PasswordHash:   user.PasswordHash,
+		Role:           user.Role,
+		FullName:       user.FullName,
+		Bio:            user.Bio,
+		ProfilePic:     user.ProfilePic,
+		Preferences:    user.Preferences,
+		SavedLocations: []string{},
+		CreatedAt:      created,
+	}
+	_, err = s.users.InsertOne(ctx, doc)
+	if mongo.IsDuplicateKeyError(err) {
+		return errUserExists
+	}
+	return err
+}
+
+// User reads an account and its saved locations
+func (s *MongoStore) User(ctx context.Context, username string) (User, error) {
+	var doc userDoc
+	err := s.users.FindOne(ctx, bson.M{"username": username}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return User{}, errNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	user := User{
+		Username:       doc.Username,
+		UserID:         doc.UserID,
+		Email:          doc.Email,
+		FullName:       doc.FullName,
+		Bio:            doc.Bio,
+		ProfilePic:     doc.ProfilePic,
+		Preferences:    doc.Preferences,
+		SavedLocations: doc.SavedLocations,
+		CreatedAt:      formatAccountTime(&doc.CreatedAt),
+		UpdatedAt:      formatAccountTime(doc.UpdatedAt),
+		LastLogin:      formatAccountTime(doc.LastLogin),
+		PasswordHash:   doc.PasswordHash,
+		Role:           doc.Role,
+	}
+	if user.SavedLocations == nil {
+		user.SavedLocations = []string{}
+	}
+	// Accounts registered before roles were stored are users
+	if user.Role == "" {
+		user.Role = auth.RoleUser
+	}
+	// and those registered before they were bound own their username's data
+	if user.UserID == "" {
+		user.UserID = user.Username
+	}
+	return user, nil
+}
+
+// UpdateUser replaces an account's profile and password hash
+func (s *MongoStore) UpdateUser(ctx context.Context, user User) error {
+	updated, err := parseTime(user.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	set := bson.M{
+		"email":         user.Email,
+		"password_hash": user.PasswordHash,
+		"full_name":     user.FullName,
+		"bio":           user.Bio,
+		"profile_pic":   user.ProfilePic,
+		"updated_at":    updated,
+	}
+	update := bson.M{"$set": set}
+	if user.Preferences != nil {
+		set["preferences"] = user.Preferences
+	} else {
+		update["$unset"] = bson.M{"preferences": ""}
+	}
+
+	res, err := s.users.UpdateOne(ctx, bson.M{"username": user.Username}, update)
+	if mongo.IsDuplicateKeyError(err) {
+		return errUserExists
+	}
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// SetLastLogin records when a user last logged in
+func (s *MongoStore) SetLastLogin(ctx context.Context, username, at string) error {
+	t, err := parseTime(at)
+	if err != nil {
+		return err
+	}
+	_, err = s.users.UpdateOne(ctx, bson.M{"username": username}, bson.M{"$set": bson.M{"last_login": t}})
+	return err
+}
+
+// SetRole changes a user's role
+func (s *MongoStore) SetRole(ctx context.Context, username, role string) error {
+	res, err := s.users.UpdateOne(ctx, bson.M{"username": username}, bson.M{"$set": bson.M{"role": role}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// BindUser sets the user_id an account owns
+func (s *MongoStore) BindUser(ctx context.Context, username, userID string) error {
+	res, err := s.users.UpdateOne(ctx, bson.M{"username": username}, bson.M{"$set": bson.M{"user_id": userID}})
+	if mongo.IsDuplicateKeyError(err) {
+		return errUserIDBound
+	}
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// SaveLocation adds a saved location, ignoring one already saved
+func (s *MongoStore) SaveLocation(ctx context.Context, username, locationID string) (bool, error) {
+	res, err := s.users.UpdateOne(ctx,
+		bson.M{"username": username},
+		bson.M{"$addToSet": bson.M{"saved_locations": locationID}},
+	)
+	if err != nil {
+		return false, err
+	}
+	if res.MatchedCount == 0 {
+		return false, errNotFound
+	}
+	return res.ModifiedCount > 0, nil
+}
+
+// RemoveLocation deletes a saved location
+func (s *MongoStore) RemoveLocation(ctx context.Context, username, locationID string) (bool, error) {
+	res, err := s.users.UpdateOne(ctx,
+		bson.M{"username": username},
+		bson.M{"$pull": bson.M{"saved_locations": locationID}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount > 0, nil
+}
+
+// mongoBatch writes each document as soon as it is given one. Nothing can
+// be undone, so a fix is inserted before its totals and a redelivered fix
+// finishes any totals that failed; the totals record the offsets folded in
+// so that none is counted twice.
+type mongoBatch struct {
+	s   *MongoStore
+	ctx context.Context
+}
+
+func (b *mongoBatch) Savepoint() error  { return nil }
+func (b *mongoBatch) RollbackTo() error { return nil }
+func (b *mongoBatch) Release() error    { return nil }
+func (b *mongoBatch) Commit() error     { return nil }
+func (b *mongoBatch) Rollback() error   { return nil }
+
+// InsertCoordinate inserts a fix, reporting false if its Kafka position is already stored
+func (b *mongoBatch) InsertCoordinate(event CoordinateEvent, seg segment, pos kafkaPosition) (bool, error) {
+	ts, err := parseTime(event.Timestamp)
+	if err != nil {
+		return false, err
+	}
+	doc := coordinateDoc{
+		UserID:    event.UserID,
+		SessionID: event.SessionID,
+		Latitude:  event.Lat,
+		Longitude: event.Lon,
+		Location:  pointAt(event.Lat, event.Lon),
+		Altitude:  event.Ele,
+		Speed:     seg.SpeedMps,
+		Timestamp: ts,
+		SegmentM:  seg.DistanceM,
+		MovingS:   seg.MovingS,
+		Kafka:     mongoPosition(pos),
+	}
+	if seg.EleDeltaM.Valid {
+		doc.EleDeltaM = &seg.EleDeltaM.Float64
+	}
+	stored, err := b.insert(b.s.coordinates, doc)
+	if err != nil || stored {
+		return stored, err
+	}
+	return false, b.finishTotals(event, pos)
+}
+
+// finishTotals folds an already stored fix into any totals that failed when
+// it was first delivered, using the segment stored with it
+func (b *mongoBatch) finishTotals(event CoordinateEvent, pos kafkaPosition) error {
+	var d coordinateDoc
+	err := b.s.coordinates.FindOne(b.ctx, bson.M{
+		"kafka.topic":     pos.Topic,
+		"kafka.partition": pos.Partition,
+		"kafka.offset":    pos.Offset,
+	}).Decode(&d)
+	if err != nil {
+		return err
+	}
+	seg := segment{DistanceM: d.SegmentM, MovingS: d.MovingS, SpeedMps: d.Speed, EleDeltaM: nullFloat(d.EleDeltaM)}
+
+	if event.SessionID != "" {
+		if err := b.UpdateSession(event, seg, pos); err != nil {
+			return err
+		}
+	}
+	return b.UpdateDailyStats(event, seg, pos)
+}
+
+// appliedField names the field of a session or daily rollup holding the
+// highest offset of pos's partition folded into it. Every fix comes from the
+// coordinates topic, and a partition's fixes are folded in offset order.
+func appliedField(pos kafkaPosition) string {
+	return fmt.Sprintf("applied.p%d", pos.Partition)
+}
+
+// upsertOnce applies an upsert unless the fix at pos is already folded into
+// the document. The guard then fails and the upsert tries to insert a second
+// document with the same key, which the unique index rejects.
+func (b *mongoBatch) upsertOnce(coll *mongo.Collection, filter, update bson.M, pos kafkaPosition) error {
+	filter[appliedField(pos)] = bson.M{"$not": bson.M{"$gte": pos.Offset}}
+	update["$max"].(bson.M)[appliedField(pos)] = pos.Offset
+	_, err := coll.UpdateOne(b.ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+// insert inserts doc, reporting false if it duplicates a unique index
+func (b *mongoBatch) insert(coll *mongo.Collection, doc interface{}) (bool, error) {
+	_, err := coll.InsertOne(b.ctx, doc)
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// LastFix reads the position a session was last seen at
+func (b *mongoBatch) LastFix(userID, sessionID string) (fix, bool, error) {
+	var d sessionDoc
+	err := b.s.sessions.FindOne(b.ctx, sessionFilter(userID, sessionID)).Decode(&d)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return fix{}, false, nil
+	}
+	if err != nil {
+		return fix{}, false, err
+	}
+	if d.LastLat == nil || d.LastLon == nil {
+		return fix{}, false, nil
+	}
+	return fix{
+		Lat:       *d.LastLat,
+		Lon:       *d.LastLon,
+		Timestamp: formatOptionalTime(d.LastTime),
+		Ele:       nullFloat(d.LastEle),
+	}, true, nil
+}
+
+// UpdateSession upserts the session with the fix added to its totals
+func (b *mongoBatch) UpdateSession(event CoordinateEvent, seg segment, pos kafkaPosition) error {
+	ts, err := parseTime(event.Timestamp)
+	if err != nil {
+		return err
+	}
+
+	set := bson.M{"last_lat": event.Lat, "last_lon": event.Lon, "last_time": ts}
+	minimum := bson.M{"start_time": ts, "min_lat": event.Lat, "min_lon": event.Lon}
+	maximum := bson.M{"max_lat": event.Lat, "max_lon": event.Lon, "max_speed_mps": seg.SpeedMps}
+	update := bson.M{
+		"$inc": bson.M{
+			"point_count": int64(1),
+			"distance_m":  seg.DistanceM,
+			"moving_s":    seg.MovingS,
+			"ele_gain_m":  seg.gain(),
+			"ele_loss_m":  seg.loss(),
+		},
+		"$set": set,
+		"$min": minimum,
+		"$max": maximum,
+	}
+	if event.Ele != nil {
+		set["last_ele"] = *event.Ele
+		minimum["min_ele"] = *event.Ele
+		maximum["max_ele"] = *event.Ele
+	} else {
+		update["$unset"] = bson.M{"last_ele": ""}
+	}
+
+	return b.upsertOnce(b.s.sessions, sessionFilter(event.UserID, event.SessionID), update, pos)
+}
+
+// UpdateDailyStats upserts the user's rollup for the day of the fix
+func (b *mongoBatch) UpdateDailyStats(event CoordinateEvent, seg segment, pos kafkaPosition) error {
+	ts, err := parseTime(event.Timestamp)
+	if err != nil {
+		return err
+	}
+
+	minimum := bson.M{"min_lat": event.Lat, "min_lon": event.Lon}
+	maximum := bson.M{"max_lat": event.Lat, "max_lon": event.Lon, "max_speed_mps": seg.SpeedMps}
+	if event.Ele != nil {
+		minimum["min_ele"] = *event.Ele
+		maximum["max_ele"] = *event.Ele
+	}
+	update := bson.M{
+		"$inc": bson.M{
+			"point_count": int64(1),
+			"distance_m":  seg.DistanceM,
+			"moving_s":    seg.MovingS,
+			"ele_gain_m":  seg.gain(),
+			"ele_loss_m":  seg.loss(),
+		},
+		"$min": minimum,
+		"$max": maximum,
+	}
+
+	filter := bson.M{"user_id": event.UserID, "day": ts.UTC().Format("2006-01-02")}
+	return b.upsertOnce(b.s.dailyStats, filter, update, pos)
+}
+
+// InsertLocation inserts a check-in, reporting false if its Kafka position is already stored
+func (b *mongoBatch) InsertLocation(event LocationEvent, pos kafkaPosition) (bool, error) {
+	ts, err := parseTime(event.Timestamp)
+	if err != nil {
+		return false, err
+	}
+	return b.insert(b.s.locations, locationDoc{
+		Name:        event.Location,
+		Coordinates: latLon{Latitude: event.Lat, Longitude: event.Lon},
+		Location:    pointAt(event.Lat, event.Lon),
+		UserID:      event.UserID,
+		SessionID:   event.SessionID,
+		CreatedAt:   ts,
+		Kafka:       mongoPosition(pos),
+	})
+}
+
+// StartSession records a session's activity and start time
+func (b *mongoBatch) StartSession(event SessionEvent) error {
+	ts, err := parseTime(event.Timestamp)
+	if err != nil {
+		return err
+	}
+	update := bson.M{"$set": bson.M{"activity": event.Activity, "start_time": ts}}
+	filter := sessionFilter(event.UserID, event.SessionID)
+	_, err = b.s.sessions.UpdateOne(b.ctx, filter, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// EndSession records a session's end time
+func (b *mongoBatch) EndSession(event SessionEvent) error {
+	ts, err := parseTime(event.Timestamp)
+	if err != nil {
+		return err
+	}
+	update := bson.M{
+		"$setOnInsert": bson.M{"activity": event.Activity},
+		"$set":         bson.M{"end_time": ts},
+	}
+	filter := sessionFilter(event.UserID, event.SessionID)
+	_, err = b.s.sessions.UpdateOne(b.ctx, filter, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// sessionFilter matches a user's session; an upsert copies both fields
+// into the new document
+func sessionFilter(userID, sessionID string) bson.M {
+	return bson.M{"user_id": userID, "session_id": sessionID}
+}
+
+// InsideGeofences reads the fences a user is currently inside
+func (b *mongoBatch) InsideGeofences(userID string) (map[int64]bool, error) {
+	var docs []struct {
+		GeofenceID int64 `bson:"geofence_id"`
+	}
+	err := b.s.find(b.ctx, b.s.geofenceState, bson.M{"user_id": userID, "inside": true}, options.Find(), &docs)
+	if err != nil {
+		return nil, err
+	}
+	inside := map[int64]bool{}
+	for _, d := range docs {
+		inside[d.GeofenceID] = true
+	}
+	return inside, nil
+}
+
+// SetGeofenceState records whether a user is inside a fence and since when
+func (b *mongoBatch) SetGeofenceState(userID string, geofenceID int64, inside bool, since string) error {
+	ts, err := parseTime(since)
+	if err != nil {
+		return err
+	}
+	_, err = b.s.geofenceState.UpdateOne(b.ctx,
+		bson.M{"user_id": userID, "geofence_id": geofenceID},
+		bson.M{"$set": bson.M{"inside": inside, "since": ts}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// InsertGeofenceEvent stores an enter or exit event
+func (b *mongoBatch) InsertGeofenceEvent(ge GeofenceEvent) error {
+	ts, err := parseTime(ge.Timestamp)
+	if err != nil {
+		return err
+	}
+	_, err = b.s.geofenceEvents.InsertOne(b.ctx, geofenceEventDoc{
+		Type:         ge.Type,
+		GeofenceID:   ge.GeofenceID,
+		GeofenceName: ge.GeofenceName,
+		UserID:       ge.UserID,
+		SessionID:    ge.SessionID,
+		Lat:          ge.Lat,
+		Lon:          ge.Lon,
+		Location:     pointAt(ge.Lat, ge.Lon),
+		Timestamp:    ts,
+	})
+	return err
+}
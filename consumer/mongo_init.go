@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// InitMongo connects to the MongoDB deployment at uri and checks that it answers
+func InitMongo(ctx context.Context, uri string) (*mongo.Client, error) {
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, fmt.Errorf("mongo connect: %w", err)
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(ctx)
+		return nil, fmt.Errorf("mongo ping: %w", err)
+	}
+
+	return client, nil
+}
+
+// coordinatesValidator is the validation schema of the coordinates collection
+func coordinatesValidator() bson.M {
+	return bson.M{
+		"$jsonSchema": bson.M{
+			"bsonType": "object",
+			"required": []string{"user_id", "latitude", "longitude", "location", "timestamp"},
+			"properties": bson.M{
+				"user_id": bson.M{
+					"bsonType":    "string",
+					"description": "ID of the user who generated this coordinate",
+				},
+				"latitude": bson.M{
+					"bsonType":    "double",
+					"description": "Latitude coordinate",
+				},
+				"longitude": bson.M{
+					"bsonType":    "double",
+					"description": "Longitude coordinate",
+				},
+				"location": bson.M{
+					"bsonType": "object",
+					"required": []string{"type", "coordinates"},
+					"properties": bson.M{
+						"type": bson.M{
+							"enum":        []string{"Point"},
+							"description": "GeoJSON type, always Point",
+						},
+						"coordinates": bson.M{
+							"bsonType":    "array",
+							"minItems":    2,
+							"maxItems":    2,
+							"items":       bson.M{"bsonType": "double"},
+							"description": "Longitude and latitude, in that order",
+						},
+					},
+					"description": "GeoJSON point of the coordinate, for the 2dsphere index",
+				},
+				"altitude": bson.M{
+					"bsonType":    "double",
+					"description": "Altitude in meters (optional)",
+				},
+				"accuracy": bson.M{
+					"bsonType":    "double",
+					"description": "Accuracy of the coordinates in meters (optional)",
+				},
+				"speed": bson.M{
+					"bsonType":    "double",
+					"description": "Speed in meters per second (optional)",
+				},
+				"timestamp": bson.M{
+					"bsonType":    "date",
+					"description": "Time when the coordinate was recorded",
+				},
+				"activity_type": bson.M{
+					"bsonType":    "string",
+					"description": "Type of activity (e.g., running, cycling, walking)",
+				},
+			},
+		},
+	}
+}
+
+// locationsValidator is the validation schema of the locations collection
+func locationsValidator() bson.M {
+	return bson.M{
+		"$jsonSchema": bson.M{
+			"bsonType": "object",
+			"required": []string{"name", "coordinates", "created_at"},
+			"properties": bson.M{
+				"name": bson.M{
+					"bsonType":    "string",
+					"description": "Name of the location",
+				},
+				"description": bson.M{
+					"bsonType":    "string",
+					"description": "Description of the location",
+				},
+				"coordinates": bson.M{
+					"bsonType": "object",
+					"required": []string{"latitude", "longitude"},
+					"properties": bson.M{
+						"latitude": bson.M{
+							"bsonType":    "double",
+							"description": "Latitude coordinate",
+						},
+						"longitude": bson.M{
+							"bsonType":    "double",
+							"description": "Longitude coordinate",
+						},
+					},
+				},
+				"address": bson.M{
+					"bsonType":    "string",
+					"description": "Physical address of the location",
+				},
+				"category": bson.M{
+					"bsonType":    "string",
+					"description": "Category of the location (e.g., restaurant, park, museum)",
+				},
+				"tags": bson.M{
+					"bsonType":    "array",
+					"description": "Tags associated with the location",
+					"items": bson.M{
+						"bsonType": "string",
+					},
+				},
+				"rating": bson.M{
+					"bsonType":    "double",
+					"minimum":     0,
+					"maximum":     5,
+					"description": "Rating of the location (0-5)",
+				},
+				"photos": bson.M{
+					"bsonType":    "array",
+					"description": "URLs to photos of the location",
+					"items": bson.M{
+						"bsonType": "string",
+					},
+				},
+				"created_at": bson.M{
+					"bsonType":    "date",
+					"description": "Date when the location was created",
+				},
+				"updated_at": bson.M{
+					"bsonType":    "date",
+					"description": "Date when the location was last updated",
+				},
+			},
+		},
+	}
+}
+
+// usersValidator is the validation schema of the users collection
+func usersValidator() bson.M {
+	return bson.M{
+		"$jsonSchema": bson.M{
+			"bsonType": "object",
+			"required": []string{"username", "email", "created_at"},
+			"properties": bson.M{
+				"username": bson.M{
+					"bsonType":    "string",
+					"description": "Username must be a string and is required",
+				},
+				"email": bson.M{
+					"bsonType":    "string",
+					"pattern":     "^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\\.[a-zA-Z]{2,}$",
+					"description": "Email must be a valid email address and is required",
+				},
+				"password_hash": bson.M{
+					"bsonType":    "string",
+					"description": "Hashed password for the user",
+				},
+				"role": bson.M{
+					"enum":        []string{"user", "admin"},
+					"description": "Role granted to the user by an operator",
+				},
+				"user_id": bson.M{
+					"bsonType":    "string",
+					"description": "user_id of the events the account owns",
+				},
+				"full_name": bson.M{
+					"bsonType":    "string",
+					"description": "Full name of the user",
+				},
+				"profile_pic": bson.M{
+					"bsonType":    "string",
+					"description": "URL to profile picture",
+				},
+				"bio": bson.M{
+					"bsonType":    "string",
+					"description": "User biography",
+				},
+				"preferences": bson.M{
+					"bsonType":    "object",
+					"description": "User preferences",
+				},
+				"saved_locations": bson.M{
+					"bsonType":    "array",
+					"description": "Array of saved location IDs",
+					"items": bson.M{
+						"bsonType": "string",
+					},
+				},
+				"created_at": bson.M{
+					"bsonType":    "date",
+					"description": "Date when the user was created",
+				},
+				"updated_at": bson.M{
+					"bsonType":    "date",
+					"description": "Date when the user was last updated",
+				},
+				"last_login": bson.M{
+					"bsonType":    "date",
+					"description": "Date of the user's last login",
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoMigration is one versioned change to the MongoDB schema. Applied
+// versions are recorded in the schema_migrations collection.
+//
+// Every step is safe to run again, so a migration interrupted part-way is
+// simply rerun. Validators are installed in their current form: a
+// migration that changes one re-applies it with collMod, and a fresh
+// database ends up with the same schema as one migrated step by step.
+type mongoMigration struct {
+	Version     int
+	Description string
+	Steps       []migrationStep
+}
+
+// migrationStep is a single idempotent schema change
+type migrationStep interface {
+	// String describes the step for logs and dry runs
+	String() string
+	apply(ctx context.Context, db *mongo.Database) error
+}
+
+// mongoMigrations is the schema history, in version order. Append new
+// migrations; never edit or renumber one that has shipped.
+var mongoMigrations = []mongoMigration{
+	{
+		Version:     1,
+		Description: "create the validated coordinates, locations and users collections",
+		Steps: []migrationStep{
+			createCollection{"coordinates", coordinatesValidator},
+			createIndex{"coordinates", bson.D{{Key: "user_id", Value: 1}}, nil},
+			createIndex{"coordinates", bson.D{{Key: "timestamp", Value: 1}}, nil},
+			createIndex{"coordinates", bson.D{{Key: "user_id", Value: 1}, {Key: "timestamp", Value: 1}}, nil},
+			createIndex{"coordinates", bson.D{{Key: "location", Value: "2dsphere"}}, nil},
+
+			createCollection{"locations", locationsValidator},
+			createIndex{"locations", bson.D{{Key: "name", Value: "text"}, {Key: "description", Value: "text"}}, nil},
+			createIndex{"locations", bson.D{{Key: "category", Value: 1}}, nil},
+			createIndex{"locations", bson.D{{Key: "location", Value: "2dsphere"}}, nil},
+
+			createCollection{"users", usersValidator},
+			createIndex{"users", bson.D{{Key: "username", Value: 1}}, options.Index().SetUnique(true)},
+			createIndex{"users", bson.D{{Key: "email", Value: 1}}, options.Index().SetUnique(true)},
+		},
+	},
+	{
+		Version:     2,
+		Description: "store a GeoJSON location point on every coordinate",
+		Steps: []migrationStep{
+			migrationFunc{"fill in location from latitude and longitude on coordinates", backfillLocation},
+			setValidator{"coordinates", coordinatesValidator},
+		},
+	},
+	{
+		Version:     3,
+		Description: "index Kafka positions and the store's queries",
+		Steps: []migrationStep{
+			// Redelivered messages are recognised by the position they were read from
+			createIndex{"coordinates", kafkaPositionKeys, options.Index().SetUnique(true)},
+			createIndex{"coordinates", bson.D{{Key: "session_id", Value: 1}, {Key: "timestamp", Value: 1}}, nil},
+			createIndex{"locations", kafkaPositionKeys, options.Index().SetUnique(true)},
+			createIndex{"locations", bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}, nil},
+			createIndex{"sessions", bson.D{{Key: "user_id", Value: 1}, {Key: "start_time", Value: -1}}, nil},
+			createIndex{"user_daily_stats", bson.D{{Key: "user_id", Value: 1}, {Key: "day", Value: 1}}, options.Index().SetUnique(true)},
+			createIndex{"geofence_state", bson.D{{Key: "user_id", Value: 1}, {Key: "geofence_id", Value: 1}}, options.Index().SetUnique(true)},
+			createIndex{"geofence_events", bson.D{{Key: "user_id", Value: 1}, {Key: "timestamp", Value: -1}}, nil},
+			createIndex{"geofence_events", bson.D{{Key: "geofence_id", Value: 1}, {Key: "timestamp", Value: -1}}, nil},
+		},
+	},
+	{
+		Version:     4,
+		Description: "drop the coordinates user_id index, a prefix of user_id+timestamp",
+		Steps: []migrationStep{
+			dropIndex{"coordinates", "user_id_1"},
+		},
+	},
+	{
+		Version:     5,
+		Description: "allow a role on users",
+		Steps: []migrationStep{
+			setValidator{"users", usersValidator},
+		},
+	},
+	{
+		Version:     6,
+		Description: "key sessions by user and session ID",
+		Steps: []migrationStep{
+			migrationFunc{"copy the session ID from _id into session_id on sessions", backfillSessionID},
+			createIndex{"sessions", bson.D{{Key: "user_id", Value: 1}, {Key: "session_id", Value: 1}}, options.Index().SetUnique(true)},
+		},
+	},
+	{
+		Version:     7,
+		Description: "bind each account to the user_id it owns",
+		Steps: []migrationStep{
+			migrationFunc{"bind accounts registered before bindings to their username", backfillAccountUserID},
+			setValidator{"users", usersValidator},
+			createIndex{"users", bson.D{{Key: "user_id", Value: 1}}, options.Index().SetUnique(true)},
+		},
+	},
+}
+
+// kafkaPositionKeys are the keys of the unique Kafka position indexes
+var kafkaPositionKeys = bson.D{{Key: "kafka.topic", Value: 1}, {Key: "kafka.partition", Value: 1}, {Key: "kafka.offset", Value: 1}}
+
+// migrationRecord is a document in schema_migrations
+type migrationRecord struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"applied_at"`
+}
+
+// PendingMigrations returns the migrations not yet recorded as applied to db
+func PendingMigrations(ctx context.Context, db *mongo.Database) ([]mongoMigration, error) {
+	cur, err := db.Collection("schema_migrations").Find(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("reading schema_migrations: %w", err)
+	}
+	var records []migrationRecord
+	if err := cur.All(ctx, &records); err != nil {
+		return nil, fmt.Errorf("reading schema_migrations: %w", err)
+	}
+	applied := make(map[int]bool, len(records))
+	for _, r := range records {
+		applied[r.Version] = true
+	}
+
+	var pending []mongoMigration
+	for _, m := range mongoMigrations {
+		if !applied[m.Version] {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// MigrateMongo applies the pending migrations in version order, recording
+// each one once all its steps have succeeded. With dryRun it only logs the
+// steps it would run. It returns the number of pending migrations.
+func MigrateMongo(ctx context.Context, db *mongo.Database, dryRun bool) (int, error) {
+	pending, err := PendingMigrations(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, m := range pending {
+		if dryRun {
+			log.Printf("Would apply migration %d: %s", m.Version, m.Description)
+			for _, step := range m.Steps {
+				log.Printf("  %s", step)
+			}
+			continue
+		}
+
+		log.Printf("Applying migration %d: %s", m.Version, m.Description)
+		for _, step := range m.Steps {
+			if err := step.apply(ctx, db); err != nil {
+				return 0, fmt.Errorf("migration %d: %s: %w", m.Version, step, err)
+			}
+		}
+		record := migrationRecord{Version: m.Version, Description: m.Description, AppliedAt: time.Now().UTC()}
+		_, err := db.Collection("schema_migrations").InsertOne(ctx, record)
+		// Another consumer may have run the same migration concurrently
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return 0, fmt.Errorf("recording migration %d: %w", m.Version, err)
+		}
+	}
+	return len(pending), nil
+}
+
+// createCollection creates a collection with its validator. An existing
+// collection is left alone; a later setValidator brings its schema up to date.
+type createCollection struct {
+	name      string
+	validator func() bson.M
+}
+
+func (s createCollection) String() string {
+	return "create collection " + s.name
+}
+
+func (s createCollection) apply(ctx context.Context, db *mongo.Database) error {
+	names, err := db.ListCollectionNames(ctx, bson.M{"name": s.name})
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		return nil
+	}
+	return db.CreateCollection(ctx, s.name, options.CreateCollection().SetValidator(s.validator()))
+}
+
+// setValidator replaces the validator of an existing collection. Documents
+// already stored are not revalidated.
+type setValidator struct {
+	coll      string
+	validator func() bson.M
+}
+
+func (s setValidator) String() string {
+	return "update the validator of " + s.coll
+}
+
+func (s setValidator) apply(ctx context.Context, db *mongo.Database) error {
+	cmd := bson.D{{Key: "collMod", Value: s.coll}, {Key: "validator", Value: s.validator()}}
+	return db.RunCommand(ctx, cmd).Err()
+}
+
+// createIndex adds an index, or does nothing if the same one exists
+type createIndex struct {
+	coll string
+	keys bson.D
+	opts *options.IndexOptions
+}
+
+func (s createIndex) String() string {
+	kind := "index"
+	if s.opts != nil && s.opts.Unique != nil && *s.opts.Unique {
+		kind = "unique index"
+	}
+	return fmt.Sprintf("create %s %s on %s", kind, indexName(s.keys), s.coll)
+}
+
+func (s createIndex) apply(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(s.coll).Indexes().CreateOne(ctx, mongo.IndexModel{Keys: s.keys, Options: s.opts})
+	return err
+}
+
+// dropIndex removes an index by name, or does nothing if it is already gone
+type dropIndex struct {
+	coll string
+	name string
+}
+
+func (s dropIndex) String() string {
+	return fmt.Sprintf("drop index %s on %s", s.name, s.coll)
+}
+
+func (s dropIndex) apply(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(s.coll).Indexes().DropOne(ctx, s.name)
+	// 26: NamespaceNotFound, 27: IndexNotFound
+	var serr mongo.ServerError
+	if errors.As(err, &serr) && (serr.HasErrorCode(26) || serr.HasErrorCode(27)) {
+		return nil
+	}
+	return err
+}
+
+// migrationFunc is a data migration written as code
+type migrationFunc struct {
+	description string
+	fn          func(ctx context.Context, db *mongo.Database) error
+}
+
+func (s migrationFunc) String() string {
+	return s.description
+}
+
+func (s migrationFunc) apply(ctx context.Context, db *mongo.Database) error {
+	return s.fn(ctx, db)
+}
+
+// indexName returns the name MongoDB gives an index with these keys by default
+func indexName(keys bson.D) string {
+	parts := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		parts = append(parts, k.Key, fmt.Sprint(k.Value))
+	}
+	return strings.Join(parts, "_")
+}
+
+// backfillLocation gives coordinates stored before documents carried a
+// GeoJSON location one built from their latitude and longitude
+// backfillSessionID names sessions written when _id was the session ID.
+// Sessions two users already shared stay merged under the first user.
+func backfillSessionID(ctx context.Context, db *mongo.Database) error {
+	filter := bson.M{"session_id": bson.M{"$exists": false}}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"session_id": "$_id"}}},
+	}
+	res, err := db.Collection("sessions").UpdateMany(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount > 0 {
+		log.Printf("Added a session_id to %d sessions", res.ModifiedCount)
+	}
+	return nil
+}
+
+// backfillAccountUserID binds older accounts to the user_id they owned
+// when it was their username
+func backfillAccountUserID(ctx context.Context, db *mongo.Database) error {
+	filter := bson.M{"user_id": bson.M{"$exists": false}}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"user_id": "$username"}}},
+	}
+	res, err := db.Collection("users").UpdateMany(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount > 0 {
+		log.Printf("Bound %d accounts to their username", res.ModifiedCount)
+	}
+	return nil
+}
+
+func backfillLocation(ctx context.Context, db *mongo.Database) error {
+	// Positions out of range cannot be indexed and would fail the whole
+	// update, so they are left without a location
+	filter := bson.M{
+		"location":  bson.M{"$exists": false},
+		"latitude":  bson.M{"$gte": -90, "$lte": 90},
+		"longitude": bson.M{"$gte": -180, "$lte": 180},
+	}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"location": bson.M{
+			"type":        "Point",
+			"coordinates": bson.A{"$longitude", "$latitude"},
+		}}}},
+	}
+	res, err := db.Collection("coordinates").UpdateMany(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount > 0 {
+		log.Printf("Added a location to %d coordinates", res.ModifiedCount)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestMongoMigrationsOrdered(t *testing.T) {
+	for i, m := range mongoMigrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %d has version %d, want %d", i, m.Version, i+1)
+		}
+		if m.Description == "" || len(m.Steps) == 0 {
+			t.Errorf("migration %d has no description or no steps", m.Version)
+		}
+	}
+}
+
+// TestMongoDroppedIndexesExisted checks that every index a migration drops
+// was created by an earlier one under the name it is dropped by
+func TestMongoDroppedIndexesExisted(t *testing.T) {
+	created := map[string]bool{}
+	for _, m := range mongoMigrations {
+		for _, step := range m.Steps {
+			switch s := step.(type) {
+			case createIndex:
+				created[s.coll+"."+indexName(s.keys)] = true
+			case dropIndex:
+				if !created[s.coll+"."+s.name] {
+					t.Errorf("migration %d drops %s on %s, which no earlier migration created", m.Version, s.name, s.coll)
+				}
+			}
+		}
+	}
+}
+
+func TestIndexName(t *testing.T) {
+	tests := []struct {
+		keys bson.D
+		want string
+	}{
+		{bson.D{{Key: "user_id", Value: 1}}, "user_id_1"},
+		{bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}, "user_id_1_created_at_-1"},
+		{bson.D{{Key: "location", Value: "2dsphere"}}, "location_2dsphere"},
+		{kafkaPositionKeys, "kafka.topic_1_kafka.partition_1_kafka.offset_1"},
+	}
+	for _, tt := range tests {
+		if got := indexName(tt.keys); got != tt.want {
+			t.Errorf("indexName(%v) = %q, want %q", tt.keys, got, tt.want)
+		}
+	}
+}
+
+// TestMigrateMongoIdempotent runs the migrations against a local mongod,
+// given as MONGO_TEST_URI, in a database of its own that it drops after
+func TestMigrateMongoIdempotent(t *testing.T) {
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	client, err := InitMongo(ctx, uri)
+	if err != nil {
+		t.Fatalf("InitMongo: %v", err)
+	}
+	defer client.Disconnect(ctx)
+	name := fmt.Sprintf("gps_test_%d", time.Now().UnixNano())
+	db := client.Database(name)
+	defer db.Drop(ctx)
+
+	runs := []struct {
+		name string
+		want int
+	}{
+		{"fresh database", len(mongoMigrations)},
+		{"up to date", 0},
+	}
+	for _, run := range runs {
+		n, err := MigrateMongo(ctx, db, false)
+		if err != nil {
+			t.Fatalf("%s: MigrateMongo: %v", run.name, err)
+		}
+		if n != run.want {
+			t.Errorf("%s: applied %d migrations, want %d", run.name, n, run.want)
+		}
+	}
+
+	// An interrupted migration is rerun from its first step
+	for _, m := range mongoMigrations {
+		for _, step := range m.Steps {
+			if err := step.apply(ctx, db); err != nil {
+				t.Errorf("migration %d: rerunning %s: %v", m.Version, step, err)
+			}
+		}
+	}
+
+	store, err := OpenMongoStore(ctx, uri, name, false)
+	if err != nil {
+		t.Fatalf("OpenMongoStore without migrating: %v", err)
+	}
+	store.Close()
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"shared/events"
+)
+
+// cursor is the position of the last row returned by a paginated query.
+// It is handed to clients as an opaque base64 token.
+type cursor struct {
+	Timestamp string `json:"t"`
+	ID        int64  `json:"id,omitempty"`  // SQLite row ID
+	OID       string `json:"oid,omitempty"` // MongoDB ObjectID, in hex
+}
+
+// errInvalidCursor is returned for a token that is not a cursor, or is a
+// cursor from a different storage backend
+var errInvalidCursor = errors.New("invalid cursor")
+
+// errInvalidPolygon is returned for a polygon= whose edges cross
+var errInvalidPolygon = errors.New("invalid polygon: edges must not cross")
+
+// encodeCursor turns a row position into an opaque pagination token
+func encodeCursor(c cursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor parses a token produced by encodeCursor
+func decodeCursor(token string) (cursor, error) {
+	var c cursor
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return c, errInvalidCursor
+	}
+	if err := json.Unmarshal(data, &c); err != nil || c.Timestamp == "" {
+		return c, errInvalidCursor
+	}
+	return c, nil
+}
+
+// Page sizes for the list endpoints
+const (
+	defaultLimit = 50
+	maxLimit     = 1000
+)
+
+// parseLimit reads the optional limit query parameter, which must be a
+// positive integer no larger than maxLimit
+func parseLimit(q url.Values) (int, error) {
+	v := q.Get("limit")
+	if v == "" {
+		return defaultLimit, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid limit: must be a positive integer")
+	}
+	if n > maxLimit {
+		return 0, fmt.Errorf("invalid limit: must be at most %d", maxLimit)
+	}
+	return n, nil
+}
+
+// parseTimeRange reads the optional from/to RFC3339 query parameters and
+// returns them in events.TimestampLayout so they compare correctly with
+// stored timestamps
+func parseTimeRange(q url.Values) (from, to string, err error) {
+	if v := q.Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid from: must be RFC3339")
+		}
+		from = t.UTC().Format(events.TimestampLayout)
+	}
+	if v := q.Get("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid to: must be RFC3339")
+		}
+		to = t.UTC().Format(events.TimestampLayout)
+	}
+	if from != "" && to != "" && from > to {
+		return "", "", fmt.Errorf("invalid range: from is after to")
+	}
+	return from, to, nil
+}
+
+// parseBBox parses a bbox=minLon,minLat,maxLon,maxLat query parameter
+func parseBBox(v string) (*BoundingBox, error) {
+	parts := strings.Split(v, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("invalid bbox: expected minLon,minLat,maxLon,maxLat")
+	}
+
+	vals := make([]float64, 4)
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bbox: %q is not a number", p)
+		}
+		vals[i] = f
+	}
+
+	bbox := &BoundingBox{MinLon: vals[0], MinLat: vals[1], MaxLon: vals[2], MaxLat: vals[3]}
+	if bbox.MinLat > bbox.MaxLat || bbox.MinLon > bbox.MaxLon {
+		return nil, fmt.Errorf("invalid bbox: min exceeds max")
+	}
+	if bbox.MinLat < -90 || bbox.MaxLat > 90 || bbox.MinLon < -180 || bbox.MaxLon > 180 {
+		return nil, fmt.Errorf("invalid bbox: coordinates out of range")
+	}
+	return bbox, nil
+}
+
+// maxNearRadius is the largest radius= accepted, half the Earth's circumference
+const maxNearRadius = math.Pi * earthRadiusMeters
+
+// parseNear parses the near=lat,lon and radius=<metres> query parameters
+func parseNear(near, radius string) (*GeoCircle, error) {
+	parts := strings.Split(near, ",")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid near: expected lat,lon")
+	}
+	center, err := parsePoint(parts[0], parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid near: %w", err)
+	}
+
+	if radius == "" {
+		return nil, fmt.Errorf("radius is required with near")
+	}
+	r, err := strconv.ParseFloat(radius, 64)
+	if err != nil || r <= 0 || r > maxNearRadius {
+		return nil, fmt.Errorf("invalid radius: must be metres between 0 and %.0f", maxNearRadius)
+	}
+	return &GeoCircle{Center: center, RadiusM: r}, nil
+}
+
+// parsePolygon parses a polygon=lat,lon,lat,lon,... query parameter. The
+// ring is closed implicitly; repeating the first point at the end is allowed.
+func parsePolygon(v string) ([]Point, error) {
+	parts := strings.Split(v, ",")
+	if len(parts)%2 != 0 {
+		return nil, fmt.Errorf("invalid polygon: expected lat,lon pairs")
+	}
+
+	var polygon []Point
+	for i := 0; i < len(parts); i += 2 {
+		p, err := parsePoint(parts[i], parts[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid polygon: point %d: %w", i/2, err)
+		}
+		if n := len(polygon); n > 0 && polygon[n-1] == p {
+			return nil, fmt.Errorf("invalid polygon: point %d repeats the one before it", i/2)
+		}
+		polygon = append(polygon, p)
+	}
+	if n := len(polygon); n > 1 && polygon[0] == polygon[n-1] {
+		polygon = polygon[:n-1]
+	}
+
+	if len(polygon) < 3 {
+		return nil, fmt.Errorf("invalid polygon: needs at least 3 points")
+	}
+	if polygonSelfIntersects(polygon) {
+		return nil, errInvalidPolygon
+	}
+	return polygon, nil
+}
+
+// parsePoint parses a latitude and longitude into a valid Point
+func parsePoint(lat, lon string) (Point, error) {
+	var p Point
+	var err error
+	if p.Lat, err = strconv.ParseFloat(strings.TrimSpace(lat), 64); err != nil {
+		return p, fmt.Errorf("%q is not a number", lat)
+	}
+	if p.Lon, err = strconv.ParseFloat(strings.TrimSpace(lon), 64); err != nil {
+		return p, fmt.Errorf("%q is not a number", lon)
+	}
+	return p, validPoint(p)
+}
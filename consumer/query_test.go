@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		c    cursor
+	}{
+		{"sqlite", cursor{Timestamp: "2026-10-16T10:00:00Z", ID: 42}},
+		{"mongodb", cursor{Timestamp: "2026-10-16T10:00:00Z", OID: "652d1f0c8b3e4a0012345678"}},
+		{"timestamp only", cursor{Timestamp: "2026-10-16T10:00:00Z"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeCursor(encodeCursor(tt.c))
+			if err != nil {
+				t.Fatalf("decodeCursor: %v", err)
+			}
+			if got != tt.c {
+				t.Errorf("decoded %+v, want %+v", got, tt.c)
+			}
+		})
+	}
+}
+
+func TestDecodeCursorRejects(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"empty", ""},
+		{"not base64", "not a cursor!"},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte(`{"t":"2026-10-16T10:00:00Z","id":1}`))},
+		{"not JSON", base64.RawURLEncoding.EncodeToString([]byte("t=2026"))},
+		{"no timestamp", base64.RawURLEncoding.EncodeToString([]byte(`{"id":1}`))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeCursor(tt.token); err != errInvalidCursor {
+				t.Errorf("decodeCursor(%q) error = %v, want errInvalidCursor", tt.token, err)
+			}
+		})
+	}
+}
+
+func TestParseTimeRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		from, to string
+		wantErr  bool
+	}{
+		{"open", "", "", "", false},
+		{"utc", "from=2026-10-16T10:00:00Z&to=2026-10-16T11:00:00Z", "2026-10-16T10:00:00.000000000Z", "2026-10-16T11:00:00.000000000Z", false},
+		{"offset normalised", "from=2026-10-16T12:00:00%2B02:00", "2026-10-16T10:00:00.000000000Z", "", false},
+		{"fraction kept", "to=2026-10-16T10:00:00.25Z", "", "2026-10-16T10:00:00.250000000Z", false},
+		{"not rfc3339", "to=yesterday", "", "", true},
+		{"reversed", "from=2026-10-16T11:00:00Z&to=2026-10-16T10:00:00Z", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, _ := url.ParseQuery(tt.query)
+			from, to, err := parseTimeRange(q)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTimeRange error = %v, want error %v", err, tt.wantErr)
+			}
+			if from != tt.from || to != tt.to {
+				t.Errorf("got %q..%q, want %q..%q", from, to, tt.from, tt.to)
+			}
+		})
+	}
+}
+
+func TestParseBBox(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    *BoundingBox
+		wantErr bool
+	}{
+		{"-0.2,51.4,0.1,51.6", &BoundingBox{MinLon: -0.2, MinLat: 51.4, MaxLon: 0.1, MaxLat: 51.6}, false},
+		{" -0.2, 51.4, 0.1, 51.6 ", &BoundingBox{MinLon: -0.2, MinLat: 51.4, MaxLon: 0.1, MaxLat: 51.6}, false},
+		{"-0.2,51.4,0.1", nil, true},
+		{"a,51.4,0.1,51.6", nil, true},
+		{"0.1,51.4,-0.2,51.6", nil, true},
+		{"-0.2,51.4,0.1,91", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseBBox(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseBBox(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseBBox(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    int
+		wantErr bool
+	}{
+		{"", defaultLimit, false},
+		{"limit=1", 1, false},
+		{"limit=1000", 1000, false},
+		{"limit=1001", 0, true},
+		{"limit=0", 0, true},
+		{"limit=-5", 0, true},
+		{"limit=ten", 0, true},
+	}
+	for _, tt := range tests {
+		q, _ := url.ParseQuery(tt.query)
+		got, err := parseLimit(q)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseLimit(%q) error = %v, want error %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseLimit(%q) = %d, want %d", tt.query, got, tt.want)
+		}
+	}
+}
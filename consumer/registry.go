@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"shared/events"
+)
+
+// registryResource serves a read-only subset of the Confluent Schema
+// Registry REST API over the local registry, so tools that speak it can
+// decode Protobuf and Avro messages:
+//
+//	GET /registry/subjects
+//	GET /registry/subjects/{subject}/versions
+//	GET /registry/subjects/{subject}/versions/{version|latest}
+//	GET /registry/schemas/ids/{id}
+func registryResource(reg *events.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/registry/"), "/"), "/")
+		switch {
+		case len(parts) == 1 && parts[0] == "subjects":
+			writeRegistryJSON(w, reg.Subjects())
+
+		case len(parts) == 3 && parts[0] == "subjects" && parts[2] == "versions":
+			schemas := reg.Versions(parts[1])
+			if len(schemas) == 0 {
+				http.Error(w, "Subject not found", http.StatusNotFound)
+				return
+			}
+			versions := make([]int, len(schemas))
+			for i, s := range schemas {
+				versions[i] = s.Version
+			}
+			writeRegistryJSON(w, versions)
+
+		case len(parts) == 4 && parts[0] == "subjects" && parts[2] == "versions":
+			schemas := reg.Versions(parts[1])
+			if len(schemas) == 0 {
+				http.Error(w, "Subject not found", http.StatusNotFound)
+				return
+			}
+			if parts[3] == "latest" {
+				writeRegistryJSON(w, schemas[len(schemas)-1])
+				return
+			}
+			version, err := strconv.Atoi(parts[3])
+			if err != nil {
+				http.Error(w, "invalid version", http.StatusBadRequest)
+				return
+			}
+			for _, s := range schemas {
+				if s.Version == version {
+					writeRegistryJSON(w, s)
+					return
+				}
+			}
+			http.Error(w, "Version not found", http.StatusNotFound)
+
+		case len(parts) == 3 && parts[0] == "schemas" && parts[1] == "ids":
+			id, err := strconv.Atoi(parts[2])
+			if err != nil {
+				http.Error(w, "invalid schema id", http.StatusBadRequest)
+				return
+			}
+			s, err := reg.ByID(id)
+			if errors.Is(err, events.ErrSchemaNotFound) {
+				http.Error(w, "Schema not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeRegistryJSON(w, map[string]string{"schemaType": s.SchemaType, "schema": s.Schema})
+
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+// writeRegistryJSON writes v with the registry's content type
+func writeRegistryJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	json.NewEncoder(w).Encode(v)
+}
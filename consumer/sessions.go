@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"shared/events"
+)
+
+const (
+	SessionStart = events.SessionStart
+	SessionEnd   = events.SessionEnd
+)
+
+// SessionEvent marks the start or end of a user's activity session
+type SessionEvent = events.SessionEvent
+
+// BoundingBox is the extent covered by a set of points
+type BoundingBox struct {
+	MinLat float64 `json:"min_lat"`
+	MinLon float64 `json:"min_lon"`
+	MaxLat float64 `json:"max_lat"`
+	MaxLon float64 `json:"max_lon"`
+}
+
+// Session summarises one activity session
+type Session struct {
+	ID         string       `json:"id"`
+	UserID     string       `json:"user_id"`
+	Activity   string       `json:"activity,omitempty"`
+	StartTime  string       `json:"start_time,omitempty"`
+	EndTime    string       `json:"end_time,omitempty"`
+	PointCount int          `json:"point_count"`
+	DistanceM  float64      `json:"distance_m"`
+	BBox       *BoundingBox `json:"bbox,omitempty"`
+}
+
+// storeSession decodes a session lifecycle message and records it
+func storeSession(ser *events.Serializer, b Batch, value []byte) error {
+	var event SessionEvent
+	if err := ser.Unmarshal(value, &event); err != nil {
+		return err
+	}
+	ts, err := events.NormalizeTimestamp(event.Timestamp)
+	if err != nil {
+		return err
+	}
+	event.Timestamp = ts
+
+	switch event.Type {
+	case SessionStart:
+		err = b.StartSession(event)
+	case SessionEnd:
+		err = b.EndSession(event)
+	default:
+		return fmt.Errorf("unknown session event type %q", event.Type)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Stored session event: Type=%s, SessionID=%s\n", event.Type, event.SessionID)
+	return nil
+}
+
+// getSessions handles the HTTP endpoint for listing sessions
+func getSessions(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get query parameters
+		userID := r.URL.Query().Get("user_id")
+		limitNum, err := parseLimit(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		sessions, err := store.Sessions(r.Context(), userID, limitNum)
+		if err != nil {
+			log.Printf("Error querying database: %v\n", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		// Return JSON response
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sessions)
+	}
+}
+
+// getSessionPoints handles the HTTP endpoint for /sessions/{id}/points
+func getSessionPoints(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Expect /sessions/{id}/points
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/sessions/"), "/"), "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] != "points" {
+			http.NotFound(w, r)
+			return
+		}
+		sessionID := parts[0]
+
+		points, err := store.SessionPoints(r.Context(), r.URL.Query().Get("user_id"), sessionID)
+		if err != nil {
+			log.Printf("Error querying database: %v\n", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		// Return JSON response
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(points)
+	}
+}
@@ -0,0 +1,1458 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteDriver is go-sqlite3 with the functions behind the near and polygon
+// filters of GET /events registered on every connection
+const sqliteDriver = "sqlite3_geo"
+
+func init() {
+	sql.Register(sqliteDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if err := conn.RegisterFunc("haversine_m", haversine, true); err != nil {
+				return err
+			}
+			return conn.RegisterFunc("in_polygon", inPolygon, true)
+		},
+	})
+}
+
+// inPolygon backs the in_polygon(lat, lon, polygon) SQL function; polygon
+// is a JSON array of points
+func inPolygon(lat, lon float64, polygon string) (bool, error) {
+	var points []Point
+	if err := json.Unmarshal([]byte(polygon), &points); err != nil {
+		return false, err
+	}
+	return polygonContains(points, lat, lon), nil
+}
+
+// SQLiteStore keeps everything in one SQLite database. Each batch is a
+// single transaction with a savepoint per message.
+type SQLiteStore struct {
+	db        *sql.DB
+	coordStmt *sql.Stmt
+	locStmt   *sql.Stmt
+}
+
+// OpenSQLiteStore opens the database at path, creating and migrating its tables
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+	// WAL lets the HTTP API read while batches are being written
+	db, err := sql.Open(sqliteDriver, path+"?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("opening database: %w", err)
+	}
+	// Every connection to :memory: would open an empty database of its own
+	if path == ":memory:" {
+		db.SetMaxOpenConns(1)
+	}
+	s := &SQLiteStore{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Prepare insert statements
+	s.coordStmt, err = db.Prepare(`
+		INSERT OR IGNORE INTO coordinates (user_id, session_id, lat, lon, timestamp,
+			ele, segment_m, moving_s, speed_mps, ele_delta_m,
+			kafka_topic, kafka_partition, kafka_offset)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("preparing coordinates insert: %w", err)
+	}
+	s.locStmt, err = db.Prepare(`
+		INSERT OR IGNORE INTO locations (user_id, session_id, location, lat, lon, timestamp,
+			kafka_topic, kafka_partition, kafka_offset)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		s.coordStmt.Close()
+		db.Close()
+		return nil, fmt.Errorf("preparing locations insert: %w", err)
+	}
+	return s, nil
+}
+
+// migrate creates the tables and brings older databases up to date
+func (s *SQLiteStore) migrate() error {
+	db := s.db
+
+	// Create table if not exists
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS coordinates (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id TEXT NOT NULL,
+			session_id TEXT,
+			lat REAL NOT NULL,
+			lon REAL NOT NULL,
+			timestamp TEXT NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("creating coordinates table: %w", err)
+	}
+
+	// Record each row's Kafka position so redelivered messages are not stored twice
+	if err := addKafkaPosition(db, "coordinates"); err != nil {
+		return fmt.Errorf("migrating coordinates table: %w", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_coordinates_user_time ON coordinates (user_id, timestamp);
+		CREATE INDEX IF NOT EXISTS idx_coordinates_time ON coordinates (timestamp);
+		CREATE INDEX IF NOT EXISTS idx_coordinates_session ON coordinates (session_id);
+	`)
+	if err != nil {
+		return fmt.Errorf("creating coordinates indexes: %w", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS locations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id TEXT NOT NULL,
+			session_id TEXT,
+			location TEXT NOT NULL,
+			lat REAL NOT NULL,
+			lon REAL NOT NULL,
+			timestamp TEXT NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("creating locations table: %w", err)
+	}
+	if err := addKafkaPosition(db, "locations"); err != nil {
+		return fmt.Errorf("migrating locations table: %w", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS sessions (
+			id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			activity TEXT,
+			start_time TEXT,
+			end_time TEXT,
+			point_count INTEGER NOT NULL DEFAULT 0,
+			distance_m REAL NOT NULL DEFAULT 0,
+			min_lat REAL,
+			min_lon REAL,
+			max_lat REAL,
+			max_lon REAL,
+			last_lat REAL,
+			last_lon REAL,
+			PRIMARY KEY (user_id, id)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("creating sessions table: %w", err)
+	}
+
+	// Per-point segments, session totals and daily rollups behind the stats endpoints
+	if err := migrateStats(db); err != nil {
+		return fmt.Errorf("migrating statistics tables: %w", err)
+	}
+	// Session IDs are only unique per user
+	if err := migrateSessionKey(db); err != nil {
+		return fmt.Errorf("migrating sessions table: %w", err)
+	}
+	if err := migrateGeofences(db); err != nil {
+		return fmt.Errorf("creating geofence tables: %w", err)
+	}
+	if err := migrateUsers(db); err != nil {
+		return fmt.Errorf("creating user tables: %w", err)
+	}
+	return nil
+}
+
+// Close closes the prepared statements and the database
+func (s *SQLiteStore) Close() error {
+	s.coordStmt.Close()
+	s.locStmt.Close()
+	return s.db.Close()
+}
+
+// CheckWritable takes the write lock and rolls back, proving the database
+// is writable without leaving anything behind
+func (s *SQLiteStore) CheckWritable(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, "CREATE TABLE readyz_probe (id INTEGER)")
+	return err
+}
+
+// Begin starts the batch's transaction
+func (s *SQLiteStore) Begin(ctx context.Context) (Batch, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteBatch{tx: tx, coordStmt: tx.Stmt(s.coordStmt), locStmt: tx.Stmt(s.locStmt)}, nil
+}
+
+// Coordinates pages through the coordinates table with keyset pagination
+func (s *SQLiteStore) Coordinates(ctx context.Context, q CoordinateQuery) ([]CoordinateEvent, *cursor, error) {
+	// Build query
+	query := `
+		SELECT id, user_id, session_id, lat, lon, timestamp, ele
+		FROM coordinates
+		WHERE 1=1
+	`
+	args := []interface{}{}
+
+	if q.UserID != "" {
+		query += " AND user_id = ?"
+		args = append(args, q.UserID)
+	}
+	if q.SessionID != "" {
+		query += " AND session_id = ?"
+		args = append(args, q.SessionID)
+	}
+	if q.From != "" {
+		query += " AND timestamp >= ?"
+		args = append(args, q.From)
+	}
+	if q.To != "" {
+		query += " AND timestamp <= ?"
+		args = append(args, q.To)
+	}
+	if q.BBox != nil {
+		query += " AND lat BETWEEN ? AND ? AND lon BETWEEN ? AND ?"
+		args = append(args, q.BBox.MinLat, q.BBox.MaxLat, q.BBox.MinLon, q.BBox.MaxLon)
+	}
+	// SQLite has no spatial index: the enclosing box narrows the scan with
+	// the lat/lon columns before the exact test runs on each row
+	if q.Near != nil {
+		box := circleBBox(q.Near.Center, q.Near.RadiusM)
+		query += " AND lat BETWEEN ? AND ? AND lon BETWEEN ? AND ? AND haversine_m(lat, lon, ?, ?) <= ?"
+		args = append(args, box.MinLat, box.MaxLat, box.MinLon, box.MaxLon,
+			q.Near.Center.Lat, q.Near.Center.Lon, q.Near.RadiusM)
+	}
+	if q.Polygon != nil {
+		box := polygonBBox(q.Polygon)
+		polygon, err := json.Marshal(q.Polygon)
+		if err != nil {
+			return nil, nil, err
+		}
+		query += " AND lat BETWEEN ? AND ? AND lon BETWEEN ? AND ? AND in_polygon(lat, lon, ?)"
+		args = append(args, box.MinLat, box.MaxLat, box.MinLon, box.MaxLon, string(polygon))
+	}
+
+	// Keyset pagination on (timestamp, id) so pages never overlap
+	if q.After != nil {
+		if q.After.ID == 0 {
+			return nil, nil, errInvalidCursor
+		}
+		if q.Ascending {
+			query += " AND (timestamp > ? OR (timestamp = ? AND id > ?))"
+		} else {
+			query += " AND (timestamp < ? OR (timestamp = ? AND id < ?))"
+		}
+		args = append(args, q.After.Timestamp, q.After.Timestamp, q.After.ID)
+	}
+
+	if q.Ascending {
+		query += " ORDER BY timestamp ASC, id ASC LIMIT ?"
+	} else {
+		query += " ORDER BY timestamp DESC, id DESC LIMIT ?"
+	}
+	// Fetch one extra row to learn whether another page exists
+	args = append(args, q.Limit+1)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	events := []CoordinateEvent{}
+	var last cursor
+	for rows.Next() {
+		if len(events) == q.Limit {
+			return events, &last, nil
+		}
+
+		var id int64
+		var event CoordinateEvent
+		err := rows.Scan(
+			&id,
+			&event.UserID,
+			&event.SessionID,
+			&event.Lat,
+			&event.Lon,
+			&event.Timestamp,
+			&event.Ele,
+		)
+		if err != nil {
+			log.Printf("Error scanning row: %v\n", err)
+			continue
+		}
+		events = append(events, event)
+		last = cursor{Timestamp: event.Timestamp, ID: id}
+	}
+	return events, nil, rows.Err()
+}
+
+// Locations returns the latest check-ins, optionally for one user
+func (s *SQLiteStore) Locations(ctx context.Context, userID string, limit int) ([]LocationEvent, error) {
+	query := `
+		SELECT user_id, session_id, location, lat, lon, timestamp
+		FROM locations
+		WHERE 1=1
+	`
+	args := []interface{}{}
+
+	if userID != "" {
+		query += " AND user_id = ?"
+		args = append(args, userID)
+	}
+
+	query += " ORDER BY timestamp DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []LocationEvent{}
+	for rows.Next() {
+		var event LocationEvent
+		err := rows.Scan(
+			&event.UserID,
+			&event.SessionID,
+			&event.Location,
+			&event.Lat,
+			&event.Lon,
+			&event.Timestamp,
+		)
+		if err != nil {
+			log.Printf("Error scanning row: %v\n", err)
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// Sessions returns the latest sessions, optionally for one user
+func (s *SQLiteStore) Sessions(ctx context.Context, userID string, limit int) ([]Session, error) {
+	query := `
+		SELECT id, user_id, activity, start_time, end_time, point_count, distance_m,
+			min_lat, min_lon, max_lat, max_lon
+		FROM sessions
+		WHERE 1=1
+	`
+	args := []interface{}{}
+
+	if userID != "" {
+		query += " AND user_id = ?"
+		args = append(args, userID)
+	}
+
+	query += " ORDER BY start_time DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			log.Printf("Error scanning row: %v\n", err)
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// scanSession reads one sessions row as selected by Sessions
+func scanSession(rows *sql.Rows) (Session, error) {
+	var (
+		session                        Session
+		activity, startTime, endTime   sql.NullString
+		minLat, minLon, maxLat, maxLon sql.NullFloat64
+	)
+
+	err := rows.Scan(
+		&session.ID,
+		&session.UserID,
+		&activity,
+		&startTime,
+		&endTime,
+		&session.PointCount,
+		&session.DistanceM,
+		&minLat,
+		&minLon,
+		&maxLat,
+		&maxLon,
+	)
+	if err != nil {
+		return session, err
+	}
+
+	session.Activity = activity.String
+	session.StartTime = startTime.String
+	session.EndTime = endTime.String
+	if minLat.Valid && minLon.Valid && maxLat.Valid && maxLon.Valid {
+		session.BBox = &BoundingBox{
+			MinLat: minLat.Float64,
+			MinLon: minLon.Float64,
+			MaxLat: maxLat.Float64,
+			MaxLon: maxLon.Float64,
+		}
+	}
+	return session, nil
+}
+
+// SessionPoints returns a session's fixes in time order
+func (s *SQLiteStore) SessionPoints(ctx context.Context, userID, sessionID string) ([]CoordinateEvent, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT user_id, session_id, lat, lon, timestamp, ele
+		FROM coordinates
+		WHERE user_id = ? AND session_id = ?
+		ORDER BY timestamp ASC, id ASC
+	`, userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return scanCoordinates(rows)
+}
+
+// Track returns a user's fixes in time order, optionally within a time range
+func (s *SQLiteStore) Track(ctx context.Context, userID, from, to string) ([]CoordinateEvent, error) {
+	query := `
+		SELECT user_id, session_id, lat, lon, timestamp, ele
+		FROM coordinates
+		WHERE user_id = ?
+	`
+	args := []interface{}{userID}
+
+	if from != "" {
+		query += " AND timestamp >= ?"
+		args = append(args, from)
+	}
+	if to != "" {
+		query += " AND timestamp <= ?"
+		args = append(args, to)
+	}
+	query += " ORDER BY timestamp ASC, id ASC"
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanCoordinates(rows)
+}
+
+// scanCoordinates reads and closes rows selecting user_id, session_id, lat, lon, timestamp, ele
+func scanCoordinates(rows *sql.Rows) ([]CoordinateEvent, error) {
+	defer rows.Close()
+
+	points := []CoordinateEvent{}
+	for rows.Next() {
+		var event CoordinateEvent
+		err := rows.Scan(
+			&event.UserID,
+			&event.SessionID,
+			&event.Lat,
+			&event.Lon,
+			&event.Timestamp,
+			&event.Ele,
+		)
+		if err != nil {
+			log.Printf("Error scanning row: %v\n", err)
+			continue
+		}
+		points = append(points, event)
+	}
+	return points, rows.Err()
+}
+
+// SessionTotals reads a session's running totals
+func (s *SQLiteStore) SessionTotals(ctx context.Context, userID, sessionID string) (sessionTotals, error) {
+	var (
+		t                                     sessionTotals
+		activity, startTime, endTime, lastFix sql.NullString
+		row                                   = &t.Totals
+	)
+	err := s.db.QueryRowContext(ctx, `
+		SELECT user_id, activity, start_time, end_time, last_time,
+			point_count, distance_m, moving_s, max_speed_mps,
+			ele_gain_m, ele_loss_m, min_ele, max_ele,
+			min_lat, min_lon, max_lat, max_lon
+		FROM sessions
+		WHERE user_id = ? AND id = ?
+	`, userID, sessionID).Scan(
+		&t.UserID, &activity, &startTime, &endTime, &lastFix,
+		&row.points, &row.distance, &row.moving, &row.maxSpeed,
+		&row.gain, &row.loss, &row.minEle, &row.maxEle,
+		&row.minLat, &row.minLon, &row.maxLat, &row.maxLon,
+	)
+	if err == sql.ErrNoRows {
+		return t, errNotFound
+	}
+	if err != nil {
+		return t, err
+	}
+
+	t.Activity = activity.String
+	t.StartTime = startTime.String
+	t.EndTime = endTime.String
+	t.LastTime = lastFix.String
+	return t, nil
+}
+
+// DailyStats sums a user's rollups for days in [fromDay, toDay); empty bounds are open
+func (s *SQLiteStore) DailyStats(ctx context.Context, userID, fromDay, toDay string) (statsRow, error) {
+	query := `
+		SELECT SUM(point_count), SUM(distance_m), SUM(moving_s), MAX(max_speed_mps),
+			SUM(ele_gain_m), SUM(ele_loss_m), MIN(min_ele), MAX(max_ele),
+			MIN(min_lat), MIN(min_lon), MAX(max_lat), MAX(max_lon)
+		FROM user_daily_stats
+		WHERE user_id = ?
+	`
+	args := []interface{}{userID}
+	if fromDay != "" {
+		query += " AND day >= ?"
+		args = append(args, fromDay)
+	}
+	if toDay != "" {
+		query += " AND day < ?"
+		args = append(args, toDay)
+	}
+	return scanStats(s.db.QueryRowContext(ctx, query, args...))
+}
+
+// RawStats sums a user's coordinates with from <= timestamp < to (or <= to
+// when toInclusive), for the partial days at the edges of a range
+func (s *SQLiteStore) RawStats(ctx context.Context, userID, from, to string, toInclusive bool) (statsRow, error) {
+	query := `
+		SELECT COUNT(*), SUM(segment_m), SUM(moving_s), MAX(speed_mps),
+			SUM(MAX(ele_delta_m, 0)), -SUM(MIN(ele_delta_m, 0)), MIN(ele), MAX(ele),
+			MIN(lat), MIN(lon), MAX(lat), MAX(lon)
+		FROM coordinates
+		WHERE user_id = ? AND timestamp >= ?
+	`
+	if toInclusive {
+		query += " AND timestamp <= ?"
+	} else {
+		query += " AND timestamp < ?"
+	}
+	return scanStats(s.db.QueryRowContext(ctx, query, userID, from, to))
+}
+
+// scanStats reads an aggregate row selected in statsRow field order
+func scanStats(row *sql.Row) (statsRow, error) {
+	var s statsRow
+	err := row.Scan(&s.points, &s.distance, &s.moving, &s.maxSpeed,
+		&s.gain, &s.loss, &s.minEle, &s.maxEle,
+		&s.minLat, &s.minLon, &s.maxLat, &s.maxLon)
+	return s, err
+}
+
+// GeofenceEvents returns the latest enter/exit events matching q
+func (s *SQLiteStore) GeofenceEvents(ctx context.Context, q GeofenceEventQuery) ([]GeofenceEvent, error) {
+	query := `
+		SELECT type, geofence_id, geofence_name, user_id, session_id, lat, lon, timestamp
+		FROM geofence_events
+		WHERE 1=1
+	`
+	args := []interface{}{}
+
+	if q.UserID != "" {
+		query += " AND user_id = ?"
+		args = append(args, q.UserID)
+	}
+	if q.GeofenceID != 0 {
+		query += " AND geofence_id = ?"
+		args = append(args, q.GeofenceID)
+	}
+	if q.From != "" {
+		query += " AND timestamp >= ?"
+		args = append(args, q.From)
+	}
+	if q.To != "" {
+		query += " AND timestamp <= ?"
+		args = append(args, q.To)
+	}
+
+	query += " ORDER BY timestamp DESC, id DESC LIMIT ?"
+	args = append(args, q.Limit)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []GeofenceEvent{}
+	for rows.Next() {
+		var event GeofenceEvent
+		var sessionID sql.NullString
+		err := rows.Scan(
+			&event.Type,
+			&event.GeofenceID,
+			&event.GeofenceName,
+			&event.UserID,
+			&sessionID,
+			&event.Lat,
+			&event.Lon,
+			&event.Timestamp,
+		)
+		if err != nil {
+			log.Printf("Error scanning row: %v\n", err)
+			continue
+		}
+		event.SessionID = sessionID.String
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// Geofences loads every stored fence
+func (s *SQLiteStore) Geofences(ctx context.Context) ([]*Geofence, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, name, type, center_lat, center_lon, radius_m, polygon, created_at
+		FROM geofences
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fences := []*Geofence{}
+	for rows.Next() {
+		var (
+			fence                        Geofence
+			centerLat, centerLon, radius sql.NullFloat64
+			polygon                      sql.NullString
+		)
+		err := rows.Scan(&fence.ID, &fence.Name, &fence.Type, &centerLat, &centerLon, &radius, &polygon, &fence.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		if centerLat.Valid && centerLon.Valid {
+			fence.Center = &Point{Lat: centerLat.Float64, Lon: centerLon.Float64}
+		}
+		fence.RadiusM = radius.Float64
+		if polygon.Valid {
+			if err := json.Unmarshal([]byte(polygon.String), &fence.Polygon); err != nil {
+				return nil, fmt.Errorf("geofence %d: invalid polygon: %w", fence.ID, err)
+			}
+		}
+		fences = append(fences, &fence)
+	}
+	return fences, rows.Err()
+}
+
+// geofenceColumns returns the shape columns of a fence, NULL where they do not apply
+func geofenceColumns(fence Geofence) (centerLat, centerLon, radius, polygon interface{}, err error) {
+	if fence.Type == GeofencePolygon {
+		data, err := json.Marshal(fence.Polygon)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		polygon = string(data)
+	}
+	if fence.Type == GeofenceCircle {
+		centerLat, centerLon, radius = fence.Center.Lat, fence.Center.Lon, fence.RadiusM
+	}
+	return centerLat, centerLon, radius, polygon, nil
+}
+
+// InsertGeofence stores a new fence and returns its ID
+func (s *SQLiteStore) InsertGeofence(ctx context.Context, fence Geofence) (int64, error) {
+	centerLat, centerLon, radius, polygon, err := geofenceColumns(fence)
+	if err != nil {
+		return 0, err
+	}
+	res, err := s.db.ExecContext(ctx, `
+		INSERT INTO geofences (name, type, center_lat, center_lon, radius_m, polygon, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, fence.Name, fence.Type, centerLat, centerLon, radius, polygon, fence.CreatedAt)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// UpdateGeofence replaces the name and shape of a stored fence
+func (s *SQLiteStore) UpdateGeofence(ctx context.Context, fence Geofence) error {
+	centerLat, centerLon, radius, polygon, err := geofenceColumns(fence)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE geofences
+		SET name = ?, type = ?, center_lat = ?, center_lon = ?, radius_m = ?, polygon = ?
+		WHERE id = ?
+	`, fence.Name, fence.Type, centerLat, centerLon, radius, polygon, fence.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// DeleteGeofence removes a fence and which users were inside it in one transaction
+func (s *SQLiteStore) DeleteGeofence(ctx context.Context, id int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("DELETE FROM geofences WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	if _, err := tx.Exec("DELETE FROM geofence_state WHERE geofence_id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// InsertUser stores a new account
+func (s *SQLiteStore) InsertUser(ctx context.Context, user User) error {
+	prefs, err := preferencesColumn(user.Preferences)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO users (username, user_id, email, password_hash, role, full_name, bio, profile_pic, preferences, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, user.Username, user.UserID, user.Email, user.PasswordHash, user.Role, user.FullName, user.Bio, user.ProfilePic, prefs, user.CreatedAt)
+	if isConstraintError(err) {
+		return errUserExists
+	}
+	return err
+}
+
+// User reads an account and its saved locations
+func (s *SQLiteStore) User(ctx context.Context, username string) (User, error) {
+	var user User
+	var prefs, updatedAt, lastLogin sql.NullString
+	err := s.db.QueryRowContext(ctx, `
+		SELECT username, user_id, email, password_hash, role, full_name, bio, profile_pic, preferences,
+			created_at, updated_at, last_login
+		FROM users
+		WHERE username = ?
+	`, username).Scan(
+		&user.Username, &user.UserID, &user.Email, &user.PasswordHash, &user.Role, &user.FullName, &user.Bio, &user.ProfilePic, &prefs,
+		&user.CreatedAt, &updatedAt, &lastLogin,
+	)
+	if err == sql.ErrNoRows {
+		return user, errNotFound
+	}
+	if err != nil {
+		return user, err
+	}
+	user.UpdatedAt, user.LastLogin = updatedAt.String, lastLogin.String
+	if prefs.Valid {
+		if err := json.Unmarshal([]byte(prefs.String), &user.Preferences); err != nil {
+			return user, fmt.Errorf("user %s: preferences: %w", username, err)
+		}
+	}
+
+	rows, err := s.db.QueryContext(ctx, "SELECT location_id FROM saved_locations WHERE username = ? ORDER BY rowid", username)
+	if err != nil {
+		return user, err
+	}
+	defer rows.Close()
+
+	user.SavedLocations = []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return user, err
+		}
+		user.SavedLocations = append(user.SavedLocations, id)
+	}
+	return user, rows.Err()
+}
+
+// UpdateUser replaces an account's profile and password hash
+func (s *SQLiteStore) UpdateUser(ctx context.Context, user User) error {
+	prefs, err := preferencesColumn(user.Preferences)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE users
+		SET email = ?, password_hash = ?, full_name = ?, bio = ?, profile_pic = ?, preferences = ?, updated_at = ?
+		WHERE username = ?
+	`, user.Email, user.PasswordHash, user.FullName, user.Bio, user.ProfilePic, prefs, user.UpdatedAt, user.Username)
+	if isConstraintError(err) {
+		return errUserExists
+	}
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// SetLastLogin records when a user last logged in
+func (s *SQLiteStore) SetLastLogin(ctx context.Context, username, at string) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE users SET last_login = ? WHERE username = ?", at, username)
+	return err
+}
+
+// SetRole changes a user's role
+func (s *SQLiteStore) SetRole(ctx context.Context, username, role string) error {
+	res, err := s.db.ExecContext(ctx, "UPDATE users SET role = ? WHERE username = ?", role, username)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// BindUser sets the user_id an account owns
+func (s *SQLiteStore) BindUser(ctx context.Context, username, userID string) error {
+	res, err := s.db.ExecContext(ctx, "UPDATE users SET user_id = ? WHERE username = ?", userID, username)
+	if isConstraintError(err) {
+		return errUserIDBound
+	}
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// SaveLocation adds a saved location, ignoring one already saved
+func (s *SQLiteStore) SaveLocation(ctx context.Context, username, locationID string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE username = ?)", username).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		return false, errNotFound
+	}
+
+	res, err := s.db.ExecContext(ctx, `
+		INSERT OR IGNORE INTO saved_locations (username, location_id, saved_at)
+		VALUES (?, ?, ?)
+	`, username, locationID, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// RemoveLocation deletes a saved location
+func (s *SQLiteStore) RemoveLocation(ctx context.Context, username, locationID string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM saved_locations WHERE username = ? AND location_id = ?", username, locationID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// preferencesColumn encodes a user's preferences as JSON, or NULL when unset
+func preferencesColumn(prefs map[string]interface{}) (sql.NullString, error) {
+	if prefs == nil {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(prefs)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+// isConstraintError reports whether err is a UNIQUE or PRIMARY KEY violation
+func isConstraintError(err error) bool {
+	var serr sqlite3.Error
+	return errors.As(err, &serr) && serr.Code == sqlite3.ErrConstraint
+}
+
+// sqliteBatch writes one batch inside a transaction
+type sqliteBatch struct {
+	tx        *sql.Tx
+	coordStmt *sql.Stmt
+	locStmt   *sql.Stmt
+}
+
+// A savepoint per message lets one bad message fail without discarding the
+// rest of the batch
+func (b *sqliteBatch) Savepoint() error {
+	_, err := b.tx.Exec("SAVEPOINT msg")
+	return err
+}
+
+func (b *sqliteBatch) RollbackTo() error {
+	_, err := b.tx.Exec("ROLLBACK TO msg")
+	return err
+}
+
+func (b *sqliteBatch) Release() error {
+	_, err := b.tx.Exec("RELEASE msg")
+	return err
+}
+
+func (b *sqliteBatch) Commit() error   { return b.tx.Commit() }
+func (b *sqliteBatch) Rollback() error { return b.tx.Rollback() }
+
+// InsertCoordinate inserts a fix, ignoring it if its Kafka position is already stored
+func (b *sqliteBatch) InsertCoordinate(event CoordinateEvent, seg segment, pos kafkaPosition) (bool, error) {
+	res, err := b.coordStmt.Exec(
+		event.UserID,
+		event.SessionID,
+		event.Lat,
+		event.Lon,
+		event.Timestamp,
+		event.Ele,
+		seg.DistanceM,
+		seg.MovingS,
+		seg.SpeedMps,
+		seg.EleDeltaM,
+		pos.Topic,
+		pos.Partition,
+		pos.Offset,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// LastFix reads the position a session was last seen at
+func (b *sqliteBatch) LastFix(userID, sessionID string) (fix, bool, error) {
+	var lat, lon sql.NullFloat64
+	var ts sql.NullString
+	var ele sql.NullFloat64
+	err := b.tx.QueryRow(
+		"SELECT last_lat, last_lon, last_time, last_ele FROM sessions WHERE user_id = ? AND id = ?", userID, sessionID,
+	).Scan(&lat, &lon, &ts, &ele)
+	if err == sql.ErrNoRows {
+		return fix{}, false, nil
+	}
+	if err != nil {
+		return fix{}, false, err
+	}
+	if !lat.Valid || !lon.Valid {
+		return fix{}, false, nil
+	}
+	return fix{Lat: lat.Float64, Lon: lon.Float64, Timestamp: ts.String, Ele: ele}, true, nil
+}
+
+// UpdateSession upserts the session row with the fix added to its totals.
+// The fix is stored in the same transaction, so a redelivered message is
+// skipped by InsertCoordinate before it gets here and pos is not needed.
+func (b *sqliteBatch) UpdateSession(event CoordinateEvent, seg segment, pos kafkaPosition) error {
+	f := fixOf(event)
+	_, err := b.tx.Exec(`
+		INSERT INTO sessions (id, user_id, start_time, point_count, distance_m,
+			min_lat, min_lon, max_lat, max_lon, last_lat, last_lon, last_time, last_ele,
+			moving_s, max_speed_mps, ele_gain_m, ele_loss_m, min_ele, max_ele)
+		VALUES (?, ?, ?, 1, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(user_id, id) DO UPDATE SET
+			start_time = COALESCE(start_time, excluded.start_time),
+			point_count = point_count + 1,
+			distance_m = distance_m + excluded.distance_m,
+			min_lat = MIN(COALESCE(min_lat, excluded.min_lat), excluded.min_lat),
+			min_lon = MIN(COALESCE(min_lon, excluded.min_lon), excluded.min_lon),
+			max_lat = MAX(COALESCE(max_lat, excluded.max_lat), excluded.max_lat),
+			max_lon = MAX(COALESCE(max_lon, excluded.max_lon), excluded.max_lon),
+			last_lat = excluded.last_lat,
+			last_lon = excluded.last_lon,
+			last_time = excluded.last_time,
+			last_ele = excluded.last_ele,
+			moving_s = moving_s + excluded.moving_s,
+			max_speed_mps = MAX(max_speed_mps, excluded.max_speed_mps),
+			ele_gain_m = ele_gain_m + excluded.ele_gain_m,
+			ele_loss_m = ele_loss_m + excluded.ele_loss_m,
+			min_ele = MIN(COALESCE(min_ele, excluded.min_ele), COALESCE(excluded.min_ele, min_ele)),
+			max_ele = MAX(COALESCE(max_ele, excluded.max_ele), COALESCE(excluded.max_ele, max_ele))
+	`,
+		event.SessionID, event.UserID, event.Timestamp, seg.DistanceM,
+		event.Lat, event.Lon, event.Lat, event.Lon,
+		event.Lat, event.Lon, event.Timestamp, f.Ele,
+		seg.MovingS, seg.SpeedMps, seg.gain(), seg.loss(), f.Ele, f.Ele,
+	)
+	return err
+}
+
+// UpdateDailyStats upserts the user's rollup row for the day of the fix;
+// like UpdateSession it relies on the transaction rather than pos
+func (b *sqliteBatch) UpdateDailyStats(event CoordinateEvent, seg segment, pos kafkaPosition) error {
+	f := fixOf(event)
+	_, err := b.tx.Exec(`
+		INSERT INTO user_daily_stats (user_id, day, point_count, distance_m, moving_s, max_speed_mps,
+			ele_gain_m, ele_loss_m, min_ele, max_ele, min_lat, min_lon, max_lat, max_lon)
+		VALUES (?, substr(?, 1, 10), 1, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(user_id, day) DO UPDATE SET
+			point_count = point_count + 1,
+			distance_m = distance_m + excluded.distance_m,
+			moving_s = moving_s + excluded.moving_s,
+			max_speed_mps = MAX(max_speed_mps, excluded.max_speed_mps),
+			ele_gain_m = ele_gain_m + excluded.ele_gain_m,
+			ele_loss_m = ele_loss_m + excluded.ele_loss_m,
+			min_ele = MIN(COALESCE(min_ele, excluded.min_ele), COALESCE(excluded.min_ele, min_ele)),
+			max_ele = MAX(COALESCE(max_ele, excluded.max_ele), COALESCE(excluded.max_ele, max_ele)),
+			min_lat = MIN(min_lat, excluded.min_lat),
+			min_lon = MIN(min_lon, excluded.min_lon),
+			max_lat = MAX(max_lat, excluded.max_lat),
+			max_lon = MAX(max_lon, excluded.max_lon)
+	`,
+		event.UserID, event.Timestamp,
+		seg.DistanceM, seg.MovingS, seg.SpeedMps, seg.gain(), seg.loss(),
+		f.Ele, f.Ele, event.Lat, event.Lon, event.Lat, event.Lon,
+	)
+	return err
+}
+
+// InsertLocation inserts a check-in, ignoring it if its Kafka position is already stored
+func (b *sqliteBatch) InsertLocation(event LocationEvent, pos kafkaPosition) (bool, error) {
+	res, err := b.locStmt.Exec(
+		event.UserID,
+		event.SessionID,
+		event.Location,
+		event.Lat,
+		event.Lon,
+		event.Timestamp,
+		pos.Topic,
+		pos.Partition,
+		pos.Offset,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// StartSession records a session's activity and start time
+func (b *sqliteBatch) StartSession(event SessionEvent) error {
+	_, err := b.tx.Exec(`
+		INSERT INTO sessions (id, user_id, activity, start_time)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(user_id, id) DO UPDATE SET
+			activity = excluded.activity,
+			start_time = excluded.start_time
+	`, event.SessionID, event.UserID, event.Activity, event.Timestamp)
+	return err
+}
+
+// EndSession records a session's end time
+func (b *sqliteBatch) EndSession(event SessionEvent) error {
+	_, err := b.tx.Exec(`
+		INSERT INTO sessions (id, user_id, activity, end_time)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(user_id, id) DO UPDATE SET
+			end_time = excluded.end_time
+	`, event.SessionID, event.UserID, event.Activity, event.Timestamp)
+	return err
+}
+
+// InsideGeofences reads the fences a user is currently inside
+func (b *sqliteBatch) InsideGeofences(userID string) (map[int64]bool, error) {
+	inside := map[int64]bool{}
+	rows, err := b.tx.Query("SELECT geofence_id FROM geofence_state WHERE user_id = ? AND inside = 1", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		inside[id] = true
+	}
+	return inside, rows.Err()
+}
+
+// SetGeofenceState records whether a user is inside a fence and since when
+func (b *sqliteBatch) SetGeofenceState(userID string, geofenceID int64, inside bool, since string) error {
+	_, err := b.tx.Exec(`
+		INSERT INTO geofence_state (user_id, geofence_id, inside, since)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(user_id, geofence_id) DO UPDATE SET
+			inside = excluded.inside,
+			since = excluded.since
+	`, userID, geofenceID, inside, since)
+	return err
+}
+
+// InsertGeofenceEvent stores an enter or exit event
+func (b *sqliteBatch) InsertGeofenceEvent(ge GeofenceEvent) error {
+	_, err := b.tx.Exec(`
+		INSERT INTO geofence_events (type, geofence_id, geofence_name, user_id, session_id, lat, lon, timestamp)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, ge.Type, ge.GeofenceID, ge.GeofenceName, ge.UserID, ge.SessionID, ge.Lat, ge.Lon, ge.Timestamp)
+	return err
+}
+
+// column is a column added to an existing table by addColumns
+type column struct{ name, decl string }
+
+// addColumns adds any of columns missing from table, reporting whether it added one
+func addColumns(db *sql.DB, table string, columns []column) (bool, error) {
+	existing := map[string]bool{}
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return false, err
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return false, err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+
+	added := false
+	for _, col := range columns {
+		if existing[col.name] {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, col.name, col.decl)); err != nil {
+			return added, err
+		}
+		added = true
+	}
+	return added, nil
+}
+
+// addKafkaPosition adds the columns recording each row's Kafka topic,
+// partition and offset to table, with a unique index over them
+func addKafkaPosition(db *sql.DB, table string) error {
+	_, err := addColumns(db, table, []column{
+		{"kafka_topic", "TEXT"},
+		{"kafka_partition", "INTEGER"},
+		{"kafka_offset", "INTEGER"},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf(
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_%s_kafka_position ON %s (kafka_topic, kafka_partition, kafka_offset)",
+		table, table,
+	))
+	return err
+}
+
+// migrateStats adds the columns and rollup table behind the stats endpoints.
+// Rows stored before statistics were tracked are backfilled once.
+func migrateStats(db *sql.DB) error {
+	added, err := addColumns(db, "coordinates", []column{
+		{"ele", "REAL"},
+		{"segment_m", "REAL NOT NULL DEFAULT 0"},
+		{"moving_s", "REAL NOT NULL DEFAULT 0"},
+		{"speed_mps", "REAL NOT NULL DEFAULT 0"},
+		{"ele_delta_m", "REAL"},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = addColumns(db, "sessions", []column{
+		{"last_time", "TEXT"},
+		{"last_ele", "REAL"},
+		{"moving_s", "REAL NOT NULL DEFAULT 0"},
+		{"max_speed_mps", "REAL NOT NULL DEFAULT 0"},
+		{"ele_gain_m", "REAL NOT NULL DEFAULT 0"},
+		{"ele_loss_m", "REAL NOT NULL DEFAULT 0"},
+		{"min_ele", "REAL"},
+		{"max_ele", "REAL"},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS user_daily_stats (
+			user_id TEXT NOT NULL,
+			day TEXT NOT NULL,
+			point_count INTEGER NOT NULL DEFAULT 0,
+			distance_m REAL NOT NULL DEFAULT 0,
+			moving_s REAL NOT NULL DEFAULT 0,
+			max_speed_mps REAL NOT NULL DEFAULT 0,
+			ele_gain_m REAL NOT NULL DEFAULT 0,
+			ele_loss_m REAL NOT NULL DEFAULT 0,
+			min_ele REAL,
+			max_ele REAL,
+			min_lat REAL,
+			min_lon REAL,
+			max_lat REAL,
+			max_lon REAL,
+			PRIMARY KEY (user_id, day)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	if added {
+		return backfillStats(db)
+	}
+	return nil
+}
+
+// backfillStats computes segments for existing coordinates, then rebuilds
+// session totals and daily rollups from them
+func backfillStats(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT id, user_id, session_id, lat, lon, timestamp
+		FROM coordinates
+		WHERE session_id IS NOT NULL AND session_id != ''
+		ORDER BY user_id, session_id, timestamp, id
+	`)
+	if err != nil {
+		return err
+	}
+
+	type update struct {
+		id  int64
+		seg segment
+	}
+	updates := []update{}
+	var prevUser, prevSession string
+	var prev fix
+	for rows.Next() {
+		var id int64
+		var userID, sessionID string
+		var f fix
+		if err := rows.Scan(&id, &userID, &sessionID, &f.Lat, &f.Lon, &f.Timestamp); err != nil {
+			rows.Close()
+			return err
+		}
+		// Older data reused session IDs across users, so a track is a (user, session) pair
+		if userID == prevUser && sessionID == prevSession {
+			updates = append(updates, update{id: id, seg: measureSegment(prev, f)})
+		}
+		prevUser, prevSession, prev = userID, sessionID, f
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, u := range updates {
+		_, err := tx.Exec(
+			"UPDATE coordinates SET segment_m = ?, moving_s = ?, speed_mps = ? WHERE id = ?",
+			u.seg.DistanceM, u.seg.MovingS, u.seg.SpeedMps, u.id,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE sessions SET
+			moving_s = (SELECT COALESCE(SUM(moving_s), 0) FROM coordinates c
+				WHERE c.user_id = sessions.user_id AND c.session_id = sessions.id),
+			max_speed_mps = (SELECT COALESCE(MAX(speed_mps), 0) FROM coordinates c
+				WHERE c.user_id = sessions.user_id AND c.session_id = sessions.id),
+			last_time = (SELECT MAX(timestamp) FROM coordinates c
+				WHERE c.user_id = sessions.user_id AND c.session_id = sessions.id)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT OR REPLACE INTO user_daily_stats (user_id, day, point_count, distance_m, moving_s,
+			max_speed_mps, min_lat, min_lon, max_lat, max_lon)
+		SELECT user_id, substr(timestamp, 1, 10), COUNT(*), SUM(segment_m), SUM(moving_s),
+			MAX(speed_mps), MIN(lat), MIN(lon), MAX(lat), MAX(lon)
+		FROM coordinates
+		GROUP BY user_id, substr(timestamp, 1, 10)
+	`)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Backfilled activity statistics for %d segments\n", len(updates))
+	return tx.Commit()
+}
+
+// migrateSessionKey rebuilds a sessions table keyed by id alone into one
+// keyed by (user_id, id). Sessions two users already shared stay merged.
+func migrateSessionKey(db *sql.DB) error {
+	var keyed int
+	err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('sessions') WHERE name = 'user_id' AND pk > 0").Scan(&keyed)
+	if err != nil || keyed > 0 {
+		return err
+	}
+
+	const columns = `id, user_id, activity, start_time, end_time, point_count, distance_m,
+		min_lat, min_lon, max_lat, max_lon, last_lat, last_lon, last_time, last_ele,
+		moving_s, max_speed_mps, ele_gain_m, ele_loss_m, min_ele, max_ele`
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		CREATE TABLE sessions_keyed (
+			id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			activity TEXT,
+			start_time TEXT,
+			end_time TEXT,
+			point_count INTEGER NOT NULL DEFAULT 0,
+			distance_m REAL NOT NULL DEFAULT 0,
+			min_lat REAL,
+			min_lon REAL,
+			max_lat REAL,
+			max_lon REAL,
+			last_lat REAL,
+			last_lon REAL,
+			last_time TEXT,
+			last_ele REAL,
+			moving_s REAL NOT NULL DEFAULT 0,
+			max_speed_mps REAL NOT NULL DEFAULT 0,
+			ele_gain_m REAL NOT NULL DEFAULT 0,
+			ele_loss_m REAL NOT NULL DEFAULT 0,
+			min_ele REAL,
+			max_ele REAL,
+			PRIMARY KEY (user_id, id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO sessions_keyed (" + columns + ") SELECT " + columns + " FROM sessions"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DROP TABLE sessions"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("ALTER TABLE sessions_keyed RENAME TO sessions"); err != nil {
+		return err
+	}
+
+	log.Printf("Rekeyed the sessions table by user and session ID\n")
+	return tx.Commit()
+}
+
+// migrateGeofences creates the geofence tables
+func migrateGeofences(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS geofences (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			type TEXT NOT NULL,
+			center_lat REAL,
+			center_lon REAL,
+			radius_m REAL,
+			polygon TEXT,
+			created_at TEXT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS geofence_state (
+			user_id TEXT NOT NULL,
+			geofence_id INTEGER NOT NULL,
+			inside INTEGER NOT NULL,
+			since TEXT NOT NULL,
+			PRIMARY KEY (user_id, geofence_id)
+		);
+		CREATE TABLE IF NOT EXISTS geofence_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			type TEXT NOT NULL,
+			geofence_id INTEGER NOT NULL,
+			geofence_name TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			session_id TEXT,
+			lat REAL NOT NULL,
+			lon REAL NOT NULL,
+			timestamp TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_geofence_events_user_time ON geofence_events (user_id, timestamp);
+		CREATE INDEX IF NOT EXISTS idx_geofence_events_fence_time ON geofence_events (geofence_id, timestamp);
+	`)
+	return err
+}
+
+// migrateUsers creates the account tables
+func migrateUsers(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS users (
+			username TEXT PRIMARY KEY,
+			email TEXT NOT NULL UNIQUE,
+			password_hash TEXT NOT NULL,
+			full_name TEXT NOT NULL DEFAULT '',
+			bio TEXT NOT NULL DEFAULT '',
+			profile_pic TEXT NOT NULL DEFAULT '',
+			preferences TEXT,
+			created_at TEXT NOT NULL,
+			updated_at TEXT,
+			last_login TEXT
+		);
+		CREATE TABLE IF NOT EXISTS saved_locations (
+			username TEXT NOT NULL,
+			location_id TEXT NOT NULL,
+			saved_at TEXT NOT NULL,
+			PRIMARY KEY (username, location_id)
+		);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Roles are granted by an operator with "consumer set-role"
+	_, err = addColumns(db, "users", []column{
+		{"role", "TEXT NOT NULL DEFAULT 'user'"},
+		{"user_id", "TEXT"},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Accounts registered before they were bound owned their username's data
+	_, err = db.Exec(`
+		UPDATE users SET user_id = username WHERE user_id IS NULL;
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_users_user_id ON users (user_id);
+	`)
+	return err
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSQLiteMigrateIdempotent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gps.db")
+
+	// A database as the first release created it
+	db, err := sql.Open(sqliteDriver, path)
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	_, err = db.Exec(`
+		CREATE TABLE coordinates (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id TEXT NOT NULL,
+			session_id TEXT,
+			lat REAL NOT NULL,
+			lon REAL NOT NULL,
+			timestamp TEXT NOT NULL
+		);
+		INSERT INTO coordinates (user_id, session_id, lat, lon, timestamp)
+		VALUES ('u1', 's1', 51.5, -0.1, '2026-10-16T10:00:00Z');
+		CREATE TABLE sessions (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			activity TEXT,
+			start_time TEXT,
+			end_time TEXT,
+			point_count INTEGER NOT NULL DEFAULT 0,
+			distance_m REAL NOT NULL DEFAULT 0,
+			min_lat REAL,
+			min_lon REAL,
+			max_lat REAL,
+			max_lon REAL,
+			last_lat REAL,
+			last_lon REAL
+		);
+		INSERT INTO sessions (id, user_id, activity, start_time, point_count, last_lat, last_lon)
+		VALUES ('s1', 'u1', 'running', '2026-10-16T10:00:00Z', 1, 51.5, -0.1);
+	`)
+	db.Close()
+	if err != nil {
+		t.Fatalf("creating the original schema: %v", err)
+	}
+
+	for _, run := range []string{"first open", "second open", "third open"} {
+		t.Run(run, func(t *testing.T) {
+			store, err := OpenSQLiteStore(path)
+			if err != nil {
+				t.Fatalf("OpenSQLiteStore: %v", err)
+			}
+			defer store.Close()
+			ctx := context.Background()
+
+			got, _, err := store.Coordinates(ctx, CoordinateQuery{Limit: 10})
+			if err != nil {
+				t.Fatalf("Coordinates: %v", err)
+			}
+			if want := []string{normalized("2026-10-16T10:00:00Z")}; !reflect.DeepEqual(timestamps(got), want) {
+				t.Errorf("coordinates %v, want %v", timestamps(got), want)
+			}
+
+			// Sessions are now keyed by user as well as session ID
+			totals, err := store.SessionTotals(ctx, "u1", "s1")
+			if err != nil || totals.Activity != "running" || totals.Totals.points.Int64 != 1 {
+				t.Errorf("SessionTotals = %+v, %v; want u1's running session with 1 point", totals, err)
+			}
+			if _, err := store.SessionTotals(ctx, "u2", "s1"); err != errNotFound {
+				t.Errorf("SessionTotals of another user: error = %v, want errNotFound", err)
+			}
+
+			// Every table a later release added is usable
+			if _, err := store.Sessions(ctx, "", 10); err != nil {
+				t.Errorf("Sessions: %v", err)
+			}
+			if _, err := store.Geofences(ctx); err != nil {
+				t.Errorf("Geofences: %v", err)
+			}
+			if _, err := store.User(ctx, "nobody"); err != errNotFound {
+				t.Errorf("User error = %v, want errNotFound", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// Segments slower than this are treated as standing still
+	movingSpeedMps = 0.5
+
+	// Gaps longer than this between fixes are pauses, even if the position moved
+	maxMovingGap = 5 * time.Minute
+)
+
+// segment is the movement from the previous fix of a session to the current one.
+// It is stored with the coordinate so any time range can be summed by the store.
+type segment struct {
+	DistanceM float64
+	MovingS   float64         // seconds spent moving, 0 if the user was stopped
+	SpeedMps  float64         // speed over the segment while moving, otherwise 0
+	EleDeltaM sql.NullFloat64 // change in elevation, if both fixes have one
+}
+
+// gain and loss split the elevation change into its climbing and descending parts
+func (s segment) gain() float64 {
+	if s.EleDeltaM.Valid && s.EleDeltaM.Float64 > 0 {
+		return s.EleDeltaM.Float64
+	}
+	return 0
+}
+
+func (s segment) loss() float64 {
+	if s.EleDeltaM.Valid && s.EleDeltaM.Float64 < 0 {
+		return -s.EleDeltaM.Float64
+	}
+	return 0
+}
+
+// fix is a stored position used as the start of the next segment
+type fix struct {
+	Lat, Lon  float64
+	Timestamp string
+	Ele       sql.NullFloat64
+}
+
+// measureSegment computes the segment between two consecutive fixes
+func measureSegment(prev fix, next fix) segment {
+	seg := segment{DistanceM: haversine(prev.Lat, prev.Lon, next.Lat, next.Lon)}
+	if prev.Ele.Valid && next.Ele.Valid {
+		seg.EleDeltaM = sql.NullFloat64{Float64: next.Ele.Float64 - prev.Ele.Float64, Valid: true}
+	}
+
+	t0, err0 := time.Parse(time.RFC3339, prev.Timestamp)
+	t1, err1 := time.Parse(time.RFC3339, next.Timestamp)
+	if err0 != nil || err1 != nil {
+		return seg
+	}
+	dt := t1.Sub(t0)
+	if dt <= 0 || dt > maxMovingGap {
+		return seg
+	}
+	if speed := seg.DistanceM / dt.Seconds(); speed >= movingSpeedMps {
+		seg.MovingS = dt.Seconds()
+		seg.SpeedMps = speed
+	}
+	return seg
+}
+
+// sessionSegment measures an incoming coordinate against the last fix stored
+// for its session. Points outside a session, and the first point of one,
+// start a new track and have an empty segment.
+func sessionSegment(b Batch, event CoordinateEvent) (segment, error) {
+	if event.SessionID == "" {
+		return segment{}, nil
+	}
+
+	prev, ok, err := b.LastFix(event.UserID, event.SessionID)
+	if err != nil || !ok {
+		return segment{}, err
+	}
+	return measureSegment(prev, fixOf(event)), nil
+}
+
+// fixOf returns the position part of an event
+func fixOf(e CoordinateEvent) fix {
+	f := fix{Lat: e.Lat, Lon: e.Lon, Timestamp: e.Timestamp}
+	if e.Ele != nil {
+		f.Ele = sql.NullFloat64{Float64: *e.Ele, Valid: true}
+	}
+	return f
+}
+
+// ActivityStats summarises movement over a session or a time range
+type ActivityStats struct {
+	PointCount     int          `json:"point_count"`
+	DistanceM      float64      `json:"distance_m"`
+	MovingTimeS    float64      `json:"moving_time_s"`
+	ElapsedTimeS   float64      `json:"elapsed_time_s,omitempty"`
+	AvgSpeedMps    float64      `json:"avg_speed_mps"`
+	MaxSpeedMps    float64      `json:"max_speed_mps"`
+	PaceSecPerKm   float64      `json:"pace_s_per_km,omitempty"`
+	ElevationGainM float64      `json:"elevation_gain_m"`
+	ElevationLossM float64      `json:"elevation_loss_m"`
+	MinElevationM  *float64     `json:"min_elevation_m,omitempty"`
+	MaxElevationM  *float64     `json:"max_elevation_m,omitempty"`
+	BBox           *BoundingBox `json:"bbox,omitempty"`
+}
+
+// UserStats is the response of GET /users/{id}/stats
+type UserStats struct {
+	UserID string `json:"user_id"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+	ActivityStats
+}
+
+// SessionStats is the response of GET /sessions/{id}/stats
+type SessionStats struct {
+	SessionID string `json:"session_id"`
+	UserID    string `json:"user_id"`
+	Activity  string `json:"activity,omitempty"`
+	StartTime string `json:"start_time,omitempty"`
+	EndTime   string `json:"end_time,omitempty"`
+	ActivityStats
+}
+
+// statsRow is the aggregate row shared by the session, daily rollup and raw
+// coordinate queries
+type statsRow struct {
+	points                         sql.NullInt64
+	distance, moving, maxSpeed     sql.NullFloat64
+	gain, loss, minEle, maxEle     sql.NullFloat64
+	minLat, minLon, maxLat, maxLon sql.NullFloat64
+}
+
+// add merges an aggregate row into the running totals
+func (a *ActivityStats) add(s statsRow) {
+	if !s.points.Valid || s.points.Int64 == 0 {
+		return
+	}
+	a.PointCount += int(s.points.Int64)
+	a.DistanceM += s.distance.Float64
+	a.MovingTimeS += s.moving.Float64
+	a.ElevationGainM += s.gain.Float64
+	a.ElevationLossM += s.loss.Float64
+	if s.maxSpeed.Float64 > a.MaxSpeedMps {
+		a.MaxSpeedMps = s.maxSpeed.Float64
+	}
+	if s.minEle.Valid && (a.MinElevationM == nil || s.minEle.Float64 < *a.MinElevationM) {
+		v := s.minEle.Float64
+		a.MinElevationM = &v
+	}
+	if s.maxEle.Valid && (a.MaxElevationM == nil || s.maxEle.Float64 > *a.MaxElevationM) {
+		v := s.maxEle.Float64
+		a.MaxElevationM = &v
+	}
+	if s.minLat.Valid && s.minLon.Valid && s.maxLat.Valid && s.maxLon.Valid {
+		if a.BBox == nil {
+			a.BBox = &BoundingBox{MinLat: s.minLat.Float64, MinLon: s.minLon.Float64, MaxLat: s.maxLat.Float64, MaxLon: s.maxLon.Float64}
+		} else {
+			a.BBox.MinLat = min(a.BBox.MinLat, s.minLat.Float64)
+			a.BBox.MinLon = min(a.BBox.MinLon, s.minLon.Float64)
+			a.BBox.MaxLat = max(a.BBox.MaxLat, s.maxLat.Float64)
+			a.BBox.MaxLon = max(a.BBox.MaxLon, s.maxLon.Float64)
+		}
+	}
+}
+
+// finish derives the averages from the totals
+func (a *ActivityStats) finish() {
+	if a.MovingTimeS > 0 {
+		a.AvgSpeedMps = a.DistanceM / a.MovingTimeS
+	}
+	if a.DistanceM > 0 && a.MovingTimeS > 0 {
+		a.PaceSecPerKm = a.MovingTimeS / (a.DistanceM / 1000)
+	}
+}
+
+// statsSource sums stored activity for loadUserStats
+type statsSource interface {
+	// DailyStats sums a user's rollups for days in [fromDay, toDay); empty bounds are open
+	DailyStats(ctx context.Context, userID, fromDay, toDay string) (statsRow, error)
+	// RawStats sums a user's fixes with from <= timestamp < to (or <= to
+	// when toInclusive), for the partial days at the edges of a range
+	RawStats(ctx context.Context, userID, from, to string, toInclusive bool) (statsRow, error)
+}
+
+// loadUserStats combines whole days from the rollup table with the partial
+// days at either end of the range read from the coordinates themselves
+func loadUserStats(ctx context.Context, src statsSource, userID, from, to string) (ActivityStats, error) {
+	var stats ActivityStats
+
+	// Whole days covered by the range: [fromDay, toDay)
+	fromDay, toDay := "", ""
+	if from != "" {
+		fromDay = dayStart(from, true)
+	}
+	if to != "" {
+		toDay = dayStart(to, false)
+	}
+
+	if from != "" && to != "" && fromDay >= toDay {
+		// The range lies within a day or two; read it directly
+		row, err := src.RawStats(ctx, userID, from, to, true)
+		if err != nil {
+			return stats, err
+		}
+		stats.add(row)
+		stats.finish()
+		return stats, nil
+	}
+
+	row, err := src.DailyStats(ctx, userID, fromDay, toDay)
+	if err != nil {
+		return stats, err
+	}
+	stats.add(row)
+
+	if from != "" && from < midnight(fromDay) {
+		row, err := src.RawStats(ctx, userID, from, midnight(fromDay), false)
+		if err != nil {
+			return stats, err
+		}
+		stats.add(row)
+	}
+	if to != "" {
+		row, err := src.RawStats(ctx, userID, midnight(toDay), to, true)
+		if err != nil {
+			return stats, err
+		}
+		stats.add(row)
+	}
+
+	stats.finish()
+	return stats, nil
+}
+
+// dayStart returns the date of the midnight at or before a UTC RFC3339
+// timestamp, or at or after it when roundUp is set
+func dayStart(ts string, roundUp bool) string {
+	t, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		return ts[:min(len(ts), 10)]
+	}
+	day := t.Truncate(24 * time.Hour)
+	if roundUp && day.Before(t) {
+		day = day.Add(24 * time.Hour)
+	}
+	return day.Format("2006-01-02")
+}
+
+// midnight returns the start of a day in events.TimestampLayout
+func midnight(day string) string {
+	return day + "T00:00:00.000000000Z"
+}
+
+// getUserStats handles GET /users/{id}/stats
+func getUserStats(store Store, userID string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		from, to, err := parseTimeRange(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		stats, err := loadUserStats(r.Context(), store, userID, from, to)
+		if err != nil {
+			log.Printf("Error querying database: %v\n", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(UserStats{UserID: userID, From: from, To: to, ActivityStats: stats})
+	}
+}
+
+// getSessionStats handles GET /sessions/{id}/stats from the session's running totals
+func getSessionStats(store Store, sessionID string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		totals, err := store.SessionTotals(r.Context(), r.URL.Query().Get("user_id"), sessionID)
+		if err == errNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Printf("Error querying database: %v\n", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		resp := SessionStats{
+			SessionID: sessionID,
+			UserID:    totals.UserID,
+			Activity:  totals.Activity,
+			StartTime: totals.StartTime,
+			EndTime:   totals.EndTime,
+		}
+		resp.add(totals.Totals)
+		resp.finish()
+
+		// Elapsed time runs to the session end, or the latest fix of an open session
+		end := totals.EndTime
+		if end == "" {
+			end = totals.LastTime
+		}
+		t0, err0 := time.Parse(time.RFC3339, totals.StartTime)
+		t1, err1 := time.Parse(time.RFC3339, end)
+		if err0 == nil && err1 == nil && t1.After(t0) {
+			resp.ElapsedTimeS = t1.Sub(t0).Seconds()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// userResource routes /users/{id}/... to the profile, saved locations, track
+// export or stats handler
+func userResource(store Store, a *Accounts) http.HandlerFunc {
+	export := exportTrack(store)
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/users/"), "/"), "/")
+		if parts[0] == "" {
+			http.NotFound(w, r)
+			return
+		}
+		switch {
+		case len(parts) == 1:
+			userProfile(a, parts[0])(w, r)
+			return
+		case len(parts) == 2 && parts[1] == "locations":
+			savedLocations(a, parts[0], "")(w, r)
+			return
+		case len(parts) == 3 && parts[1] == "locations":
+			savedLocations(a, parts[0], parts[2])(w, r)
+			return
+		}
+		if len(parts) == 2 && parts[0] != "" && parts[1] == "stats" {
+			getUserStats(store, parts[0])(w, r)
+			return
+		}
+		export(w, r)
+	}
+}
+
+// sessionResource routes /sessions/{id}/... to the points or stats handler
+func sessionResource(store Store) http.HandlerFunc {
+	points := getSessionPoints(store)
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/sessions/"), "/"), "/")
+		if len(parts) == 2 && parts[0] != "" && parts[1] == "stats" {
+			getSessionStats(store, parts[0])(w, r)
+			return
+		}
+		points(w, r)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+// Storage backends selectable with Config.Storage
+const (
+	StorageSQLite  = "sqlite"
+	StorageMongoDB = "mongodb"
+)
+
+// errNotFound is returned by stores when a session or geofence does not exist
+var errNotFound = errors.New("not found")
+
+// Store persists consumed events and answers the queries behind the HTTP
+// API. The ingest, session, statistics and geofence logic is written once
+// against this interface; SQLiteStore and MongoStore only move rows.
+type Store interface {
+	// Begin starts a batch of writes
+	Begin(ctx context.Context) (Batch, error)
+
+	// Coordinates returns one page of fixes and, when more match, the
+	// cursor of the last one
+	Coordinates(ctx context.Context, q CoordinateQuery) ([]CoordinateEvent, *cursor, error)
+	Locations(ctx context.Context, userID string, limit int) ([]LocationEvent, error)
+	Sessions(ctx context.Context, userID string, limit int) ([]Session, error)
+	// Session IDs are only unique per user, so a session is named by both
+	SessionPoints(ctx context.Context, userID, sessionID string) ([]CoordinateEvent, error)
+	// SessionTotals returns errNotFound for an unknown session
+	SessionTotals(ctx context.Context, userID, sessionID string) (sessionTotals, error)
+	// Track returns a user's fixes in time order, for export
+	Track(ctx context.Context, userID, from, to string) ([]CoordinateEvent, error)
+	GeofenceEvents(ctx context.Context, q GeofenceEventQuery) ([]GeofenceEvent, error)
+
+	statsSource
+
+	Geofences(ctx context.Context) ([]*Geofence, error)
+	// InsertGeofence stores a new fence and returns its ID
+	InsertGeofence(ctx context.Context, fence Geofence) (int64, error)
+	UpdateGeofence(ctx context.Context, fence Geofence) error
+	// DeleteGeofence removes a fence and the users' state for it
+	DeleteGeofence(ctx context.Context, id int64) error
+
+	// InsertUser stores a new account, returning errUserExists if its
+	// username or email is taken
+	InsertUser(ctx context.Context, user User) error
+	// User returns an account and its saved locations, or errNotFound
+	User(ctx context.Context, username string) (User, error)
+	// UpdateUser replaces an account's profile and password hash, returning
+	// errUserExists if the new email is taken
+	UpdateUser(ctx context.Context, user User) error
+	SetLastLogin(ctx context.Context, username, at string) error
+	// SetRole changes an account's role, returning errNotFound for an
+	// unknown username
+	SetRole(ctx context.Context, username, role string) error
+	// BindUser sets the user_id an account owns, returning errNotFound for
+	// an unknown username and errUserIDBound if another account owns it
+	BindUser(ctx context.Context, username, userID string) error
+	// SaveLocation adds to a user's saved locations, reporting false if it
+	// was already saved
+	SaveLocation(ctx context.Context, username, locationID string) (bool, error)
+	// RemoveLocation reports false if the location was not saved
+	RemoveLocation(ctx context.Context, username, locationID string) (bool, error)
+
+	// CheckWritable reports whether the store can accept writes, for /readyz
+	CheckWritable(ctx context.Context) error
+	Close() error
+}
+
+// Batch is a set of writes committed together. Each message is written
+// between Savepoint and Release, and RollbackTo undoes just that message
+// where the backend supports it. A backend that cannot undo a message must
+// let its redelivery finish the writes that failed without repeating the
+// ones that succeeded.
+type Batch interface {
+	Savepoint() error
+	RollbackTo() error
+	Release() error
+	Commit() error
+	Rollback() error
+
+	// InsertCoordinate stores a fix with the segment leading to it. It
+	// reports false if a message from the same Kafka position is already
+	// stored, in which case its totals are too.
+	InsertCoordinate(event CoordinateEvent, seg segment, pos kafkaPosition) (bool, error)
+	// LastFix returns the latest fix folded into a user's session, if any
+	LastFix(userID, sessionID string) (fix, bool, error)
+	// UpdateSession folds a stored fix into its session's running totals
+	// once, however often the message at pos is delivered
+	UpdateSession(event CoordinateEvent, seg segment, pos kafkaPosition) error
+	// UpdateDailyStats folds a stored fix into its user's rollup for the day
+	// once, however often the message at pos is delivered
+	UpdateDailyStats(event CoordinateEvent, seg segment, pos kafkaPosition) error
+
+	// InsertLocation stores a check-in, reporting false for a duplicate
+	InsertLocation(event LocationEvent, pos kafkaPosition) (bool, error)
+	StartSession(event SessionEvent) error
+	EndSession(event SessionEvent) error
+
+	// InsideGeofences returns the fences the user was last seen inside
+	InsideGeofences(userID string) (map[int64]bool, error)
+	SetGeofenceState(userID string, geofenceID int64, inside bool, since string) error
+	InsertGeofenceEvent(ge GeofenceEvent) error
+}
+
+// CoordinateQuery filters and pages GET /events
+type CoordinateQuery struct {
+	UserID    string
+	SessionID string
+	From, To  string // RFC3339 in UTC, empty when open
+	BBox      *BoundingBox
+	Near      *GeoCircle
+	Polygon   []Point // an open ring, at least 3 points
+	Ascending bool
+	After     *cursor
+	Limit     int
+}
+
+// GeoCircle matches positions within RadiusM metres of Center
+type GeoCircle struct {
+	Center  Point
+	RadiusM float64
+}
+
+// GeofenceEventQuery filters GET /geofence-events
+type GeofenceEventQuery struct {
+	UserID     string
+	GeofenceID int64 // 0 for every fence
+	From, To   string
+	Limit      int
+}
+
+// sessionTotals is a session's running totals, as read for its stats
+type sessionTotals struct {
+	UserID    string
+	Activity  string
+	StartTime string
+	EndTime   string
+	LastTime  string // timestamp of the latest fix
+	Totals    statsRow
+}
+
+// kafkaPosition identifies the message a row was stored from, so a
+// redelivered message is recognised and not stored twice
+type kafkaPosition struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+}
+
+// positionOf returns the Kafka position of a message
+func positionOf(msg *kafka.Message) kafkaPosition {
+	return kafkaPosition{
+		Topic:     *msg.TopicPartition.Topic,
+		Partition: msg.TopicPartition.Partition,
+		Offset:    int64(msg.TopicPartition.Offset),
+	}
+}
+
+// openStore opens the configured storage backend, creating or migrating its schema
+func openStore(ctx context.Context, cfg *Config) (Store, error) {
+	switch cfg.Storage {
+	case StorageSQLite:
+		return OpenSQLiteStore(cfg.DBPath)
+	case StorageMongoDB:
+		return OpenMongoStore(ctx, cfg.MongoURI, cfg.MongoDatabase, cfg.MongoMigrate)
+	default:
+		return nil, fmt.Errorf("unknown storage %q", cfg.Storage)
+	}
+}
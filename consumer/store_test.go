@@ -0,0 +1,657 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+
+	"shared/events"
+)
+
+// newTestStore opens an empty in-memory SQLite store
+func newTestStore(t *testing.T) *SQLiteStore {
+	t.Helper()
+	s, err := OpenSQLiteStore(":memory:")
+	if err != nil {
+		t.Fatalf("OpenSQLiteStore: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// newTestMongoStore opens a store on a fresh database of the mongod at uri
+// and drops the database when the test ends
+func newTestMongoStore(t *testing.T, uri string) *MongoStore {
+	t.Helper()
+	ctx := context.Background()
+	name := fmt.Sprintf("gps_test_%d", time.Now().UnixNano())
+	s, err := OpenMongoStore(ctx, uri, name, true)
+	if err != nil {
+		t.Fatalf("OpenMongoStore: %v", err)
+	}
+	t.Cleanup(func() {
+		s.client.Database(name).Drop(ctx)
+		s.Close()
+	})
+	return s
+}
+
+// forEachStore runs fn against an empty store of every backend: SQLite
+// always, and MongoDB when MONGO_TEST_URI points at a mongod to test against
+func forEachStore(t *testing.T, fn func(t *testing.T, store Store)) {
+	t.Run("sqlite", func(t *testing.T) {
+		fn(t, newTestStore(t))
+	})
+	t.Run("mongodb", func(t *testing.T) {
+		uri := os.Getenv("MONGO_TEST_URI")
+		if uri == "" {
+			t.Skip("MONGO_TEST_URI not set")
+		}
+		fn(t, newTestMongoStore(t, uri))
+	})
+}
+
+// testFixes are stored by storeFixes, at offsets 0..4 of partition 0
+var testFixes = []CoordinateEvent{
+	{UserID: "u1", SessionID: "s1", Lat: 51.5000, Lon: -0.1000, Timestamp: "2026-10-16T10:00:00Z"},
+	{UserID: "u2", SessionID: "s2", Lat: 48.8566, Lon: 2.3522, Timestamp: "2026-10-16T10:00:05Z"},
+	{UserID: "u1", SessionID: "s1", Lat: 51.5010, Lon: -0.1000, Timestamp: "2026-10-16T10:00:10Z"},
+	{UserID: "u1", SessionID: "s1", Lat: 51.5020, Lon: -0.1000, Timestamp: "2026-10-16T10:00:20Z"},
+	{UserID: "u1", SessionID: "s3", Lat: 51.6000, Lon: -0.1000, Timestamp: "2026-10-16T10:00:30Z"},
+}
+
+// storeFixes inserts fixes, normalised as the ingest would, without their
+// sessions or statistics
+func storeFixes(t *testing.T, store Store, fixes []CoordinateEvent) {
+	t.Helper()
+	b, err := store.Begin(context.Background())
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	for i, e := range fixes {
+		e.Timestamp = normalized(e.Timestamp)
+		if _, err := b.InsertCoordinate(e, segment{}, kafkaPosition{"coordinates", 0, int64(i)}); err != nil {
+			t.Fatalf("InsertCoordinate: %v", err)
+		}
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+}
+
+// normalized rewrites ts in events.TimestampLayout, as the ingest and
+// parseTimeRange do; an empty bound stays empty
+func normalized(ts string) string {
+	if ts == "" {
+		return ""
+	}
+	n, err := events.NormalizeTimestamp(ts)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// timestamps lists the timestamps of fixes in events.TimestampLayout, for comparison
+func timestamps(fixes []CoordinateEvent) []string {
+	out := []string{}
+	for _, e := range fixes {
+		out = append(out, normalized(e.Timestamp))
+	}
+	return out
+}
+
+// allNormalized applies normalized to every timestamp in ts
+func allNormalized(ts []string) []string {
+	out := []string{}
+	for _, t := range ts {
+		out = append(out, normalized(t))
+	}
+	return out
+}
+
+func TestStoreCoordinates(t *testing.T) {
+	tests := []struct {
+		name string
+		q    CoordinateQuery
+		want []string
+	}{
+		{"newest first", CoordinateQuery{Limit: 10},
+			[]string{"2026-10-16T10:00:30Z", "2026-10-16T10:00:20Z", "2026-10-16T10:00:10Z", "2026-10-16T10:00:05Z", "2026-10-16T10:00:00Z"}},
+		{"limit", CoordinateQuery{Limit: 2},
+			[]string{"2026-10-16T10:00:30Z", "2026-10-16T10:00:20Z"}},
+		{"user oldest first", CoordinateQuery{UserID: "u1", Ascending: true, Limit: 10},
+			[]string{"2026-10-16T10:00:00Z", "2026-10-16T10:00:10Z", "2026-10-16T10:00:20Z", "2026-10-16T10:00:30Z"}},
+		{"session", CoordinateQuery{SessionID: "s1", Limit: 10},
+			[]string{"2026-10-16T10:00:20Z", "2026-10-16T10:00:10Z", "2026-10-16T10:00:00Z"}},
+		{"time range", CoordinateQuery{From: normalized("2026-10-16T10:00:05Z"), To: normalized("2026-10-16T10:00:20Z"), Limit: 10},
+			[]string{"2026-10-16T10:00:20Z", "2026-10-16T10:00:10Z", "2026-10-16T10:00:05Z"}},
+		{"bbox", CoordinateQuery{BBox: &BoundingBox{MinLat: 48, MinLon: 2, MaxLat: 49, MaxLon: 3}, Limit: 10},
+			[]string{"2026-10-16T10:00:05Z"}},
+		{"near", CoordinateQuery{Near: &GeoCircle{Center: Point{Lat: 51.5000, Lon: -0.1000}, RadiusM: 150}, Limit: 10},
+			[]string{"2026-10-16T10:00:10Z", "2026-10-16T10:00:00Z"}},
+		{"polygon", CoordinateQuery{Polygon: []Point{{Lat: 51.5005, Lon: -0.11}, {Lat: 51.5005, Lon: -0.09}, {Lat: 51.55, Lon: -0.10}}, Limit: 10},
+			[]string{"2026-10-16T10:00:20Z", "2026-10-16T10:00:10Z"}},
+		{"near and user", CoordinateQuery{UserID: "u2", Near: &GeoCircle{Center: Point{Lat: 51.5000, Lon: -0.1000}, RadiusM: 150}, Limit: 10},
+			[]string{}},
+		{"no match", CoordinateQuery{UserID: "nobody", Limit: 10},
+			[]string{}},
+	}
+
+	forEachStore(t, func(t *testing.T, store Store) {
+		storeFixes(t, store, testFixes)
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				got, _, err := store.Coordinates(context.Background(), tt.q)
+				if err != nil {
+					t.Fatalf("Coordinates: %v", err)
+				}
+				if want := allNormalized(tt.want); !reflect.DeepEqual(timestamps(got), want) {
+					t.Errorf("got %v, want %v", timestamps(got), want)
+				}
+			})
+		}
+	})
+}
+
+func TestStoreCoordinatesPaging(t *testing.T) {
+	tests := []struct {
+		name      string
+		ascending bool
+		pageSize  int
+	}{
+		{"newest first by 2", false, 2},
+		{"oldest first by 2", true, 2},
+		{"one page", false, 5},
+		{"by 1", true, 1},
+	}
+
+	forEachStore(t, func(t *testing.T, store Store) {
+		// Two fixes share a timestamp, so pages must break ties on the row ID
+		fixes := append([]CoordinateEvent{}, testFixes...)
+		fixes = append(fixes, CoordinateEvent{UserID: "u2", SessionID: "s2", Lat: 48.857, Lon: 2.3522, Timestamp: "2026-10-16T10:00:10Z"})
+		storeFixes(t, store, fixes)
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				all, _, err := store.Coordinates(context.Background(), CoordinateQuery{Ascending: tt.ascending, Limit: 10})
+				if err != nil {
+					t.Fatalf("Coordinates: %v", err)
+				}
+				if len(all) != len(fixes) {
+					t.Fatalf("got %d fixes, want %d", len(all), len(fixes))
+				}
+
+				var paged []CoordinateEvent
+				q := CoordinateQuery{Ascending: tt.ascending, Limit: tt.pageSize}
+				for pages := 0; ; pages++ {
+					if pages > len(fixes) {
+						t.Fatalf("paging did not stop")
+					}
+					page, next, err := store.Coordinates(context.Background(), q)
+					if err != nil {
+						t.Fatalf("Coordinates: %v", err)
+					}
+					paged = append(paged, page...)
+					if next == nil {
+						break
+					}
+					// Cursors go through their token form, as they do over HTTP
+					after, err := decodeCursor(encodeCursor(*next))
+					if err != nil {
+						t.Fatalf("decodeCursor: %v", err)
+					}
+					q.After = &after
+				}
+				if !reflect.DeepEqual(paged, all) {
+					t.Errorf("pages gave %v, want %v", timestamps(paged), timestamps(all))
+				}
+			})
+		}
+	})
+}
+
+func TestStoreSessionPointsOrder(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		// Fixes sharing a timestamp come back in the order they were stored
+		fixes := []CoordinateEvent{
+			{UserID: "u1", SessionID: "s1", Lat: 51.5020, Lon: -0.1000, Timestamp: "2026-10-16T10:00:10Z"},
+			{UserID: "u1", SessionID: "s1", Lat: 51.5000, Lon: -0.1000, Timestamp: "2026-10-16T10:00:00Z"},
+			{UserID: "u1", SessionID: "s1", Lat: 51.5030, Lon: -0.1000, Timestamp: "2026-10-16T10:00:10Z"},
+			{UserID: "u1", SessionID: "s1", Lat: 51.5010, Lon: -0.1000, Timestamp: "2026-10-16T10:00:10Z"},
+		}
+		storeFixes(t, store, fixes)
+
+		points, err := store.SessionPoints(context.Background(), "u1", "s1")
+		if err != nil {
+			t.Fatalf("SessionPoints: %v", err)
+		}
+		got := []float64{}
+		for _, p := range points {
+			got = append(got, p.Lat)
+		}
+		if want := []float64{51.5000, 51.5020, 51.5030, 51.5010}; !reflect.DeepEqual(got, want) {
+			t.Errorf("SessionPoints latitudes = %v, want %v", got, want)
+		}
+	})
+}
+
+func TestStoreIngestNormalisesTimestamps(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		// The offset fix is later than the UTC one despite its earlier date
+		ingestFixes(t, store, []CoordinateEvent{
+			{UserID: "u1", SessionID: "s1", Lat: 51.5000, Lon: -0.1000, Timestamp: "2026-10-17T04:30:00.5Z"},
+			{UserID: "u1", SessionID: "s1", Lat: 51.5010, Lon: -0.1000, Timestamp: "2026-10-16T23:30:00.75-05:00"},
+		})
+
+		got, _, err := store.Coordinates(context.Background(), CoordinateQuery{Ascending: true, Limit: 10})
+		if err != nil {
+			t.Fatalf("Coordinates: %v", err)
+		}
+		stored := []string{}
+		for _, e := range got {
+			stored = append(stored, e.Timestamp)
+		}
+		if want := []string{"2026-10-17T04:30:00.500000000Z", "2026-10-17T04:30:00.750000000Z"}; !reflect.DeepEqual(stored, want) {
+			t.Errorf("stored timestamps %v, want %v", stored, want)
+		}
+	})
+}
+
+func TestStoreRedelivery(t *testing.T) {
+	tests := []struct {
+		name string
+		pos  kafkaPosition
+		want bool
+	}{
+		{"same position", kafkaPosition{"coordinates", 0, 3}, false},
+		{"other partition", kafkaPosition{"coordinates", 1, 3}, true},
+		{"new offset", kafkaPosition{"coordinates", 0, 99}, true},
+	}
+
+	forEachStore(t, func(t *testing.T, store Store) {
+		storeFixes(t, store, testFixes)
+
+		b, err := store.Begin(context.Background())
+		if err != nil {
+			t.Fatalf("Begin: %v", err)
+		}
+		defer b.Rollback()
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				stored, err := b.InsertCoordinate(testFixes[3], segment{}, tt.pos)
+				if err != nil {
+					t.Fatalf("InsertCoordinate: %v", err)
+				}
+				if stored != tt.want {
+					t.Errorf("stored = %v, want %v", stored, tt.want)
+				}
+			})
+		}
+	})
+}
+
+func TestStoreSessionsAndLocations(t *testing.T) {
+	sessionTests := []struct {
+		userID string
+		limit  int
+		want   []string
+	}{
+		{"", 10, []string{"s2", "s3", "s1"}},
+		{"u1", 10, []string{"s2", "s1"}},
+		{"u1", 1, []string{"s2"}},
+		{"u3", 10, []string{}},
+	}
+	locationTests := []struct {
+		userID string
+		want   []string
+	}{
+		{"", []string{"Cafe", "Park"}},
+		{"u1", []string{"Park"}},
+		{"u3", []string{}},
+	}
+
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		b, err := store.Begin(ctx)
+		if err != nil {
+			t.Fatalf("Begin: %v", err)
+		}
+		for _, e := range []SessionEvent{
+			{SessionID: "s1", UserID: "u1", Activity: "running", Timestamp: "2026-10-16T09:00:00Z"},
+			{SessionID: "s2", UserID: "u1", Activity: "cycling", Timestamp: "2026-10-16T11:00:00Z"},
+			{SessionID: "s3", UserID: "u2", Activity: "walking", Timestamp: "2026-10-16T10:00:00Z"},
+		} {
+			if err := b.StartSession(e); err != nil {
+				t.Fatalf("StartSession: %v", err)
+			}
+		}
+		for i, e := range []LocationEvent{
+			{UserID: "u1", Location: "Park", Lat: 51.5, Lon: -0.1, Timestamp: "2026-10-16T09:30:00Z"},
+			{UserID: "u2", Location: "Cafe", Lat: 51.5, Lon: -0.1, Timestamp: "2026-10-16T10:30:00Z"},
+		} {
+			if _, err := b.InsertLocation(e, kafkaPosition{"locations", 0, int64(i)}); err != nil {
+				t.Fatalf("InsertLocation: %v", err)
+			}
+		}
+		if err := b.Commit(); err != nil {
+			t.Fatalf("Commit: %v", err)
+		}
+
+		for _, tt := range sessionTests {
+			sessions, err := store.Sessions(ctx, tt.userID, tt.limit)
+			if err != nil {
+				t.Fatalf("Sessions: %v", err)
+			}
+			got := []string{}
+			for _, s := range sessions {
+				got = append(got, s.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Sessions(%q, %d) = %v, want %v", tt.userID, tt.limit, got, tt.want)
+			}
+		}
+
+		for _, tt := range locationTests {
+			locations, err := store.Locations(ctx, tt.userID, 10)
+			if err != nil {
+				t.Fatalf("Locations: %v", err)
+			}
+			got := []string{}
+			for _, l := range locations {
+				got = append(got, l.Location)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Locations(%q) = %v, want %v", tt.userID, got, tt.want)
+			}
+		}
+	})
+}
+
+// statsFixes cross midnight and carry elevation, so the rollups and the raw
+// edges of a range both contribute
+var statsFixes = []CoordinateEvent{
+	{UserID: "u1", SessionID: "s1", Lat: 51.5000, Lon: -0.1000, Timestamp: "2026-10-15T23:59:40Z", Ele: ptr(10.0)},
+	{UserID: "u1", SessionID: "s1", Lat: 51.5003, Lon: -0.1000, Timestamp: "2026-10-15T23:59:50Z", Ele: ptr(12.0)},
+	{UserID: "u2", SessionID: "s2", Lat: 48.8566, Lon: 2.3522, Timestamp: "2026-10-16T00:00:00Z"},
+	{UserID: "u1", SessionID: "s1", Lat: 51.5006, Lon: -0.1000, Timestamp: "2026-10-16T00:00:00Z", Ele: ptr(11.0)},
+	{UserID: "u2", SessionID: "s2", Lat: 48.8570, Lon: 2.3522, Timestamp: "2026-10-16T00:00:05Z"},
+	{UserID: "u1", SessionID: "s1", Lat: 51.5009, Lon: -0.1003, Timestamp: "2026-10-16T00:00:10Z", Ele: ptr(15.0)},
+	{UserID: "u1", SessionID: "s1", Lat: 51.5012, Lon: -0.1003, Timestamp: "2026-10-17T08:00:00Z", Ele: ptr(14.0)},
+}
+
+func ptr(f float64) *float64 { return &f }
+
+// ingestFixes stores fixes the way Flush does, updating their sessions and
+// daily statistics, after starting each fix's session
+func ingestFixes(t *testing.T, store Store, fixes []CoordinateEvent) {
+	t.Helper()
+	ser := newTestSerializer(t)
+	b, err := store.Begin(context.Background())
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+
+	started := map[[2]string]bool{}
+	topic := "coordinates"
+	for i, e := range fixes {
+		if key := [2]string{e.UserID, e.SessionID}; !started[key] {
+			started[key] = true
+			start := SessionEvent{Type: events.SessionStart, SessionID: e.SessionID, UserID: e.UserID, Activity: "running", Timestamp: normalized(e.Timestamp)}
+			if err := b.StartSession(start); err != nil {
+				t.Fatalf("StartSession: %v", err)
+			}
+		}
+
+		data, err := ser.Marshal(&e)
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		msg := &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 0, Offset: kafka.Offset(i)},
+			Value:          data,
+		}
+		if _, err := storeCoordinate(ser, b, msg); err != nil {
+			t.Fatalf("storeCoordinate: %v", err)
+		}
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+}
+
+// wantStats sums the segments of a user's fixes with from <= timestamp <= to
+func wantStats(userID, from, to string) ActivityStats {
+	var want ActivityStats
+	last := map[string]fix{}
+	for _, e := range statsFixes {
+		var seg segment
+		if prev, ok := last[e.SessionID]; ok {
+			seg = measureSegment(prev, fixOf(e))
+		}
+		last[e.SessionID] = fixOf(e)
+
+		if e.UserID != userID || (from != "" && e.Timestamp < from) || (to != "" && e.Timestamp > to) {
+			continue
+		}
+		want.PointCount++
+		want.DistanceM += seg.DistanceM
+		want.ElevationGainM += seg.gain()
+		want.ElevationLossM += seg.loss()
+	}
+	return want
+}
+
+// closeTo compares distances and elevations summed in a different order
+func closeTo(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+func TestStoreUpdateSession(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ingestFixes(t, store, statsFixes)
+		ctx := context.Background()
+		want := wantStats("u1", "", "")
+
+		totals, err := store.SessionTotals(ctx, "u1", "s1")
+		if err != nil {
+			t.Fatalf("SessionTotals: %v", err)
+		}
+		var got ActivityStats
+		got.add(totals.Totals)
+		if got.PointCount != want.PointCount || !closeTo(got.DistanceM, want.DistanceM) ||
+			!closeTo(got.ElevationGainM, want.ElevationGainM) || !closeTo(got.ElevationLossM, want.ElevationLossM) {
+			t.Errorf("session totals %+v, want %+v", got, want)
+		}
+		wantStart, wantLast := normalized("2026-10-15T23:59:40Z"), normalized("2026-10-17T08:00:00Z")
+		if totals.UserID != "u1" || totals.StartTime != wantStart || totals.LastTime != wantLast {
+			t.Errorf("session %s %s..%s, want u1 %s..%s",
+				totals.UserID, totals.StartTime, totals.LastTime, wantStart, wantLast)
+		}
+		if _, err := store.SessionTotals(ctx, "u1", "nope"); err != errNotFound {
+			t.Errorf("SessionTotals of an unknown session: error = %v, want errNotFound", err)
+		}
+
+		sessions, err := store.Sessions(ctx, "u1", 10)
+		if err != nil {
+			t.Fatalf("Sessions: %v", err)
+		}
+		wantBBox := &BoundingBox{MinLat: 51.5000, MinLon: -0.1003, MaxLat: 51.5012, MaxLon: -0.1000}
+		if len(sessions) != 1 || sessions[0].PointCount != want.PointCount ||
+			!closeTo(sessions[0].DistanceM, want.DistanceM) || !reflect.DeepEqual(sessions[0].BBox, wantBBox) {
+			t.Errorf("Sessions = %+v, want s1 with %d points, %.3f m inside %+v", sessions, want.PointCount, want.DistanceM, wantBBox)
+		}
+
+		points, err := store.SessionPoints(ctx, "u1", "s1")
+		if err != nil {
+			t.Fatalf("SessionPoints: %v", err)
+		}
+		wantPoints := allNormalized([]string{"2026-10-15T23:59:40Z", "2026-10-15T23:59:50Z", "2026-10-16T00:00:00Z", "2026-10-16T00:00:10Z", "2026-10-17T08:00:00Z"})
+		if !reflect.DeepEqual(timestamps(points), wantPoints) {
+			t.Errorf("SessionPoints = %v, want %v", timestamps(points), wantPoints)
+		}
+	})
+}
+
+func TestStoreSessionsPerUser(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		// Two users who picked the same session ID keep separate sessions
+		fixes := []CoordinateEvent{
+			{UserID: "u1", SessionID: "s1", Lat: 51.5000, Lon: -0.1000, Timestamp: "2026-10-16T10:00:00Z"},
+			{UserID: "u2", SessionID: "s1", Lat: 48.8566, Lon: 2.3522, Timestamp: "2026-10-16T10:00:05Z"},
+			{UserID: "u1", SessionID: "s1", Lat: 51.5003, Lon: -0.1000, Timestamp: "2026-10-16T10:00:10Z"},
+		}
+		ingestFixes(t, store, fixes)
+		ctx := context.Background()
+		seg := measureSegment(fixOf(fixes[0]), fixOf(fixes[2]))
+
+		for _, tt := range []struct {
+			userID    string
+			points    int
+			distanceM float64
+		}{
+			{"u1", 2, seg.DistanceM},
+			{"u2", 1, 0},
+		} {
+			totals, err := store.SessionTotals(ctx, tt.userID, "s1")
+			if err != nil {
+				t.Fatalf("SessionTotals(%s): %v", tt.userID, err)
+			}
+			var got ActivityStats
+			got.add(totals.Totals)
+			if totals.UserID != tt.userID || got.PointCount != tt.points || !closeTo(got.DistanceM, tt.distanceM) {
+				t.Errorf("%s's session: %s with %d points, %.3f m; want %d points, %.3f m",
+					tt.userID, totals.UserID, got.PointCount, got.DistanceM, tt.points, tt.distanceM)
+			}
+
+			points, err := store.SessionPoints(ctx, tt.userID, "s1")
+			if err != nil {
+				t.Fatalf("SessionPoints(%s): %v", tt.userID, err)
+			}
+			for _, p := range points {
+				if p.UserID != tt.userID {
+					t.Errorf("%s's session points include %+v", tt.userID, p)
+				}
+			}
+			if len(points) != tt.points {
+				t.Errorf("%s's session has %d points, want %d", tt.userID, len(points), tt.points)
+			}
+		}
+		if _, err := store.SessionTotals(ctx, "u3", "s1"); err != errNotFound {
+			t.Errorf("SessionTotals of another user's session ID: error = %v, want errNotFound", err)
+		}
+	})
+}
+
+func TestStoreStats(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+	}{
+		{"all time", "", ""},
+		{"within a day", "2026-10-16T00:00:00Z", "2026-10-16T00:00:10Z"},
+		{"across days", "2026-10-15T23:59:45Z", "2026-10-17T00:00:00Z"},
+		{"whole days", "2026-10-16T00:00:00Z", "2026-10-18T00:00:00Z"},
+		{"from only", "2026-10-16T00:00:05Z", ""},
+		{"to only", "", "2026-10-16T00:00:00Z"},
+		{"nothing", "2026-10-18T00:00:00Z", "2026-10-19T00:00:00Z"},
+	}
+
+	forEachStore(t, func(t *testing.T, store Store) {
+		ingestFixes(t, store, statsFixes)
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				got, err := loadUserStats(context.Background(), store, "u1", normalized(tt.from), normalized(tt.to))
+				if err != nil {
+					t.Fatalf("loadUserStats: %v", err)
+				}
+				want := wantStats("u1", tt.from, tt.to)
+				if got.PointCount != want.PointCount || !closeTo(got.DistanceM, want.DistanceM) ||
+					!closeTo(got.ElevationGainM, want.ElevationGainM) || !closeTo(got.ElevationLossM, want.ElevationLossM) {
+					t.Errorf("got %d points, %.3f m, +%.1f/-%.1f m; want %d points, %.3f m, +%.1f/-%.1f m",
+						got.PointCount, got.DistanceM, got.ElevationGainM, got.ElevationLossM,
+						want.PointCount, want.DistanceM, want.ElevationGainM, want.ElevationLossM)
+				}
+			})
+		}
+	})
+}
+
+func TestStoreRedeliveryCountsOnce(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ingestFixes(t, store, statsFixes)
+		ingestFixes(t, store, statsFixes)
+		ctx := context.Background()
+		want := wantStats("u1", "", "")
+
+		totals, err := store.SessionTotals(ctx, "u1", "s1")
+		if err != nil {
+			t.Fatalf("SessionTotals: %v", err)
+		}
+		var session ActivityStats
+		session.add(totals.Totals)
+		if session.PointCount != want.PointCount || !closeTo(session.DistanceM, want.DistanceM) {
+			t.Errorf("session totals %d points, %.3f m; want %d points, %.3f m",
+				session.PointCount, session.DistanceM, want.PointCount, want.DistanceM)
+		}
+
+		got, err := loadUserStats(ctx, store, "u1", "", "")
+		if err != nil {
+			t.Fatalf("loadUserStats: %v", err)
+		}
+		if got.PointCount != want.PointCount || !closeTo(got.DistanceM, want.DistanceM) {
+			t.Errorf("daily stats %d points, %.3f m; want %d points, %.3f m",
+				got.PointCount, got.DistanceM, want.PointCount, want.DistanceM)
+		}
+	})
+}
+
+func TestMongoRedeliveryFinishesTotals(t *testing.T) {
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI not set")
+	}
+	store := newTestMongoStore(t, uri)
+	ctx := context.Background()
+
+	// The first delivery stored the second fix, then failed before its totals
+	ingestFixes(t, store, statsFixes[:1])
+	seg := measureSegment(fixOf(statsFixes[0]), fixOf(statsFixes[1]))
+	b, err := store.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	second := statsFixes[1]
+	second.Timestamp = normalized(second.Timestamp)
+	if _, err := b.InsertCoordinate(second, seg, kafkaPosition{"coordinates", 0, 1}); err != nil {
+		t.Fatalf("InsertCoordinate: %v", err)
+	}
+
+	// Redelivering both fixes finishes the second and leaves the first alone
+	ingestFixes(t, store, statsFixes[:2])
+
+	totals, err := store.SessionTotals(ctx, "u1", "s1")
+	if err != nil {
+		t.Fatalf("SessionTotals: %v", err)
+	}
+	var session ActivityStats
+	session.add(totals.Totals)
+	if session.PointCount != 2 || !closeTo(session.DistanceM, seg.DistanceM) {
+		t.Errorf("session totals %d points, %.3f m; want 2 points, %.3f m",
+			session.PointCount, session.DistanceM, seg.DistanceM)
+	}
+	got, err := loadUserStats(ctx, store, "u1", "", "")
+	if err != nil {
+		t.Fatalf("loadUserStats: %v", err)
+	}
+	if got.PointCount != 2 || !closeTo(got.DistanceM, seg.DistanceM) {
+		t.Errorf("daily stats %d points, %.3f m; want 2 points, %.3f m", got.PointCount, got.DistanceM, seg.DistanceM)
+	}
+}
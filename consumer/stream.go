@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	streamBufferSize = 64               // events buffered per client before eviction
+	streamHeartbeat  = 15 * time.Second // keep-alive comment interval
+)
+
+// streamClient is a single connected live-stream subscriber
+type streamClient struct {
+	userID string
+	events chan CoordinateEvent
+}
+
+// StreamHub fans out stored coordinate events to live-stream subscribers.
+// Publish never blocks: a client whose buffer is full is evicted so a slow
+// browser cannot stall the Kafka poll loop.
+type StreamHub struct {
+	mu      sync.Mutex
+	clients map[*streamClient]struct{}
+}
+
+// NewStreamHub creates an empty hub
+func NewStreamHub() *StreamHub {
+	return &StreamHub{clients: make(map[*streamClient]struct{})}
+}
+
+// subscribe registers a client interested in userID ("" means all users)
+func (h *StreamHub) subscribe(userID string) *streamClient {
+	client := &streamClient{
+		userID: userID,
+		events: make(chan CoordinateEvent, streamBufferSize),
+	}
+
+	h.mu.Lock()
+	h.clients[client] = struct{}{}
+	h.mu.Unlock()
+	return client
+}
+
+// unsubscribe removes a client if it is still registered
+func (h *StreamHub) unsubscribe(client *streamClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.clients[client]; ok {
+		delete(h.clients, client)
+		close(client.events)
+	}
+}
+
+// Close disconnects every client so their streams end and the HTTP server
+// can shut down
+func (h *StreamHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for client := range h.clients {
+		delete(h.clients, client)
+		close(client.events)
+	}
+}
+
+// Publish delivers an event to every matching client without blocking
+func (h *StreamHub) Publish(event CoordinateEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for client := range h.clients {
+		if client.userID != "" && client.userID != event.UserID {
+			continue
+		}
+
+		select {
+		case client.events <- event:
+		default:
+			log.Printf("Evicting slow stream client (user_id=%q)\n", client.userID)
+			delete(h.clients, client)
+			close(client.events)
+		}
+	}
+}
+
+// streamEvents handles the Server-Sent Events endpoint for live coordinates
+func streamEvents(hub *StreamHub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		client := hub.subscribe(r.URL.Query().Get("user_id"))
+		defer hub.unsubscribe(client)
+
+		heartbeat := time.NewTicker(streamHeartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+				flusher.Flush()
+			case event, ok := <-client.events:
+				if !ok {
+					// Evicted by Publish or the server is shutting down;
+					// the browser will reconnect
+					return
+				}
+				data, err := json.Marshal(event)
+				if err != nil {
+					log.Printf("Error marshaling stream event: %v\n", err)
+					continue
+				}
+				fmt.Fprintf(w, "data: %s\n\n", data)
+				flusher.Flush()
+			}
+		}
+	}
+}
@@ -0,0 +1,627 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"golang.org/x/crypto/bcrypt"
+
+	"shared/auth"
+	"shared/events"
+)
+
+// User event types, re-exported from the shared contract
+const (
+	UserRegistered      = events.UserRegistered
+	UserUpdated         = events.UserUpdated
+	UserLocationSaved   = events.UserLocationSaved
+	UserLocationRemoved = events.UserLocationRemoved
+)
+
+// UserEvent is a change to an account, published to the users topic
+type UserEvent = events.UserEvent
+
+const (
+	// bcrypt ignores everything after 72 bytes, so longer passwords are refused
+	minPasswordLen = 8
+	maxPasswordLen = 72
+
+	maxSavedLocations = 100
+	maxLocationIDLen  = 200
+)
+
+var (
+	// usernamePattern keeps usernames usable as the user_id of events and in URLs
+	usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,32}$`)
+	// emailPattern matches the users collection's validator
+	emailPattern = regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
+
+	// errUserExists is returned by stores when a username or email is taken
+	errUserExists = errors.New("username or email already registered")
+	// errUserIDBound is returned by stores when binding an account to a
+	// user_id another account is bound to
+	errUserIDBound = errors.New("user_id is bound to another account")
+	// errBadCredentials is returned for an unknown user or a wrong password alike
+	errBadCredentials = errors.New("invalid username or password")
+	// errTooManyLocations is returned when saving one more location would exceed maxSavedLocations
+	errTooManyLocations = fmt.Errorf("at most %d locations can be saved", maxSavedLocations)
+)
+
+// User is an account. UserID is the user_id of the coordinates, sessions
+// and events the account owns: registration binds a new account to a fresh
+// one, and only an operator can bind it to another, such as a simulated
+// user's, with "consumer bind-user". Accounts register with the user role;
+// only an operator can make one an admin, with "consumer set-role".
+type User struct {
+	Username       string                 `json:"username"`
+	UserID         string                 `json:"user_id"`
+	Email          string                 `json:"email"`
+	Role           string                 `json:"role"`
+	FullName       string                 `json:"full_name,omitempty"`
+	Bio            string                 `json:"bio,omitempty"`
+	ProfilePic     string                 `json:"profile_pic,omitempty"`
+	Preferences    map[string]interface{} `json:"preferences,omitempty"`
+	SavedLocations []string               `json:"saved_locations"`
+	CreatedAt      string                 `json:"created_at"`
+	UpdatedAt      string                 `json:"updated_at,omitempty"`
+	LastLogin      string                 `json:"last_login,omitempty"`
+
+	PasswordHash string `json:"-"`
+}
+
+// registerRequest is the body of POST /auth/register
+type registerRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	FullName string `json:"full_name"`
+}
+
+// loginRequest is the body of POST /auth/login
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// profileUpdate is the body of PATCH /users/{id}. Absent fields are left
+// alone; preferences: null clears them. Changing the password needs the
+// current one.
+type profileUpdate struct {
+	Email           *string         `json:"email"`
+	FullName        *string         `json:"full_name"`
+	Bio             *string         `json:"bio"`
+	ProfilePic      *string         `json:"profile_pic"`
+	Preferences     json.RawMessage `json:"preferences"`
+	Password        *string         `json:"password"`
+	CurrentPassword string          `json:"current_password"`
+}
+
+// loginResponse is the body of a successful POST /auth/login
+type loginResponse struct {
+	Token     string `json:"token"`
+	TokenType string `json:"token_type"`
+	ExpiresAt string `json:"expires_at"`
+	Role      string `json:"role"`
+	User      User   `json:"user"`
+}
+
+// Accounts registers users, checks their passwords, issues their API
+// tokens, edits their profiles and saved locations, and publishes every
+// change to the users topic
+type Accounts struct {
+	cfg        *Config
+	store      Store
+	authn      *auth.Authenticator
+	producer   *kafka.Producer
+	serializer *events.Serializer
+
+	// dummyHash is compared against when a login names an unknown user, so
+	// the response time does not reveal which usernames exist
+	dummyHash []byte
+}
+
+// NewAccounts creates the user event producer
+func NewAccounts(cfg *Config, store Store, authn *auth.Authenticator, serializer *events.Serializer) (*Accounts, error) {
+	dummyHash, err := bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := kafka.NewProducer(cfg.producerConfig())
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for e := range p.Events() {
+			if m, ok := e.(*kafka.Message); ok && m.TopicPartition.Error != nil {
+				log.Printf("User event delivery failed: %v\n", m.TopicPartition.Error)
+			}
+		}
+	}()
+
+	return &Accounts{cfg: cfg, store: store, authn: authn, producer: p, serializer: serializer, dummyHash: dummyHash}, nil
+}
+
+// Close flushes pending user events and closes the producer
+func (a *Accounts) Close(timeout time.Duration) error {
+	remaining := a.producer.Flush(int(timeout.Milliseconds()))
+	a.producer.Close()
+	if remaining > 0 {
+		return fmt.Errorf("%d user events not delivered", remaining)
+	}
+	return nil
+}
+
+// publish produces a user event once the change is stored. A failure is
+// logged: the account change itself has already succeeded.
+func (a *Accounts) publish(ue UserEvent) {
+	ue.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	data, err := a.serializer.Marshal(&ue)
+	if err != nil {
+		log.Printf("Error marshaling user event: %v\n", err)
+		return
+	}
+
+	err = a.producer.Produce(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &a.cfg.UsersTopic, Partition: kafka.PartitionAny},
+		Key:            []byte(ue.UserID),
+		Value:          data,
+	}, nil)
+	if err != nil {
+		log.Printf("Error producing user event: %v\n", err)
+	}
+}
+
+// Register creates an account with a bcrypt hash of its password, bound to
+// a new user_id. The username is never taken as the user_id, so signing up
+// under the name of a simulated user does not reach that user's data.
+func (a *Accounts) Register(ctx context.Context, req registerRequest) (User, error) {
+	userID, err := newUserID()
+	if err != nil {
+		return User{}, err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+	user := User{
+		Username:       req.Username,
+		UserID:         userID,
+		Email:          strings.ToLower(req.Email),
+		Role:           auth.RoleUser,
+		FullName:       req.FullName,
+		SavedLocations: []string{},
+		CreatedAt:      time.Now().UTC().Format(time.RFC3339),
+		PasswordHash:   string(hash),
+	}
+	if err := a.store.InsertUser(ctx, user); err != nil {
+		return User{}, err
+	}
+
+	a.publish(UserEvent{Type: UserRegistered, UserID: user.Username})
+	return user, nil
+}
+
+// newUserID returns a random user_id for a new account
+func newUserID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "u-" + hex.EncodeToString(b), nil
+}
+
+// Login checks a username and password and records the login
+func (a *Accounts) Login(ctx context.Context, username, password string) (User, error) {
+	user, err := a.store.User(ctx, username)
+	if err == errNotFound {
+		bcrypt.CompareHashAndPassword(a.dummyHash, []byte(password))
+		return User{}, errBadCredentials
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return User{}, errBadCredentials
+	}
+
+	user.LastLogin = time.Now().UTC().Format(time.RFC3339)
+	if err := a.store.SetLastLogin(ctx, user.Username, user.LastLogin); err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// Token issues an API token for a logged-in user's account
+func (a *Accounts) Token(user User) (loginResponse, error) {
+	p := principalOf(user)
+	token, expires, err := a.authn.Issue(p)
+	if err != nil {
+		return loginResponse{}, err
+	}
+	return loginResponse{
+		Token:     token,
+		TokenType: "Bearer",
+		ExpiresAt: expires.UTC().Format(time.RFC3339),
+		Role:      p.Role,
+		User:      user,
+	}, nil
+}
+
+// Resolve gives a token its account's current user_id and role, so a
+// demotion or a new binding applies to tokens already issued. Tokens of a
+// deleted account are revoked.
+func (a *Accounts) Resolve(ctx context.Context, p auth.Principal) (auth.Principal, error) {
+	user, err := a.store.User(ctx, p.Account)
+	if err == errNotFound {
+		return auth.Principal{}, auth.ErrRevoked
+	}
+	if err != nil {
+		log.Printf("Error looking up account %s: %v\n", p.Account, err)
+		return auth.Principal{}, err
+	}
+	return principalOf(user), nil
+}
+
+// principalOf returns the caller an account acts as
+func principalOf(user User) auth.Principal {
+	role := user.Role
+	if role != auth.RoleAdmin {
+		role = auth.RoleUser
+	}
+	return auth.Principal{UserID: user.UserID, Role: role, Account: user.Username}
+}
+
+// UpdateProfile applies a validated profile update and publishes the
+// fields that changed
+func (a *Accounts) UpdateProfile(ctx context.Context, username string, upd profileUpdate) (User, error) {
+	user, err := a.store.User(ctx, username)
+	if err != nil {
+		return User{}, err
+	}
+
+	var changed []string
+	setString := func(field string, dst *string, src *string) {
+		if src != nil && *src != *dst {
+			*dst = *src
+			changed = append(changed, field)
+		}
+	}
+	if upd.Email != nil {
+		email := strings.ToLower(*upd.Email)
+		setString("email", &user.Email, &email)
+	}
+	setString("full_name", &user.FullName, upd.FullName)
+	setString("bio", &user.Bio, upd.Bio)
+	setString("profile_pic", &user.ProfilePic, upd.ProfilePic)
+	if len(upd.Preferences) > 0 {
+		var prefs map[string]interface{}
+		json.Unmarshal(upd.Preferences, &prefs) // checked by validate
+		if prefs != nil || user.Preferences != nil {
+			user.Preferences = prefs
+			changed = append(changed, "preferences")
+		}
+	}
+	if upd.Password != nil {
+		if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(upd.CurrentPassword)) != nil {
+			return User{}, errBadCredentials
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(*upd.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return User{}, err
+		}
+		user.PasswordHash = string(hash)
+		changed = append(changed, "password")
+	}
+	if len(changed) == 0 {
+		return user, nil
+	}
+
+	user.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	if err := a.store.UpdateUser(ctx, user); err != nil {
+		return User{}, err
+	}
+
+	a.publish(UserEvent{Type: UserUpdated, UserID: user.Username, Changed: strings.Join(changed, ",")})
+	return user, nil
+}
+
+// SaveLocation adds a location to the user's saved locations
+func (a *Accounts) SaveLocation(ctx context.Context, username, locationID string) error {
+	user, err := a.store.User(ctx, username)
+	if err != nil {
+		return err
+	}
+	for _, id := range user.SavedLocations {
+		if id == locationID {
+			return nil
+		}
+	}
+	if len(user.SavedLocations) >= maxSavedLocations {
+		return errTooManyLocations
+	}
+
+	added, err := a.store.SaveLocation(ctx, username, locationID)
+	if err != nil {
+		return err
+	}
+	if added {
+		a.publish(UserEvent{Type: UserLocationSaved, UserID: username, LocationID: locationID})
+	}
+	return nil
+}
+
+// RemoveLocation removes a location from the user's saved locations,
+// returning errNotFound if it was not saved
+func (a *Accounts) RemoveLocation(ctx context.Context, username, locationID string) error {
+	removed, err := a.store.RemoveLocation(ctx, username, locationID)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return errNotFound
+	}
+	a.publish(UserEvent{Type: UserLocationRemoved, UserID: username, LocationID: locationID})
+	return nil
+}
+
+// validate checks a registration before anything is hashed or stored
+func (req *registerRequest) validate() error {
+	if !usernamePattern.MatchString(req.Username) {
+		return fmt.Errorf("username must be 3-32 letters, digits, '.', '_' or '-'")
+	}
+	if err := validEmail(req.Email); err != nil {
+		return err
+	}
+	if err := validPassword(req.Password); err != nil {
+		return err
+	}
+	return validText("full_name", req.FullName, 100)
+}
+
+// validate checks the fields an update sets
+func (upd *profileUpdate) validate() error {
+	if upd.Email != nil {
+		if err := validEmail(*upd.Email); err != nil {
+			return err
+		}
+	}
+	if upd.FullName != nil {
+		if err := validText("full_name", *upd.FullName, 100); err != nil {
+			return err
+		}
+	}
+	if upd.Bio != nil {
+		if err := validText("bio", *upd.Bio, 1000); err != nil {
+			return err
+		}
+	}
+	if upd.ProfilePic != nil && *upd.ProfilePic != "" {
+		u, err := url.Parse(*upd.ProfilePic)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("profile_pic must be an http or https URL")
+		}
+	}
+	if len(upd.Preferences) > 0 && string(upd.Preferences) != "null" {
+		var prefs map[string]interface{}
+		if err := json.Unmarshal(upd.Preferences, &prefs); err != nil {
+			return fmt.Errorf("preferences must be an object or null")
+		}
+	}
+	if upd.Password != nil {
+		if err := validPassword(*upd.Password); err != nil {
+			return err
+		}
+		if upd.CurrentPassword == "" {
+			return fmt.Errorf("current_password is required to change the password")
+		}
+	}
+	return nil
+}
+
+func validEmail(email string) error {
+	if len(email) > 254 || !emailPattern.MatchString(email) {
+		return fmt.Errorf("email must be a valid email address")
+	}
+	return nil
+}
+
+func validPassword(password string) error {
+	if len(password) < minPasswordLen || len(password) > maxPasswordLen {
+		return fmt.Errorf("password must be %d to %d bytes", minPasswordLen, maxPasswordLen)
+	}
+	return nil
+}
+
+func validText(field, value string, max int) error {
+	if utf8.RuneCountInString(value) > max {
+		return fmt.Errorf("%s must be at most %d characters", field, max)
+	}
+	return nil
+}
+
+// maxBodyBytes bounds the size of an account or profile request body
+const maxBodyBytes = 8 << 10
+
+// decodeBody decodes a JSON request body of at most maxBodyBytes,
+// rejecting unknown fields
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// badBody answers a request whose body decodeBody rejected
+func badBody(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("Request body exceeds %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+}
+
+// authResource handles POST /auth/register and POST /auth/login
+func authResource(a *Accounts) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+
+		switch strings.Trim(strings.TrimPrefix(r.URL.Path, "/auth/"), "/") {
+		case "register":
+			var req registerRequest
+			if err := decodeBody(w, r, &req); err != nil {
+				badBody(w, err)
+				return
+			}
+			if err := req.validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			user, err := a.Register(r.Context(), req)
+			if err == errUserExists {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				log.Printf("Error registering user: %v\n", err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusCreated, user)
+
+		case "login":
+			var req loginRequest
+			if err := decodeBody(w, r, &req); err != nil {
+				badBody(w, err)
+				return
+			}
+			user, err := a.Login(r.Context(), req.Username, req.Password)
+			if err == errBadCredentials {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				log.Printf("Error logging in: %v\n", err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			resp, err := a.Token(user)
+			if err != nil {
+				log.Printf("Error issuing token: %v\n", err)
+				http.Error(w, "Error issuing token", http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, resp)
+
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+// userProfile handles GET and PATCH /users/{id}
+func userProfile(a *Accounts, username string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var user User
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			user, err = a.store.User(r.Context(), username)
+		case http.MethodPatch:
+			var upd profileUpdate
+			if err := decodeBody(w, r, &upd); err != nil {
+				badBody(w, err)
+				return
+			}
+			if err := upd.validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			user, err = a.UpdateProfile(r.Context(), username, upd)
+		default:
+			http.Error(w, "GET or PATCH only", http.StatusMethodNotAllowed)
+			return
+		}
+
+		switch err {
+		case nil:
+			writeJSON(w, http.StatusOK, user)
+		case errNotFound:
+			http.NotFound(w, r)
+		case errUserExists:
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errBadCredentials:
+			http.Error(w, "current_password is wrong", http.StatusForbidden)
+		default:
+			log.Printf("Error querying database: %v\n", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+		}
+	}
+}
+
+// savedLocations handles GET /users/{id}/locations and PUT and DELETE
+// /users/{id}/locations/{location_id}
+func savedLocations(a *Accounts, username, locationID string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if locationID == "" {
+			if r.Method != http.MethodGet {
+				http.Error(w, "GET only", http.StatusMethodNotAllowed)
+				return
+			}
+			user, err := a.store.User(r.Context(), username)
+			if err == errNotFound {
+				http.NotFound(w, r)
+				return
+			}
+			if err != nil {
+				log.Printf("Error querying database: %v\n", err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, user.SavedLocations)
+			return
+		}
+
+		if strings.TrimSpace(locationID) == "" || utf8.RuneCountInString(locationID) > maxLocationIDLen {
+			http.Error(w, fmt.Sprintf("location id must be 1 to %d characters", maxLocationIDLen), http.StatusBadRequest)
+			return
+		}
+
+		var err error
+		switch r.Method {
+		case http.MethodPut:
+			err = a.SaveLocation(r.Context(), username, locationID)
+		case http.MethodDelete:
+			err = a.RemoveLocation(r.Context(), username, locationID)
+		default:
+			http.Error(w, "PUT or DELETE only", http.StatusMethodNotAllowed)
+			return
+		}
+		switch err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case errNotFound:
+			http.NotFound(w, r)
+		case errTooManyLocations:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			log.Printf("Error saving location: %v\n", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"golang.org/x/crypto/bcrypt"
+
+	"shared/auth"
+)
+
+// newTestAccounts returns accounts over store that publish to an in-process
+// mock cluster
+func newTestAccounts(t *testing.T, store Store) *Accounts {
+	t.Helper()
+	cfg := defaultConfig()
+	authn, err := auth.New("0123456789abcdef0123456789abcdef", time.Hour, nil)
+	if err != nil {
+		t.Fatalf("auth.New: %v", err)
+	}
+	p, err := kafka.NewProducer(&kafka.ConfigMap{"test.mock.num.brokers": 1})
+	if err != nil {
+		t.Fatalf("NewProducer: %v", err)
+	}
+	t.Cleanup(p.Close)
+	return &Accounts{cfg: &cfg, store: store, authn: authn, producer: p, serializer: newTestSerializer(t), dummyHash: []byte("x")}
+}
+
+// storeEvents writes a fix for "runner", a session for "walker" and a
+// check-in for "visitor"
+func storeEvents(t *testing.T, store Store) {
+	t.Helper()
+	b, err := store.Begin(context.Background())
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	ts := "2026-10-16T10:00:00Z"
+	if _, err := b.InsertCoordinate(CoordinateEvent{UserID: "runner", SessionID: "r1", Lat: 1, Lon: 2, Timestamp: ts}, segment{}, kafkaPosition{"coordinates", 0, 1}); err != nil {
+		t.Fatalf("InsertCoordinate: %v", err)
+	}
+	if err := b.StartSession(SessionEvent{SessionID: "w1", UserID: "walker", Activity: "walking", Timestamp: ts}); err != nil {
+		t.Fatalf("StartSession: %v", err)
+	}
+	if _, err := b.InsertLocation(LocationEvent{UserID: "visitor", Location: "Park", Lat: 1, Lon: 2, Timestamp: ts}, kafkaPosition{"locations", 0, 1}); err != nil {
+		t.Fatalf("InsertLocation: %v", err)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	store := newTestStore(t)
+	storeEvents(t, store)
+	a := newTestAccounts(t, store)
+
+	tests := []struct {
+		name     string
+		username string
+		email    string
+		wantErr  error
+	}{
+		{"new username", "newcomer", "newcomer@example.com", nil},
+		{"username taken", "newcomer", "other@example.com", errUserExists},
+		// Names of users with stored events register without reaching them
+		{"owns coordinates", "runner", "runner@example.com", nil},
+		{"owns a session", "walker", "walker@example.com", nil},
+		{"owns a check-in", "visitor", "visitor@example.com", nil},
+	}
+	boundTo := map[string]bool{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := registerRequest{Username: tt.username, Email: tt.email, Password: "correct horse"}
+			user, err := a.Register(context.Background(), req)
+			if err != tt.wantErr {
+				t.Fatalf("Register error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if user.Role != auth.RoleUser {
+				t.Errorf("registered with role %q, want %q", user.Role, auth.RoleUser)
+			}
+			stored, err := store.User(context.Background(), tt.username)
+			if err != nil {
+				t.Fatalf("User: %v", err)
+			}
+			if stored.UserID != user.UserID || user.UserID == tt.username || boundTo[user.UserID] {
+				t.Errorf("bound to user_id %q (stored %q), want a new one", user.UserID, stored.UserID)
+			}
+			boundTo[user.UserID] = true
+		})
+	}
+}
+
+func TestBindUser(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	for _, name := range []string{"alice", "bob"} {
+		user := User{Username: name, UserID: "u-" + name, Email: name + "@example.com", Role: auth.RoleUser, PasswordHash: "x", CreatedAt: "2026-10-16T10:00:00Z"}
+		if err := store.InsertUser(ctx, user); err != nil {
+			t.Fatalf("InsertUser: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		userID   string
+		wantErr  error
+	}{
+		{"simulated user", "alice", "runner", nil},
+		{"bound to another account", "bob", "runner", errUserIDBound},
+		{"another account's own", "bob", "u-alice", nil},
+		{"unknown account", "nobody", "walker", errNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := store.BindUser(ctx, tt.username, tt.userID); err != tt.wantErr {
+				t.Fatalf("BindUser error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			user, err := store.User(ctx, tt.username)
+			if err != nil || user.UserID != tt.userID {
+				t.Errorf("user_id %q, %v; want %q", user.UserID, err, tt.userID)
+			}
+		})
+	}
+}
+
+func TestTokenCarriesStoredRole(t *testing.T) {
+	store := newTestStore(t)
+	a := newTestAccounts(t, store)
+	ctx := context.Background()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err := store.InsertUser(ctx, User{Username: "alice", Email: "alice@example.com", Role: auth.RoleUser, PasswordHash: string(hash), CreatedAt: "2026-10-16T10:00:00Z"}); err != nil {
+		t.Fatalf("InsertUser: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		setRole string
+		want    string
+	}{
+		{"registered", "", auth.RoleUser},
+		{"granted admin", auth.RoleAdmin, auth.RoleAdmin},
+		{"revoked", auth.RoleUser, auth.RoleUser},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.setRole != "" {
+				if err := store.SetRole(ctx, "alice", tt.setRole); err != nil {
+					t.Fatalf("SetRole: %v", err)
+				}
+			}
+			user, err := a.Login(ctx, "alice", "correct horse")
+			if err != nil {
+				t.Fatalf("Login: %v", err)
+			}
+			resp, err := a.Token(user)
+			if err != nil {
+				t.Fatalf("Token: %v", err)
+			}
+			p, err := a.authn.Verify(resp.Token)
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if resp.Role != tt.want || p.Role != tt.want {
+				t.Errorf("role %q, token role %q, want %q", resp.Role, p.Role, tt.want)
+			}
+		})
+	}
+
+	if err := store.SetRole(ctx, "nobody", auth.RoleAdmin); err != errNotFound {
+		t.Errorf("SetRole of an unknown user = %v, want errNotFound", err)
+	}
+}
+
+func TestAuthResourceBodyLimit(t *testing.T) {
+	a := newTestAccounts(t, newTestStore(t))
+	handler := authResource(a)
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"not JSON", "{", http.StatusBadRequest},
+		{"unknown field", `{"username":"newcomer","admin":true}`, http.StatusBadRequest},
+		{"too large", `{"username":"` + strings.Repeat("a", maxBodyBytes) + `"}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/auth/register", strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenFollowsAccount(t *testing.T) {
+	store := newTestStore(t)
+	a := newTestAccounts(t, store)
+	a.authn.ResolveAccounts(a.Resolve)
+	ctx := context.Background()
+
+	user := User{Username: "alice", UserID: "u-alice", Email: "alice@example.com", Role: auth.RoleAdmin, PasswordHash: "x", CreatedAt: "2026-10-16T10:00:00Z"}
+	if err := store.InsertUser(ctx, user); err != nil {
+		t.Fatalf("InsertUser: %v", err)
+	}
+	resp, err := a.Token(user)
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+
+	var seen auth.Principal
+	h := a.authn.Require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = auth.FromContext(r.Context())
+	}))
+	call := func() int {
+		r := httptest.NewRequest(http.MethodGet, "/events", nil)
+		r.Header.Set("Authorization", "Bearer "+resp.Token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := call(); code != http.StatusOK || seen.Role != auth.RoleAdmin || seen.UserID != "u-alice" {
+		t.Fatalf("before: status %d as %+v, want admin u-alice", code, seen)
+	}
+
+	// The demotion and the new binding apply to the token already issued
+	if err := store.SetRole(ctx, "alice", auth.RoleUser); err != nil {
+		t.Fatalf("SetRole: %v", err)
+	}
+	if err := store.BindUser(ctx, "alice", "runner"); err != nil {
+		t.Fatalf("BindUser: %v", err)
+	}
+	want := auth.Principal{UserID: "runner", Role: auth.RoleUser, Account: "alice"}
+	if code := call(); code != http.StatusOK || seen != want {
+		t.Errorf("after: status %d as %+v, want %+v", code, seen, want)
+	}
+}
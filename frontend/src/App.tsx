@@ -1,6 +1,17 @@
 import React, { useEffect, useState } from "react";
 import styled from "styled-components";
 
+const API_URL = "http://localhost:8082";
+
+// The dashboard signs in with POST /auth/login and keeps the token in memory
+// only, so no credential is built into the bundle; see "Authentication" in
+// the README
+type Session = {
+  token: string;
+  username: string;
+  role: string;
+};
+
 type Event = {
   user_id: string;
   lat: number;
@@ -75,20 +86,132 @@ const Select = styled.select`
   }
 `;
 
+const LoginForm = styled.form`
+  display: flex;
+  gap: 10px;
+  flex-wrap: wrap;
+  margin-bottom: 20px;
+`;
+
+const Input = styled.input`
+  padding: 8px;
+  border-radius: 4px;
+  border: 1px solid #bdc3c7;
+  font-size: 1em;
+  color: #2c3e50;
+
+  &:focus {
+    outline: none;
+    border-color: #3498db;
+  }
+`;
+
+const Button = styled.button`
+  padding: 8px 16px;
+  border-radius: 4px;
+  border: none;
+  background: #3498db;
+  color: white;
+  font-size: 1em;
+  cursor: pointer;
+`;
+
+const SignedIn = styled.div`
+  display: flex;
+  align-items: center;
+  gap: 10px;
+  color: #7f8c8d;
+  margin-bottom: 20px;
+`;
+
+const ErrorText = styled.div`
+  color: #c0392b;
+  margin-bottom: 20px;
+`;
+
+function Login({ onLogin }: { onLogin: (session: Session) => void }) {
+  const [username, setUsername] = useState("");
+  const [password, setPassword] = useState("");
+  const [error, setError] = useState("");
+
+  const submit = async (e: React.FormEvent) => {
+    e.preventDefault();
+    setError("");
+    try {
+      const response = await fetch(`${API_URL}/auth/login`, {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({ username, password }),
+      });
+      if (!response.ok) {
+        setError((await response.text()).trim());
+        return;
+      }
+      const data = await response.json();
+      onLogin({ token: data.token, username: data.user.username, role: data.role });
+    } catch (err) {
+      setError("Could not reach the consumer API");
+    }
+  };
+
+  return (
+    <>
+      <LoginForm onSubmit={submit}>
+        <Input
+          placeholder="Username"
+          autoComplete="username"
+          value={username}
+          onChange={(e) => setUsername(e.target.value)}
+        />
+        <Input
+          type="password"
+          placeholder="Password"
+          autoComplete="current-password"
+          value={password}
+          onChange={(e) => setPassword(e.target.value)}
+        />
+        <Button type="submit">Sign in</Button>
+      </LoginForm>
+      {error && <ErrorText>{error}</ErrorText>}
+    </>
+  );
+}
+
 function App() {
+  const [session, setSession] = useState<Session | null>(null);
   const [events, setEvents] = useState<Event[]>([]);
   const [selectedUser, setSelectedUser] = useState<string>("");
   const [users, setUsers] = useState<Set<string>>(new Set());
 
+  // Forget the previous user's events on signing out
+  useEffect(() => {
+    if (!session) {
+      setEvents([]);
+      setUsers(new Set());
+      setSelectedUser("");
+    }
+  }, [session]);
+
   // Fetch events periodically
   useEffect(() => {
+    if (!session) {
+      return;
+    }
+
     const fetchEvents = async () => {
       try {
         const url = selectedUser
-          ? `http://localhost:8082/events?user_id=${selectedUser}&limit=50`
-          : "http://localhost:8082/events?limit=50";
-        
-        const response = await fetch(url);
+          ? `${API_URL}/events?user_id=${encodeURIComponent(selectedUser)}&limit=50`
+          : `${API_URL}/events?limit=50`;
+
+        const response = await fetch(url, {
+          headers: { Authorization: `Bearer ${session.token}` },
+        });
+        if (response.status === 401) {
+          // The token has expired: sign in again
+          setSession(null);
+          return;
+        }
         const data = await response.json();
         setEvents(data);
 
@@ -109,12 +232,29 @@ function App() {
 
     // Cleanup
     return () => clearInterval(interval);
-  }, [selectedUser]);
+  }, [session, selectedUser]);
+
+  if (!session) {
+    return (
+      <Container>
+        <Title>🌍 Garmin Mock</Title>
+        <Login onLogin={setSession} />
+      </Container>
+    );
+  }
 
   return (
     <Container>
       <Title>🌍 Garmin Mock</Title>
-      
+
+      <SignedIn>
+        <span>
+          Signed in as <UserName>{session.username}</UserName>
+          {session.role === "admin" && " (admin)"}
+        </span>
+        <Button onClick={() => setSession(null)}>Sign out</Button>
+      </SignedIn>
+
       <UserFilter>
         <Select 
           value={selectedUser} 
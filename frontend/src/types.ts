@@ -1,14 +1,20 @@
+// Event shapes follow the contract in shared/events (JSON Schemas are served
+// by the consumer under /schemas/). Fields added later are optional.
+
 export interface CoordinateEvent {
+  schema_version?: number;
   user_id: string;
-  session_id: string;
+  session_id?: string;
   lat: number;
   lon: number;
   timestamp: string;
+  ele?: number;
 }
 
 export interface LocationEvent {
+  schema_version?: number;
   user_id: string;
-  session_id: string;
+  session_id?: string;
   location: string;
   lat: number;
   lon: number;
@@ -1,7 +1,7 @@
 #!/bin/bash
 
 # List of topics to create
-TOPICS=("coordinates" "locations" "users")
+TOPICS=("coordinates" "locations" "sessions" "users" "coordinates.dlq")
 
 # Kafka container name (matches docker-compose.yml)
 CONTAINER_NAME="kafka"
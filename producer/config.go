@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	kafka "github.com/confluentinc/confluent-kafka-go/v2/kafka"
+
+	"shared/auth"
+	"shared/events"
+)
+
+// Config holds the producer's runtime settings. See shared/config for how
+// flags, environment variables and the optional config file are applied.
+type Config struct {
+	Broker           string            `json:"broker" env:"KAFKA_BOOTSTRAP" flag:"broker" usage:"Kafka bootstrap servers"`
+	CoordinatesTopic string            `json:"coordinates_topic" env:"COORDINATES_TOPIC" flag:"coordinates-topic" usage:"topic for CoordinateEvents"`
+	LocationsTopic   string            `json:"locations_topic" env:"LOCATIONS_TOPIC" flag:"locations-topic" usage:"topic for LocationEvents"`
+	SessionsTopic    string            `json:"sessions_topic" env:"SESSIONS_TOPIC" flag:"sessions-topic" usage:"topic for session start/end events"`
+	EventFormat      string            `json:"event_format" env:"EVENT_FORMAT" flag:"event-format" usage:"wire format of published events: json, protobuf or avro"`
+	SchemaRegistry   string            `json:"schema_registry" env:"SCHEMA_REGISTRY" flag:"schema-registry" usage:"JSON file holding registered Protobuf/Avro schemas (in memory if unset)"`
+	ProduceMode      string            `json:"produce_mode" env:"PRODUCE_MODE" flag:"produce-mode" usage:"default delivery mode of POST /produce: sync waits for the broker, async answers 202"`
+	ProduceTimeout   time.Duration     `json:"produce_timeout" env:"PRODUCE_TIMEOUT" flag:"produce-timeout" usage:"how long a sync POST /produce waits for its delivery report"`
+	HTTPAddr         string            `json:"http_addr" env:"HTTP_ADDR" flag:"http-addr" usage:"HTTP listen address"`
+	AuthKey          string            `json:"auth_key" env:"AUTH_KEY" flag:"auth-key" usage:"key verifying API tokens, the consumer's auth_key" secret:"true"`
+	APIKeys          map[string]string `json:"api_keys" env:"API_KEYS" flag:"api-keys" usage:"static API keys as key=user_id[:role],key=user_id[:role]" secret:"true"`
+	CORSOrigins      []string          `json:"cors_origins" env:"CORS_ORIGINS" flag:"cors-origins" usage:"origins allowed to call the API from a browser (* for any)"`
+	UsersFile        string            `json:"users_file" env:"USERS_FILE" flag:"users" usage:"YAML or JSON roster of simulated users (reloaded on SIGHUP)"`
+	PlacesFile       string            `json:"places_file" env:"PLACES_FILE" flag:"places" usage:"CSV or GeoJSON gazetteer used to name LocationEvents (bundled places if unset)"`
+	PlaceRadius      float64           `json:"place_radius_m" env:"PLACE_RADIUS_M" flag:"place-radius" usage:"how close, in metres, a fix must be to a place to emit a LocationEvent"`
+	Seed             int64             `json:"seed" env:"SIM_SEED" flag:"seed" usage:"movement model seed, for reproducible tracks"`
+	ShutdownTimeout  time.Duration     `json:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" flag:"shutdown-timeout" usage:"how long shutdown waits for HTTP requests and undelivered messages"`
+	KafkaOverrides   map[string]string `json:"kafka_overrides" env:"KAFKA_CONFIG" flag:"kafka-config" usage:"extra librdkafka settings as key=value,key=value"`
+}
+
+// defaultConfig returns the settings used when nothing is overridden
+func defaultConfig() Config {
+	return Config{
+		Broker:           "localhost:9094", // External broker address
+		CoordinatesTopic: "coordinates",
+		LocationsTopic:   "locations",
+		SessionsTopic:    "sessions",
+		EventFormat:      events.FormatJSON,
+		ProduceMode:      ProduceSync,
+		ProduceTimeout:   5 * time.Second,
+		HTTPAddr:         ":8081",
+		APIKeys:          map[string]string{},
+		CORSOrigins:      []string{"http://localhost:3000"},
+		PlaceRadius:      750,
+		Seed:             1,
+		ShutdownTimeout:  10 * time.Second,
+		KafkaOverrides:   map[string]string{},
+	}
+}
+
+// Validate checks that required settings are present and distinct
+func (c *Config) Validate() error {
+	required := []struct{ name, value string }{
+		{"broker", c.Broker},
+		{"coordinates_topic", c.CoordinatesTopic},
+		{"locations_topic", c.LocationsTopic},
+		{"sessions_topic", c.SessionsTopic},
+		{"http_addr", c.HTTPAddr},
+	}
+	for _, r := range required {
+		if r.value == "" {
+			return fmt.Errorf("%s must not be empty", r.name)
+		}
+	}
+
+	// POST /produce needs a token or an API key, so at least one must be verifiable
+	if c.AuthKey == "" && len(c.APIKeys) == 0 {
+		return fmt.Errorf("auth_key or api_keys must be set")
+	}
+	if c.AuthKey != "" && len(c.AuthKey) < auth.MinKeyLen {
+		return fmt.Errorf("auth_key must be at least %d bytes", auth.MinKeyLen)
+	}
+
+	if !events.ValidFormat(c.EventFormat) {
+		return fmt.Errorf("event_format must be one of %s", strings.Join(events.Formats, ", "))
+	}
+
+	if c.ProduceMode != ProduceSync && c.ProduceMode != ProduceAsync {
+		return fmt.Errorf("produce_mode must be %q or %q", ProduceSync, ProduceAsync)
+	}
+	if c.ProduceTimeout <= 0 {
+		return fmt.Errorf("produce_timeout must be positive")
+	}
+
+	if c.PlaceRadius <= 0 {
+		return fmt.Errorf("place_radius_m must be positive")
+	}
+
+	if c.ShutdownTimeout <= 0 {
+		return fmt.Errorf("shutdown_timeout must be positive")
+	}
+
+	if c.CoordinatesTopic == c.LocationsTopic || c.CoordinatesTopic == c.SessionsTopic || c.LocationsTopic == c.SessionsTopic {
+		return fmt.Errorf("coordinates, locations and sessions topics must be distinct")
+	}
+	return nil
+}
+
+// kafkaConfig builds the librdkafka configuration, applying overrides last
+func (c *Config) kafkaConfig() *kafka.ConfigMap {
+	cm := &kafka.ConfigMap{
+		"bootstrap.servers": c.Broker,
+	}
+	for k, v := range c.KafkaOverrides {
+		cm.SetKey(k, v)
+	}
+	return cm
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Minimal Garmin FIT decoder: it walks the record stream and extracts the
+// timestamp, position and altitude fields of "record" messages, skipping
+// everything else.
+
+const (
+	fitRecordMesg     = 20  // global message number of a GPS record
+	fitFieldLat       = 0   // position_lat, sint32 semicircles
+	fitFieldLon       = 1   // position_long, sint32 semicircles
+	fitFieldAltitude  = 2   // altitude, uint16 (m + 500) * 5
+	fitFieldEnhAlt    = 78  // enhanced_altitude, uint32 with the same scale
+	fitFieldTimestamp = 253 // uint32 seconds since the FIT epoch
+	fitInvalidSint32  = 0x7FFFFFFF
+	fitInvalidUint32  = 0xFFFFFFFF
+	fitInvalidUint16  = 0xFFFF
+)
+
+// fitEpoch is the zero point of FIT timestamps (1989-12-31T00:00:00Z)
+var fitEpoch = time.Date(1989, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+// fitFieldDef describes one field of a FIT definition message
+type fitFieldDef struct {
+	num  byte
+	size byte
+}
+
+// fitDefinition describes the layout of data messages for a local message type
+type fitDefinition struct {
+	global    uint16
+	order     binary.ByteOrder
+	fields    []fitFieldDef
+	devFields []fitFieldDef
+}
+
+// parseFIT reads the GPS record messages from a FIT activity file
+func parseFIT(path string) ([]TrackPoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 12 {
+		return nil, fmt.Errorf("fit: file too short")
+	}
+
+	headerSize := int(data[0])
+	if headerSize < 12 || len(data) < headerSize || string(data[8:12]) != ".FIT" {
+		return nil, fmt.Errorf("fit: invalid file header")
+	}
+	dataSize := int(binary.LittleEndian.Uint32(data[4:8]))
+	if len(data) < headerSize+dataSize {
+		return nil, fmt.Errorf("fit: truncated file")
+	}
+
+	r := bytes.NewReader(data[headerSize : headerSize+dataSize])
+	defs := map[byte]*fitDefinition{}
+	points := []TrackPoint{}
+	var lastTimestamp uint32
+
+	for r.Len() > 0 {
+		header, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		// Compressed timestamp header: data message with a 5-bit time offset
+		if header&0x80 != 0 {
+			local := (header >> 5) & 0x03
+			offset := uint32(header & 0x1F)
+			ts := lastTimestamp&^0x1F + offset
+			if offset < lastTimestamp&0x1F {
+				ts += 0x20
+			}
+			lastTimestamp = ts
+
+			def, ok := defs[local]
+			if !ok {
+				return nil, fmt.Errorf("fit: data for undefined local message %d", local)
+			}
+			point, ok, err := readFITData(r, def, &lastTimestamp, true)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				points = append(points, point)
+			}
+			continue
+		}
+
+		local := header & 0x0F
+		if header&0x40 != 0 {
+			def, err := readFITDefinition(r, header&0x20 != 0)
+			if err != nil {
+				return nil, err
+			}
+			defs[local] = def
+			continue
+		}
+
+		def, ok := defs[local]
+		if !ok {
+			return nil, fmt.Errorf("fit: data for undefined local message %d", local)
+		}
+		point, ok, err := readFITData(r, def, &lastTimestamp, false)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			points = append(points, point)
+		}
+	}
+
+	return points, nil
+}
+
+// readFITDefinition reads a definition message body
+func readFITDefinition(r *bytes.Reader, hasDevFields bool) (*fitDefinition, error) {
+	fixed := make([]byte, 5)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, fmt.Errorf("fit: truncated definition: %w", err)
+	}
+
+	def := &fitDefinition{order: binary.LittleEndian}
+	if fixed[1] == 1 {
+		def.order = binary.BigEndian
+	}
+	def.global = def.order.Uint16(fixed[2:4])
+
+	readFields := func(n int) ([]fitFieldDef, error) {
+		fields := make([]fitFieldDef, n)
+		buf := make([]byte, 3)
+		for i := range fields {
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return nil, fmt.Errorf("fit: truncated field definition: %w", err)
+			}
+			fields[i] = fitFieldDef{num: buf[0], size: buf[1]}
+		}
+		return fields, nil
+	}
+
+	var err error
+	if def.fields, err = readFields(int(fixed[4])); err != nil {
+		return nil, err
+	}
+
+	if hasDevFields {
+		n, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("fit: truncated definition: %w", err)
+		}
+		if def.devFields, err = readFields(int(n)); err != nil {
+			return nil, err
+		}
+	}
+	return def, nil
+}
+
+// readFITData reads a data message and returns a track point if it is a GPS
+// record with a valid position. compressed reports that the timestamp came
+// from the record header rather than a field.
+func readFITData(r *bytes.Reader, def *fitDefinition, lastTimestamp *uint32, compressed bool) (TrackPoint, bool, error) {
+	var (
+		lat, lon     int32 = fitInvalidSint32, fitInvalidSint32
+		timestamp          = *lastTimestamp
+		hasTimestamp       = compressed
+		altitude     *float64
+		enhanced     bool // enhanced_altitude wins over altitude
+	)
+
+	for _, f := range def.fields {
+		buf := make([]byte, f.size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return TrackPoint{}, false, fmt.Errorf("fit: truncated data message: %w", err)
+		}
+		if f.size == 2 && f.num == fitFieldAltitude && def.global == fitRecordMesg && !enhanced {
+			if v := def.order.Uint16(buf); v != fitInvalidUint16 {
+				altitude = fitAltitude(uint32(v))
+			}
+			continue
+		}
+		if f.size != 4 {
+			continue
+		}
+
+		switch f.num {
+		case fitFieldTimestamp:
+			if v := def.order.Uint32(buf); v != fitInvalidUint32 {
+				timestamp = v
+				hasTimestamp = true
+				*lastTimestamp = v
+			}
+		case fitFieldLat:
+			if def.global == fitRecordMesg {
+				lat = int32(def.order.Uint32(buf))
+			}
+		case fitFieldLon:
+			if def.global == fitRecordMesg {
+				lon = int32(def.order.Uint32(buf))
+			}
+		case fitFieldEnhAlt:
+			if v := def.order.Uint32(buf); def.global == fitRecordMesg && v != fitInvalidUint32 {
+				altitude = fitAltitude(v)
+				enhanced = true
+			}
+		}
+	}
+
+	for _, f := range def.devFields {
+		if _, err := r.Seek(int64(f.size), io.SeekCurrent); err != nil {
+			return TrackPoint{}, false, err
+		}
+	}
+
+	if def.global != fitRecordMesg || lat == fitInvalidSint32 || lon == fitInvalidSint32 {
+		return TrackPoint{}, false, nil
+	}
+
+	point := TrackPoint{
+		Lat: semicirclesToDegrees(lat),
+		Lon: semicirclesToDegrees(lon),
+		Ele: altitude,
+	}
+	if hasTimestamp {
+		point.Time = fitEpoch.Add(time.Duration(timestamp) * time.Second)
+	}
+	return point, true, nil
+}
+
+// fitAltitude converts a scaled FIT altitude to metres
+func fitAltitude(v uint32) *float64 {
+	m := float64(v)/5 - 500
+	return &m
+}
+
+// semicirclesToDegrees converts a FIT semicircle value to degrees
+func semicirclesToDegrees(v int32) float64 {
+	return float64(v) * (180.0 / (1 << 31))
+}
@@ -1,83 +1,78 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"flag"
 	"log"
-	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	kafka "github.com/confluentinc/confluent-kafka-go/v2/kafka"
+
+	"shared/auth"
+	"shared/config"
+	"shared/events"
+	"shared/health"
+	"shared/metrics"
 )
 
 const (
-	KafkaBroker = "localhost:9094" // External broker address
+	EmitInterval = 5 * time.Second // Time between simulated GPS fixes
 )
 
 // User represents a user with their base location
 type User struct {
-	ID   string   `json:"id"`
-	Name string   `json:"name"`
-	Base Location `json:"base"`
+	ID       string   `json:"id" yaml:"id"`
+	Name     string   `json:"name" yaml:"name"`
+	Base     Location `json:"base" yaml:"base"`
+	Activity string   `json:"activity" yaml:"activity"`
+	Interval Duration `json:"interval" yaml:"interval"` // time between GPS fixes, EmitInterval if unset
 }
 
 // Location represents a geographical point
 type Location struct {
-	Lat float64 `json:"lat"`
-	Lon float64 `json:"lon"`
+	Lat float64 `json:"lat" yaml:"lat"`
+	Lon float64 `json:"lon" yaml:"lon"`
 }
 
 // CoordinateEvent represents a GPS coordinate event
-type CoordinateEvent struct {
-	UserID    string  `json:"user_id"`
-	SessionID string  `json:"session_id"`
-	Lat       float64 `json:"lat"`
-	Lon       float64 `json:"lon"`
-	Timestamp string  `json:"timestamp"`
-}
+type CoordinateEvent = events.CoordinateEvent
 
 // LocationEvent represents a location update event
-type LocationEvent struct {
-	UserID    string  `json:"user_id"`
-	SessionID string  `json:"session_id"`
-	Location  string  `json:"location"`
-	Lat       float64 `json:"lat"`
-	Lon       float64 `json:"lon"`
-	Timestamp string  `json:"timestamp"`
-}
+type LocationEvent = events.LocationEvent
 
 // Global variables
 var (
 	producer *kafka.Producer
+	cfg      = defaultConfig()
 	users    = []User{
-		{ID: "Ashish", Name: "Ashish", Base: Location{Lat: 40.7128, Lon: -74.0060}},    // NYC
-		{ID: "Saranya", Name: "Saranya", Base: Location{Lat: 34.0522, Lon: -118.2437}}, // LA
-		{ID: "Cookie", Name: "Cookie", Base: Location{Lat: 51.5074, Lon: -0.1278}},     // London
+		{ID: "Ashish", Name: "Ashish", Base: Location{Lat: 40.7128, Lon: -74.0060}, Activity: "running"},    // NYC
+		{ID: "Saranya", Name: "Saranya", Base: Location{Lat: 34.0522, Lon: -118.2437}, Activity: "cycling"}, // LA
+		{ID: "Cookie", Name: "Cookie", Base: Location{Lat: 51.5074, Lon: -0.1278}, Activity: "walking"},     // London
 	}
-	locations = []string{"Park", "Trailhead", "Downtown", "Beach"}
-)
 
-// generateCoordinate simulates small random movement around base location
-func generateCoordinate(base Location) Location {
-	return Location{
-		Lat: base.Lat + rand.Float64()*0.02 - 0.01, // +/- 0.01 degrees
-		Lon: base.Lon + rand.Float64()*0.02 - 0.01,
-	}
-}
+	// Encodes events in the configured wire format
+	serializer *events.Serializer
+
+	// Named places that LocationEvents are resolved against
+	gazetteer *Gazetteer
+
+	// Failed deliveries of messages no /produce caller was told about; the
+	// ones that fail while flushing at shutdown make the exit status non-zero
+	lostDeliveries atomic.Int64
+)
 
 // deliveryReport handles delivery reports from Kafka producer
 func deliveryReport(producer *kafka.Producer) {
 	for e := range producer.Events() {
 		switch ev := e.(type) {
 		case *kafka.Message:
-			if ev.TopicPartition.Error != nil {
-				log.Printf("❌ Delivery failed for record: %v\n", ev.TopicPartition.Error)
-			} else {
-				log.Printf("✅ Message produced to %v [%d] @ offset %v\n",
-					*ev.TopicPartition.Topic, ev.TopicPartition.Partition, ev.TopicPartition.Offset)
+			if recordDelivery(ev) != nil {
+				lostDeliveries.Add(1)
 			}
 		case kafka.Error:
 			log.Printf("❌ Kafka error: %v\n", ev)
@@ -87,172 +82,397 @@ func deliveryReport(producer *kafka.Producer) {
 	}
 }
 
-// generateEvents continuously generates GPS events
-func generateEvents(producer *kafka.Producer, done chan bool) {
+// recordDelivery counts and logs the delivery report of one message and
+// returns its delivery error
+func recordDelivery(msg *kafka.Message) error {
+	topic := ""
+	if msg.TopicPartition.Topic != nil {
+		topic = *msg.TopicPartition.Topic
+	}
+	if msg.TopicPartition.Error != nil {
+		messagesFailed.Inc(topic)
+		log.Printf("❌ Delivery failed for record: %v\n", msg.TopicPartition.Error)
+		return msg.TopicPartition.Error
+	}
+	messagesDelivered.Inc(topic)
+	log.Printf("✅ Message produced to %v [%d] @ offset %v\n",
+		topic, msg.TopicPartition.Partition, msg.TopicPartition.Offset)
+	return nil
+}
+
+// simUser holds the live simulation state of one roster user
+type simUser struct {
+	user    User
+	mover   *Mover
+	session *Session
+	next    time.Time
+}
+
+// userInterval returns how often a user emits a GPS fix
+func userInterval(u User) time.Duration {
+	if u.Interval > 0 {
+		return time.Duration(u.Interval)
+	}
+	return EmitInterval
+}
+
+// generateEvents continuously generates GPS events, emitting a fix for each
+// user on that user's own interval. A new roster received on reload replaces
+// the simulated users without restarting the tracks of unchanged users.
+func generateEvents(ctx context.Context, producer *kafka.Producer, reload <-chan []User) {
 	log.Printf("🌍 Starting GPS event generation for %d users\n", len(users))
+
+	seed := cfg.Seed
+	sims := map[string]*simUser{}
+
+	applyRoster := func(roster []User) {
+		now := time.Now()
+		keep := make(map[string]bool, len(roster))
+		for _, user := range roster {
+			keep[user.ID] = true
+			if sim, ok := sims[user.ID]; ok && sim.user.Base == user.Base && sim.user.Activity == user.Activity {
+				// Same track; just pick up name or interval changes
+				sim.user = user
+				continue
+			}
+			if sim, ok := sims[user.ID]; ok && sim.session != nil {
+				endSession(producer, sim.user, sim.session, now)
+			}
+			// One movement model per user so each track is continuous
+			sims[user.ID] = &simUser{user: user, mover: NewMover(user, seed), next: now}
+		}
+		for id, sim := range sims {
+			if !keep[id] {
+				if sim.session != nil {
+					endSession(producer, sim.user, sim.session, now)
+				}
+				delete(sims, id)
+			}
+		}
+	}
+	applyRoster(users)
+
 	for {
+		// Sleep until the next user is due
+		wait := time.Hour
+		now := time.Now()
+		for _, sim := range sims {
+			if d := sim.next.Sub(now); d < wait {
+				wait = d
+			}
+		}
+		timer := time.NewTimer(wait)
+
 		select {
-		case <-done:
+		case <-ctx.Done():
+			timer.Stop()
+			// Close out any activity still in progress
+			for _, sim := range sims {
+				if sim.session != nil {
+					endSession(producer, sim.user, sim.session, time.Now())
+				}
+			}
+			producer.Flush(0)
 			log.Println("🛑 Stopping GPS event generation")
 			return
-		default:
-			for _, user := range users {
-				// Generate new coordinate
-				pos := generateCoordinate(user.Base)
-				now := time.Now().UTC().Format(time.RFC3339)
-
-				// Create coordinate event
-				coordEvent := CoordinateEvent{
-					UserID:    user.ID,
-					SessionID: "s1",
-					Lat:       pos.Lat,
-					Lon:       pos.Lon,
-					Timestamp: now,
-				}
-
-				// Serialize to JSON
-				coordData, err := json.Marshal(coordEvent)
-				if err != nil {
-					log.Printf("Error marshaling coordinate event: %v\n", err)
+		case roster := <-reload:
+			timer.Stop()
+			applyRoster(roster)
+			log.Printf("🔄 Roster reloaded: simulating %d users\n", len(sims))
+		case now := <-timer.C:
+			for _, sim := range sims {
+				if sim.next.After(now) {
 					continue
 				}
+				emitFix(producer, sim, now)
 
-				// Produce coordinate event
-				err = producer.Produce(&kafka.Message{
-					TopicPartition: kafka.TopicPartition{Topic: &[]string{"coordinates"}[0], Partition: kafka.PartitionAny},
-					Key:            []byte(user.ID),
-					Value:          coordData,
-				}, nil)
-
-				if err != nil {
-					log.Printf("Error producing coordinate event: %v\n", err)
-				}
-
-				// Occasionally emit a location event (10% chance)
-				if rand.Float64() < 0.1 {
-					locEvent := LocationEvent{
-						UserID:    user.ID,
-						SessionID: "s1",
-						Location:  locations[rand.Intn(len(locations))],
-						Lat:       pos.Lat,
-						Lon:       pos.Lon,
-						Timestamp: now,
-					}
-
-					// Serialize to JSON
-					locData, err := json.Marshal(locEvent)
-					if err != nil {
-						log.Printf("Error marshaling location event: %v\n", err)
-						continue
-					}
-
-					// Produce location event
-					err = producer.Produce(&kafka.Message{
-						TopicPartition: kafka.TopicPartition{Topic: &[]string{"locations"}[0], Partition: kafka.PartitionAny},
-						Key:            []byte(user.ID),
-						Value:          locData,
-					}, nil)
-
-					if err != nil {
-						log.Printf("Error producing location event: %v\n", err)
-					}
+				// Skip ahead rather than bursting if we fell behind
+				sim.next = sim.next.Add(userInterval(sim.user))
+				if sim.next.Before(now) {
+					sim.next = now.Add(userInterval(sim.user))
 				}
-
-				// Trigger delivery report callbacks
-				producer.Flush(0)
 			}
 
-			// Wait before next iteration
-			time.Sleep(5 * time.Second)
+			// Trigger delivery report callbacks
+			producer.Flush(0)
 		}
 	}
 }
 
-func main() {
-	log.Println("🚀 Starting GPS event producer...")
+// emitFix advances a user's movement model and publishes the resulting
+// coordinate, plus an occasional location event and session lifecycle events
+func emitFix(producer *kafka.Producer, sim *simUser, at time.Time) {
+	user := sim.user
 
-	// Initialize random seed
-	rand.Seed(time.Now().UnixNano())
+	// Start a new activity session if the user is idle
+	if sim.session == nil {
+		sim.session = startSession(producer, user, sim.mover.rng, at)
+	}
+	session := sim.session
+
+	// Generate new coordinate
+	pos := sim.mover.Step(userInterval(user))
+	now := at.UTC().Format(time.RFC3339)
+
+	// End the session once the activity has run its course
+	defer func() {
+		session.Remaining--
+		if session.Remaining <= 0 {
+			endSession(producer, user, session, at)
+			sim.session = nil
+		}
+	}()
 
-	// Initialize Kafka producer
-	var err error
-	producer, err = kafka.NewProducer(&kafka.ConfigMap{
-		"bootstrap.servers": KafkaBroker,
-	})
-	if err != nil {
-		log.Fatal("Failed to create producer:", err)
+	// Create coordinate event
+	coordEvent := CoordinateEvent{
+		UserID:    user.ID,
+		SessionID: session.ID,
+		Lat:       pos.Lat,
+		Lon:       pos.Lon,
+		Timestamp: now,
 	}
-	defer producer.Close()
 
-	// Start delivery report handler
-	go deliveryReport(producer)
+	// Serialize in the configured format
+	coordData, err := serializer.Marshal(&coordEvent)
+	if err != nil {
+		log.Printf("Error marshaling coordinate event: %v\n", err)
+		return
+	}
 
-	// Channel to signal goroutine to stop
-	done := make(chan bool)
+	// Produce coordinate event
+	err = produce(producer, &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &cfg.CoordinatesTopic, Partition: kafka.PartitionAny},
+		Key:            []byte(user.ID),
+		Value:          coordData,
+	}, nil)
 
-	// Start GPS event generator
-	go generateEvents(producer, done)
+	if err != nil {
+		log.Printf("Error producing coordinate event: %v\n", err)
+	}
 
-	// Setup HTTP endpoints
-	http.HandleFunc("/produce", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+	// Occasionally emit a location event (10% chance) naming the nearest place
+	if sim.mover.rng.Float64() < 0.1 {
+		place, _, ok := gazetteer.Nearest(pos, cfg.PlaceRadius)
+		if !ok {
+			// Nowhere named nearby; nothing to check in at
 			return
 		}
+		locEvent := LocationEvent{
+			UserID:    user.ID,
+			SessionID: session.ID,
+			Location:  place.Name,
+			Lat:       pos.Lat,
+			Lon:       pos.Lon,
+			Timestamp: now,
+		}
 
-		var event CoordinateEvent
-		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		// Serialize in the configured format
+		locData, err := serializer.Marshal(&locEvent)
+		if err != nil {
+			log.Printf("Error marshaling location event: %v\n", err)
 			return
 		}
 
-		// Set timestamp if not provided
-		if event.Timestamp == "" {
-			event.Timestamp = time.Now().UTC().Format(time.RFC3339)
-		}
+		// Produce location event
+		err = produce(producer, &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &cfg.LocationsTopic, Partition: kafka.PartitionAny},
+			Key:            []byte(user.ID),
+			Value:          locData,
+		}, nil)
 
-		// Serialize event
-		data, err := json.Marshal(event)
 		if err != nil {
-			http.Error(w, "Error serializing event", http.StatusInternalServerError)
-			return
+			log.Printf("Error producing location event: %v\n", err)
 		}
+	}
+}
 
-		// Produce to Kafka
-		err = producer.Produce(&kafka.Message{
-			TopicPartition: kafka.TopicPartition{Topic: &[]string{"coordinates"}[0], Partition: kafka.PartitionAny},
-			Key:            []byte(event.UserID),
-			Value:          data,
-		}, nil)
+func main() {
+	loader := config.Register(flag.CommandLine, &cfg)
+	replayFile := flag.String("replay", "", "replay a GPX, FIT or CSV track instead of simulating users")
+	replayUser := flag.String("replay-user", "replay", "user ID to publish replayed points as")
+	replayActivity := flag.String("replay-activity", defaultActivity, "activity type of the replayed session")
+	replaySpeed := flag.Float64("replay-speed", 1.0, "replay speed multiplier (2 = twice as fast)")
+	replayKeepTime := flag.Bool("replay-keep-time", false, "publish the track's original timestamps instead of the current time")
+	flag.Parse()
+
+	// Load configuration from flags, environment and optional config file
+	if err := loader.Load(); err != nil {
+		log.Fatal(err)
+	}
+	if loader.PrintRequested() {
+		loader.Print(os.Stdout)
+		return
+	}
+
+	log.Println("🚀 Starting GPS event producer...")
 
+	// Load the replay track up front so a bad file fails fast
+	var track []TrackPoint
+	if *replayFile != "" {
+		if *replaySpeed <= 0 {
+			log.Fatal("Replay speed must be positive")
+		}
+		var err error
+		if track, err = loadTrackFile(*replayFile); err != nil {
+			log.Fatal("Failed to load replay track:", err)
+		}
+		log.Printf("📂 Loaded %d points from %s\n", len(track), *replayFile)
+	}
+
+	// Load the simulated users, falling back to the built-in roster
+	if cfg.UsersFile != "" {
+		roster, err := loadRoster(cfg.UsersFile, cfg.Seed)
 		if err != nil {
-			http.Error(w, "Error producing message", http.StatusInternalServerError)
-			return
+			log.Fatal("Failed to load roster:", err)
+		}
+		users = roster
+		log.Printf("📂 Loaded %d users from %s\n", len(users), cfg.UsersFile)
+	}
+
+	// Load the gazetteer used to name location events
+	var err error
+	if gazetteer, err = loadGazetteer(cfg.PlacesFile); err != nil {
+		log.Fatal("Failed to load places:", err)
+	}
+	if cfg.PlacesFile != "" {
+		log.Printf("📂 Loaded %d places from %s\n", gazetteer.Len(), cfg.PlacesFile)
+	}
+
+	// Register the event schemas for the configured wire format
+	schemas, err := events.OpenRegistry(cfg.SchemaRegistry)
+	if err != nil {
+		log.Fatal("Failed to open schema registry:", err)
+	}
+	if serializer, err = events.NewSerializer(cfg.EventFormat, schemas); err != nil {
+		log.Fatal("Failed to register event schemas:", err)
+	}
+	log.Printf("📦 Publishing events as %s\n", serializer.Format())
+
+	// Initialize Kafka producer
+	producer, err = kafka.NewProducer(cfg.kafkaConfig())
+	if err != nil {
+		log.Fatal("Failed to create producer:", err)
+	}
+	defer producer.Close()
+
+	// Start delivery report handler
+	go deliveryReport(producer)
+
+	// Cancelled on SIGINT/SIGTERM; stops the generator or replay
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	finished := make(chan struct{})
+
+	if *replayFile != "" {
+		// Replay a recorded activity
+		go func() {
+			replayTrack(ctx, producer, track, ReplayOptions{
+				UserID:   *replayUser,
+				Activity: *replayActivity,
+				Speed:    *replaySpeed,
+				KeepTime: *replayKeepTime,
+			})
+			close(finished)
+		}()
+	} else {
+		// Start GPS event generator
+		reload := make(chan []User)
+		go func() {
+			generateEvents(ctx, producer, reload)
+			close(finished)
+		}()
+
+		// Reload the roster on SIGHUP
+		if cfg.UsersFile != "" {
+			hupChan := make(chan os.Signal, 1)
+			signal.Notify(hupChan, syscall.SIGHUP)
+			go func() {
+				for range hupChan {
+					roster, err := loadRoster(cfg.UsersFile, cfg.Seed)
+					if err != nil {
+						log.Printf("❌ Roster reload failed, keeping current users: %v\n", err)
+						continue
+					}
+					select {
+					case reload <- roster:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
 		}
+	}
 
-		producer.Flush(1000)
-		w.Write([]byte("ok"))
+	// Setup HTTP endpoints
+	authn, err := auth.New(cfg.AuthKey, 0, cfg.APIKeys)
+	if err != nil {
+		log.Fatal("Invalid auth configuration:", err)
+	}
+	// The accounts live in the consumer, so a token's role may have been
+	// revoked since it was issued: only API keys act as admins here
+	authn.ResolveAccounts(func(ctx context.Context, p auth.Principal) (auth.Principal, error) {
+		p.Role = auth.RoleUser
+		return p, nil
 	})
+	cors, err := auth.NewCORS(cfg.CORSOrigins)
+	if err != nil {
+		log.Fatal("Invalid CORS configuration:", err)
+	}
+	http.Handle("/produce", authn.Require(produceHandler()))
+
+	// Health and metrics endpoints
+	checker := health.NewChecker(readyTimeout)
+	readinessChecks(checker, producer)
+	http.HandleFunc("/healthz", health.Healthz)
+	http.HandleFunc("/readyz", checker.Readyz())
+	http.Handle("/metrics", registry.Handler())
 
 	// Start HTTP server
+	srv := &http.Server{
+		Addr:    cfg.HTTPAddr,
+		Handler: cors.Handler(metrics.InstrumentMux(httpDuration, http.DefaultServeMux)),
+	}
 	go func() {
-		log.Printf("🚀 HTTP server running on :8081\n")
-		if err := http.ListenAndServe(":8081", nil); err != nil {
+		log.Printf("🚀 HTTP server running on %s\n", cfg.HTTPAddr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatal("HTTP server error:", err)
 		}
 	}()
 
-	// Handle graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-
 	log.Println("🚴 GPS generator started... (Ctrl+C to stop)")
-	<-sigChan
-	log.Println("\n📥 Shutting down...")
+	select {
+	case <-ctx.Done():
+		log.Println("\n📥 Shutting down...")
+	case <-finished:
+		log.Println("📥 Replay complete, shutting down...")
+	}
+	stop()
+
+	// Messages still in flight from here on are lost if they fail
+	lostBefore := lostDeliveries.Load()
 
-	// Stop GPS generator
-	done <- true
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	// Stop accepting /produce requests and let in-flight ones finish
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("⚠️ HTTP server shutdown: %v\n", err)
+	}
+
+	// Wait for the generator or replay to close its open sessions
+	select {
+	case <-finished:
+	case <-shutdownCtx.Done():
+		log.Println("⚠️ Timed out waiting for event generation to stop")
+	}
 
 	// Flush any remaining messages
-	producer.Flush(5000)
+	remaining := producer.Flush(int(cfg.ShutdownTimeout.Milliseconds()))
+	failed := lostDeliveries.Load() - lostBefore
+	if remaining > 0 || failed > 0 {
+		log.Printf("❌ Lost messages: %d unflushed at shutdown, %d failed while shutting down\n", remaining, failed)
+		producer.Close()
+		os.Exit(1)
+	}
+	log.Println("👋 All messages delivered")
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	kafka "github.com/confluentinc/confluent-kafka-go/v2/kafka"
+
+	"shared/health"
+	"shared/metrics"
+)
+
+// readyTimeout bounds how long /readyz waits for the broker
+const readyTimeout = 2 * time.Second
+
+// Prometheus metrics exposed on /metrics
+var (
+	registry = metrics.NewRegistry()
+
+	messagesProduced = registry.NewCounter("gps_producer_messages_produced_total",
+		"Messages handed to the Kafka client.", "topic")
+	messagesDelivered = registry.NewCounter("gps_producer_messages_delivered_total",
+		"Messages acknowledged by the broker.", "topic")
+	messagesFailed = registry.NewCounter("gps_producer_messages_failed_total",
+		"Messages that could not be enqueued or delivered.", "topic")
+	httpDuration = registry.NewHistogram("gps_producer_http_request_duration_seconds",
+		"HTTP request latency.", metrics.DefBuckets, "handler", "method", "code")
+)
+
+// produce enqueues a message and counts it, or counts the failure to enqueue it
+func produce(p *kafka.Producer, msg *kafka.Message, deliveryChan chan kafka.Event) error {
+	topic := ""
+	if msg.TopicPartition.Topic != nil {
+		topic = *msg.TopicPartition.Topic
+	}
+
+	if err := p.Produce(msg, deliveryChan); err != nil {
+		messagesFailed.Inc(topic)
+		return err
+	}
+	messagesProduced.Inc(topic)
+	return nil
+}
+
+// readinessChecks registers the conditions under which the producer can publish
+func readinessChecks(checker *health.Checker, p *kafka.Producer) {
+	checker.Add("kafka", func(ctx context.Context) error {
+		timeout := readyTimeout
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = time.Until(deadline)
+		}
+		if timeout <= 0 {
+			return ctx.Err()
+		}
+		_, err := p.GetMetadata(nil, false, int(timeout.Milliseconds()))
+		return err
+	})
+}
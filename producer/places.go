@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// bundledPlaces is the gazetteer used when no places file is configured. It
+// covers the neighbourhoods around the built-in roster's base locations.
+//
+//go:embed places.csv
+var bundledPlaces []byte
+
+// placeCellDeg is the size of a gazetteer grid cell in degrees (about 1 km of latitude)
+const placeCellDeg = 0.01
+
+// Place is a named point of interest from the gazetteer
+type Place struct {
+	Name string
+	Kind string // park, landmark, station, ...
+	Location
+}
+
+// cell identifies one square of the gazetteer grid
+type cell struct {
+	lat, lon int
+}
+
+// Gazetteer resolves coordinates to the nearest named place. Places are
+// bucketed into a fixed lat/lon grid so a lookup only measures the distance
+// to places in the cells that could be within range.
+type Gazetteer struct {
+	places []Place
+	grid   map[cell][]int // indexes into places
+}
+
+// NewGazetteer indexes places for nearest-neighbour lookups
+func NewGazetteer(places []Place) *Gazetteer {
+	g := &Gazetteer{places: places, grid: map[cell][]int{}}
+	for i, p := range places {
+		c := cellOf(p.Location)
+		g.grid[c] = append(g.grid[c], i)
+	}
+	return g
+}
+
+// cellOf returns the grid cell containing loc
+func cellOf(loc Location) cell {
+	return cell{
+		lat: int(math.Floor(loc.Lat / placeCellDeg)),
+		lon: int(math.Floor(loc.Lon / placeCellDeg)),
+	}
+}
+
+// Len returns the number of places in the gazetteer
+func (g *Gazetteer) Len() int {
+	return len(g.places)
+}
+
+// Nearest returns the closest place within maxDist metres of loc, and its
+// distance. ok is false when nothing is that close.
+func (g *Gazetteer) Nearest(loc Location, maxDist float64) (place Place, dist float64, ok bool) {
+	// How many cells maxDist spans; longitude cells shrink towards the poles
+	metresPerCell := placeCellDeg * math.Pi / 180 * earthRadiusMeters
+	latCells := int(math.Ceil(maxDist / metresPerCell))
+	lonCells := math.Inf(1)
+	if cos := math.Cos(loc.Lat * math.Pi / 180); cos > 0 {
+		lonCells = math.Ceil(maxDist / (metresPerCell * cos))
+	}
+
+	best := -1
+	dist = maxDist
+	consider := func(i int) {
+		if d := haversine(loc, g.places[i].Location); d <= dist {
+			best, dist = i, d
+		}
+	}
+
+	if window := float64(2*latCells+1) * (2*lonCells + 1); window > float64(len(g.grid)) {
+		// Searching the window would visit more cells than hold places
+		// (large radius or near a pole); scanning everything is cheaper
+		for i := range g.places {
+			consider(i)
+		}
+	} else {
+		center := cellOf(loc)
+		for dLat := -latCells; dLat <= latCells; dLat++ {
+			for dLon := -int(lonCells); dLon <= int(lonCells); dLon++ {
+				for _, i := range g.grid[cell{center.lat + dLat, center.lon + dLon}] {
+					consider(i)
+				}
+			}
+		}
+	}
+	if best < 0 {
+		return Place{}, 0, false
+	}
+	return g.places[best], dist, true
+}
+
+// loadGazetteer reads places from a CSV or GeoJSON file, or the bundled
+// gazetteer when path is empty
+func loadGazetteer(path string) (*Gazetteer, error) {
+	if path == "" {
+		places, err := parsePlacesCSV(bytes.NewReader(bundledPlaces))
+		if err != nil {
+			return nil, fmt.Errorf("bundled places: %w", err)
+		}
+		return NewGazetteer(places), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var places []Place
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		places, err = parsePlacesCSV(f)
+	case ".geojson", ".json":
+		places, err = parsePlacesGeoJSON(f)
+	default:
+		return nil, fmt.Errorf("unsupported places format %q (want .csv, .geojson or .json)", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(places) == 0 {
+		return nil, fmt.Errorf("%s contains no places", path)
+	}
+	return NewGazetteer(places), nil
+}
+
+// parsePlacesCSV reads a CSV file with a header row naming name, lat and lon
+// and (optionally) kind columns
+func parsePlacesCSV(in io.Reader) ([]Place, error) {
+	r := csv.NewReader(in)
+	r.TrimLeadingSpace = true
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("csv: reading header: %w", err)
+	}
+
+	nameCol, kindCol, latCol, lonCol := -1, -1, -1, -1
+	for i, name := range header {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "name":
+			nameCol = i
+		case "kind", "category", "type":
+			kindCol = i
+		case "lat", "latitude":
+			latCol = i
+		case "lon", "lng", "longitude":
+			lonCol = i
+		}
+	}
+	if nameCol < 0 || latCol < 0 || lonCol < 0 {
+		return nil, fmt.Errorf("csv: header must contain name, lat and lon columns")
+	}
+
+	places := []Place{}
+	for line := 2; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("csv: line %d: %w", line, err)
+		}
+
+		place := Place{Name: strings.TrimSpace(record[nameCol])}
+		if place.Name == "" {
+			return nil, fmt.Errorf("csv: line %d: empty name", line)
+		}
+		if kindCol >= 0 {
+			place.Kind = strings.TrimSpace(record[kindCol])
+		}
+		if place.Lat, err = strconv.ParseFloat(record[latCol], 64); err != nil || place.Lat < -90 || place.Lat > 90 {
+			return nil, fmt.Errorf("csv: line %d: invalid lat %q", line, record[latCol])
+		}
+		if place.Lon, err = strconv.ParseFloat(record[lonCol], 64); err != nil || place.Lon < -180 || place.Lon > 180 {
+			return nil, fmt.Errorf("csv: line %d: invalid lon %q", line, record[lonCol])
+		}
+		places = append(places, place)
+	}
+	return places, nil
+}
+
+// parsePlacesGeoJSON reads the Point features of a GeoJSON FeatureCollection,
+// taking the name from properties.name and the kind from properties.kind
+// (or category, or type). Features of other geometry types are skipped.
+func parsePlacesGeoJSON(in io.Reader) ([]Place, error) {
+	var doc struct {
+		Type     string `json:"type"`
+		Features []struct {
+			Geometry *struct {
+				Type        string          `json:"type"`
+				Coordinates json.RawMessage `json:"coordinates"` // shape depends on the type
+			} `json:"geometry"`
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.NewDecoder(in).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("geojson: %w", err)
+	}
+	if doc.Type != "FeatureCollection" {
+		return nil, fmt.Errorf("geojson: want a FeatureCollection, got %q", doc.Type)
+	}
+
+	places := []Place{}
+	for i, f := range doc.Features {
+		if f.Geometry == nil || f.Geometry.Type != "Point" {
+			continue
+		}
+		name, _ := f.Properties["name"].(string)
+		if strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("geojson: feature %d has no name", i)
+		}
+		// GeoJSON positions are [lon, lat]
+		var coords []float64
+		if err := json.Unmarshal(f.Geometry.Coordinates, &coords); err != nil || len(coords) < 2 || coords[1] < -90 || coords[1] > 90 || coords[0] < -180 || coords[0] > 180 {
+			return nil, fmt.Errorf("geojson: feature %d (%s) has invalid coordinates", i, name)
+		}
+
+		place := Place{Name: strings.TrimSpace(name), Location: Location{Lat: coords[1], Lon: coords[0]}}
+		for _, key := range []string{"kind", "category", "type"} {
+			if kind, ok := f.Properties[key].(string); ok && kind != "" {
+				place.Kind = kind
+				break
+			}
+		}
+		places = append(places, place)
+	}
+	return places, nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"time"
+
+	kafka "github.com/confluentinc/confluent-kafka-go/v2/kafka"
+
+	"shared/auth"
+	"shared/events"
+)
+
+// Delivery modes of POST /produce
+const (
+	// ProduceSync waits for the broker's delivery report and returns the offset
+	ProduceSync = "sync"
+	// ProduceAsync answers 202 once the message is queued
+	ProduceAsync = "async"
+
+	// maxProduceBody bounds the size of a /produce request body
+	maxProduceBody = 64 << 10
+)
+
+// produceRequest is the body of POST /produce. Lat and lon are pointers so
+// a missing coordinate is reported instead of being read as 0.
+type produceRequest struct {
+	SchemaVersion int      `json:"schema_version"`
+	UserID        string   `json:"user_id"`
+	SessionID     string   `json:"session_id"`
+	Lat           *float64 `json:"lat"`
+	Lon           *float64 `json:"lon"`
+	Timestamp     string   `json:"timestamp"`
+	Ele           *float64 `json:"ele"`
+}
+
+// produceError is the JSON body of a failed /produce request
+type produceError struct {
+	Error  string              `json:"error"`
+	Fields []events.FieldError `json:"fields,omitempty"`
+}
+
+// produceResult is the JSON body of an accepted or delivered /produce request
+type produceResult struct {
+	Status    string `json:"status"`
+	Topic     string `json:"topic"`
+	Partition *int32 `json:"partition,omitempty"`
+	Offset    *int64 `json:"offset,omitempty"`
+}
+
+// produceHandler handles POST /produce: it validates a CoordinateEvent and
+// publishes it. Callers may only publish for their own user_id unless they
+// hold the admin role. In sync mode it waits up to ProduceTimeout for the delivery
+// report and answers 200 with the partition and offset; in async mode it
+// answers 202 as soon as the message is queued. ?mode= overrides the
+// configured default per request.
+func produceHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, produceError{Error: "POST only"})
+			return
+		}
+
+		mode := cfg.ProduceMode
+		if m := r.URL.Query().Get("mode"); m != "" {
+			mode = m
+		}
+		if mode != ProduceSync && mode != ProduceAsync {
+			writeJSON(w, http.StatusBadRequest, produceError{Error: fmt.Sprintf("mode must be %q or %q", ProduceSync, ProduceAsync)})
+			return
+		}
+
+		if ct := r.Header.Get("Content-Type"); ct != "" {
+			if mt, _, err := mime.ParseMediaType(ct); err != nil || mt != "application/json" {
+				writeJSON(w, http.StatusUnsupportedMediaType, produceError{Error: "Content-Type must be application/json"})
+				return
+			}
+		}
+
+		event, err := decodeProduceRequest(w, r)
+		if err != nil {
+			var invalid events.ValidationError
+			var tooLarge *http.MaxBytesError
+			switch {
+			case errors.As(err, &invalid):
+				writeJSON(w, http.StatusBadRequest, produceError{Error: "invalid event", Fields: invalid})
+			case errors.As(err, &tooLarge):
+				writeJSON(w, http.StatusRequestEntityTooLarge, produceError{Error: fmt.Sprintf("body exceeds %d bytes", tooLarge.Limit)})
+			default:
+				writeJSON(w, http.StatusBadRequest, produceError{Error: "Invalid JSON: " + err.Error()})
+			}
+			return
+		}
+		if p, _ := auth.FromContext(r.Context()); !p.CanAccess(event.UserID) {
+			writeJSON(w, http.StatusForbidden, produceError{Error: "you may only produce events for your own user_id"})
+			return
+		}
+		if event.SessionID != "" && !sessionOwners.claim(event.SessionID, event.UserID) {
+			writeJSON(w, http.StatusForbidden, produceError{Error: "session_id belongs to another user"})
+			return
+		}
+
+		data, err := serializer.Marshal(&event)
+		if err != nil {
+			log.Printf("Error serializing event: %v\n", err)
+			writeJSON(w, http.StatusInternalServerError, produceError{Error: "Error serializing event"})
+			return
+		}
+
+		msg := &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &cfg.CoordinatesTopic, Partition: kafka.PartitionAny},
+			Key:            []byte(event.UserID),
+			Value:          data,
+		}
+
+		if mode == ProduceAsync {
+			// Delivery is reported to deliveryReport like any generated event
+			if err := produce(producer, msg, nil); err != nil {
+				writeProduceFailure(w, err)
+				return
+			}
+			writeJSON(w, http.StatusAccepted, produceResult{Status: "accepted", Topic: cfg.CoordinatesTopic})
+			return
+		}
+
+		// Buffered so the client never blocks if we stop waiting
+		delivery := make(chan kafka.Event, 1)
+		if err := produce(producer, msg, delivery); err != nil {
+			writeProduceFailure(w, err)
+			return
+		}
+
+		timer := time.NewTimer(cfg.ProduceTimeout)
+		defer timer.Stop()
+		select {
+		case e := <-delivery:
+			m, ok := e.(*kafka.Message)
+			if !ok {
+				writeJSON(w, http.StatusBadGateway, produceError{Error: fmt.Sprintf("unexpected delivery event: %v", e)})
+				return
+			}
+			if err := recordDelivery(m); err != nil {
+				writeJSON(w, http.StatusBadGateway, produceError{Error: "Delivery failed: " + err.Error()})
+				return
+			}
+			partition, offset := m.TopicPartition.Partition, int64(m.TopicPartition.Offset)
+			writeJSON(w, http.StatusOK, produceResult{
+				Status:    "delivered",
+				Topic:     *m.TopicPartition.Topic,
+				Partition: &partition,
+				Offset:    &offset,
+			})
+
+		case <-timer.C:
+			go awaitDelivery(delivery)
+			writeJSON(w, http.StatusGatewayTimeout, produceError{Error: fmt.Sprintf("delivery not confirmed within %v; the message may still be delivered", cfg.ProduceTimeout)})
+
+		case <-r.Context().Done():
+			// The client went away; still count the outcome
+			go awaitDelivery(delivery)
+		}
+	}
+}
+
+// decodeProduceRequest reads and validates the request body, reporting
+// missing coordinates alongside the event's own validation errors
+func decodeProduceRequest(w http.ResponseWriter, r *http.Request) (CoordinateEvent, error) {
+	var req produceRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxProduceBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return CoordinateEvent{}, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return CoordinateEvent{}, errors.New("body must hold a single JSON object")
+	}
+
+	event := CoordinateEvent{
+		SchemaVersion: req.SchemaVersion,
+		UserID:        req.UserID,
+		SessionID:     req.SessionID,
+		Timestamp:     req.Timestamp,
+		Ele:           req.Ele,
+	}
+
+	// Set timestamp if not provided
+	if event.Timestamp == "" {
+		event.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	var problems events.ValidationError
+	if req.Lat == nil {
+		problems = append(problems, events.FieldError{Field: "lat", Message: "is required"})
+	} else {
+		event.Lat = *req.Lat
+	}
+	if req.Lon == nil {
+		problems = append(problems, events.FieldError{Field: "lon", Message: "is required"})
+	} else {
+		event.Lon = *req.Lon
+	}
+
+	// Check the version the client sent before Marshal stamps the current one
+	if err := event.Validate(); err != nil {
+		var invalid events.ValidationError
+		if !errors.As(err, &invalid) {
+			return event, err
+		}
+		problems = append(problems, invalid...)
+	}
+	if len(problems) > 0 {
+		return event, problems
+	}
+	return event, nil
+}
+
+// writeProduceFailure reports a message the Kafka client refused to queue
+func writeProduceFailure(w http.ResponseWriter, err error) {
+	var kerr kafka.Error
+	if errors.As(err, &kerr) && kerr.Code() == kafka.ErrQueueFull {
+		w.Header().Set("Retry-After", "1")
+		writeJSON(w, http.StatusServiceUnavailable, produceError{Error: "Producer queue is full, retry later"})
+		return
+	}
+	log.Printf("Error producing message: %v\n", err)
+	writeJSON(w, http.StatusInternalServerError, produceError{Error: "Error producing message"})
+}
+
+// awaitDelivery counts the delivery report of a message nobody is waiting on any more
+func awaitDelivery(delivery chan kafka.Event) {
+	if m, ok := (<-delivery).(*kafka.Message); ok && recordDelivery(m) != nil {
+		lostDeliveries.Add(1)
+	}
+}
+
+// writeJSON writes v as a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	kafka "github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+// TrackPoint is a single fix read from a recorded activity file
+type TrackPoint struct {
+	Lat  float64
+	Lon  float64
+	Ele  *float64  // metres, nil if the source had no elevation
+	Time time.Time // zero if the source had no timestamp
+}
+
+// ReplayOptions controls how a recorded track is published
+type ReplayOptions struct {
+	UserID   string
+	Activity string
+	Speed    float64 // playback multiplier, 2 = twice as fast
+	KeepTime bool    // publish original timestamps instead of the wall clock
+}
+
+// loadTrackFile reads a GPX, FIT or CSV file based on its extension
+func loadTrackFile(path string) ([]TrackPoint, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gpx":
+		return parseGPX(path)
+	case ".fit":
+		return parseFIT(path)
+	case ".csv":
+		return parseCSV(path)
+	default:
+		return nil, fmt.Errorf("unsupported track format %q (want .gpx, .fit or .csv)", filepath.Ext(path))
+	}
+}
+
+// parseGPX reads all track points (trk/trkseg/trkpt) from a GPX file
+func parseGPX(path string) ([]TrackPoint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var doc struct {
+		Tracks []struct {
+			Segments []struct {
+				Points []struct {
+					Lat  float64  `xml:"lat,attr"`
+					Lon  float64  `xml:"lon,attr"`
+					Ele  *float64 `xml:"ele"`
+					Time string   `xml:"time"`
+				} `xml:"trkpt"`
+			} `xml:"trkseg"`
+		} `xml:"trk"`
+	}
+	if err := xml.NewDecoder(f).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("gpx: %w", err)
+	}
+
+	points := []TrackPoint{}
+	for _, trk := range doc.Tracks {
+		for _, seg := range trk.Segments {
+			for _, p := range seg.Points {
+				point := TrackPoint{Lat: p.Lat, Lon: p.Lon, Ele: p.Ele}
+				if p.Time != "" {
+					if point.Time, err = time.Parse(time.RFC3339, strings.TrimSpace(p.Time)); err != nil {
+						return nil, fmt.Errorf("gpx: invalid time %q", p.Time)
+					}
+				}
+				points = append(points, point)
+			}
+		}
+	}
+	return points, nil
+}
+
+// parseCSV reads a CSV file with a header row naming lat, lon and
+// (optionally) timestamp and elevation columns
+func parseCSV(path string) ([]TrackPoint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.TrimLeadingSpace = true
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("csv: reading header: %w", err)
+	}
+
+	latCol, lonCol, timeCol, eleCol := -1, -1, -1, -1
+	for i, name := range header {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "lat", "latitude":
+			latCol = i
+		case "lon", "lng", "longitude":
+			lonCol = i
+		case "timestamp", "time":
+			timeCol = i
+		case "ele", "elevation", "altitude":
+			eleCol = i
+		}
+	}
+	if latCol < 0 || lonCol < 0 {
+		return nil, fmt.Errorf("csv: header must contain lat and lon columns")
+	}
+
+	points := []TrackPoint{}
+	for line := 2; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("csv: line %d: %w", line, err)
+		}
+
+		var point TrackPoint
+		if point.Lat, err = strconv.ParseFloat(record[latCol], 64); err != nil {
+			return nil, fmt.Errorf("csv: line %d: invalid lat %q", line, record[latCol])
+		}
+		if point.Lon, err = strconv.ParseFloat(record[lonCol], 64); err != nil {
+			return nil, fmt.Errorf("csv: line %d: invalid lon %q", line, record[lonCol])
+		}
+		if timeCol >= 0 && record[timeCol] != "" {
+			if point.Time, err = time.Parse(time.RFC3339, record[timeCol]); err != nil {
+				return nil, fmt.Errorf("csv: line %d: invalid timestamp %q", line, record[timeCol])
+			}
+		}
+		if eleCol >= 0 && record[eleCol] != "" {
+			ele, err := strconv.ParseFloat(record[eleCol], 64)
+			if err != nil {
+				return nil, fmt.Errorf("csv: line %d: invalid elevation %q", line, record[eleCol])
+			}
+			point.Ele = &ele
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+// replayTrack publishes recorded points as CoordinateEvents, waiting the
+// original time between fixes divided by opts.Speed. Points without
+// timestamps are spaced EmitInterval apart.
+func replayTrack(ctx context.Context, producer *kafka.Producer, points []TrackPoint, opts ReplayOptions) {
+	if len(points) == 0 {
+		log.Println("⚠️ Nothing to replay")
+		return
+	}
+
+	user := User{ID: opts.UserID, Name: opts.UserID, Activity: opts.Activity}
+	now := time.Now()
+	session := &Session{
+		ID:       fmt.Sprintf("%s-replay-%s", user.ID, now.UTC().Format("20060102T150405")),
+		Activity: opts.Activity,
+	}
+	publishSessionEvent(producer, SessionStart, user, session, now)
+	defer func() {
+		publishSessionEvent(producer, SessionEnd, user, session, time.Now())
+		producer.Flush(0)
+	}()
+
+	log.Printf("⏯️ Replaying %d points for %s at %.1fx\n", len(points), user.ID, opts.Speed)
+	for i, p := range points {
+		if i > 0 {
+			gap := EmitInterval
+			if !p.Time.IsZero() && !points[i-1].Time.IsZero() {
+				gap = p.Time.Sub(points[i-1].Time)
+			}
+			wait := time.Duration(float64(gap) / opts.Speed)
+			if wait > 0 {
+				select {
+				case <-ctx.Done():
+					log.Println("🛑 Replay interrupted")
+					return
+				case <-time.After(wait):
+				}
+			}
+		}
+
+		ts := time.Now()
+		if opts.KeepTime && !p.Time.IsZero() {
+			ts = p.Time
+		}
+
+		event := CoordinateEvent{
+			UserID:    user.ID,
+			SessionID: session.ID,
+			Lat:       p.Lat,
+			Lon:       p.Lon,
+			Timestamp: ts.UTC().Format(time.RFC3339),
+			Ele:       p.Ele,
+		}
+
+		data, err := serializer.Marshal(&event)
+		if err != nil {
+			log.Printf("Error marshaling coordinate event: %v\n", err)
+			continue
+		}
+
+		err = produce(producer, &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &cfg.CoordinatesTopic, Partition: kafka.PartitionAny},
+			Key:            []byte(user.ID),
+			Value:          data,
+		}, nil)
+		if err != nil {
+			log.Printf("Error producing coordinate event: %v\n", err)
+		}
+
+		// Trigger delivery report callbacks
+		producer.Flush(0)
+	}
+	log.Println("✅ Replay finished")
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// rosterSpreadDegrees is how far replicated users are scattered around the
+// base of the entry they were expanded from
+const rosterSpreadDegrees = 0.05
+
+// Duration is a time.Duration that reads from strings such as "5s" or "1m"
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"5s\"")
+	}
+	return d.parse(s)
+}
+
+// UnmarshalYAML parses a duration string
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	return d.parse(value.Value)
+}
+
+func (d *Duration) parse(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON renders the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// RosterEntry describes one simulated user (or Count copies of it)
+type RosterEntry struct {
+	User  `yaml:",inline"`
+	Count int `json:"count" yaml:"count"` // expand into Count users for load testing
+}
+
+// Roster is the on-disk list of simulated users
+type Roster struct {
+	Users []RosterEntry `json:"users" yaml:"users"`
+}
+
+// loadRoster reads a YAML or JSON roster file and returns the expanded users
+func loadRoster(path string, seed int64) ([]User, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var roster Roster
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, &roster)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &roster)
+	default:
+		return nil, fmt.Errorf("unsupported roster format %q (want .yaml, .yml or .json)", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing roster: %w", err)
+	}
+
+	return expandRoster(roster, seed)
+}
+
+// expandRoster validates entries, applies defaults and expands counted entries
+// into individual users scattered around the entry's base
+func expandRoster(roster Roster, seed int64) ([]User, error) {
+	rng := rand.New(rand.NewSource(seed))
+	seen := map[string]bool{}
+	result := []User{}
+
+	for i, entry := range roster.Users {
+		if err := validateUser(entry.User); err != nil {
+			return nil, fmt.Errorf("roster entry %d: %w", i, err)
+		}
+		if entry.Name == "" {
+			entry.Name = entry.ID
+		}
+		if entry.Activity == "" {
+			entry.Activity = defaultActivity
+		}
+		if entry.Interval == 0 {
+			entry.Interval = Duration(EmitInterval)
+		}
+
+		expanded := []User{entry.User}
+		if entry.Count > 1 {
+			expanded = expanded[:0]
+			for n := 1; n <= entry.Count; n++ {
+				u := entry.User
+				u.ID = fmt.Sprintf("%s-%03d", entry.ID, n)
+				u.Name = fmt.Sprintf("%s %d", entry.Name, n)
+				u.Base.Lat += (rng.Float64()*2 - 1) * rosterSpreadDegrees
+				u.Base.Lon += (rng.Float64()*2 - 1) * rosterSpreadDegrees
+				expanded = append(expanded, u)
+			}
+		}
+
+		for _, u := range expanded {
+			if seen[u.ID] {
+				return nil, fmt.Errorf("roster entry %d: duplicate user id %q", i, u.ID)
+			}
+			seen[u.ID] = true
+			result = append(result, u)
+		}
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("roster has no users")
+	}
+	return result, nil
+}
+
+// validateUser checks the fields of a roster entry
+func validateUser(u User) error {
+	if u.ID == "" {
+		return fmt.Errorf("id is required")
+	}
+	if u.Base.Lat < -90 || u.Base.Lat > 90 {
+		return fmt.Errorf("user %q: base lat %f out of range", u.ID, u.Base.Lat)
+	}
+	if u.Base.Lon < -180 || u.Base.Lon > 180 {
+		return fmt.Errorf("user %q: base lon %f out of range", u.ID, u.Base.Lon)
+	}
+	if _, ok := activityProfiles[u.Activity]; u.Activity != "" && !ok {
+		return fmt.Errorf("user %q: unknown activity %q", u.ID, u.Activity)
+	}
+	if u.Interval != 0 && time.Duration(u.Interval) < 100*time.Millisecond {
+		return fmt.Errorf("user %q: interval must be at least 100ms", u.ID)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	kafka "github.com/confluentinc/confluent-kafka-go/v2/kafka"
+
+	"shared/events"
+)
+
+const (
+	SessionStart = events.SessionStart
+	SessionEnd   = events.SessionEnd
+
+	// Number of GPS fixes a simulated activity lasts (5-20 minutes at EmitInterval)
+	sessionMinPoints = 60
+	sessionMaxPoints = 240
+
+	// Number of session owners remembered; the oldest are forgotten first
+	maxSessionOwners = 100000
+)
+
+// SessionEvent marks the start or end of a user's activity session
+type SessionEvent = events.SessionEvent
+
+// Session is an activity currently being simulated for a user
+type Session struct {
+	ID        string
+	Activity  string
+	Remaining int // fixes left before the session ends
+}
+
+// sessionOwners remembers which user each session ID published by this
+// process belongs to, so /produce cannot add fixes to another user's session
+var sessionOwners = newSessionRegistry(maxSessionOwners)
+
+// sessionRegistry maps session IDs to their users, forgetting the oldest
+// once it holds max of them
+type sessionRegistry struct {
+	mu     sync.Mutex
+	owners map[string]string
+	order  []string // session IDs, oldest first
+	max    int
+}
+
+func newSessionRegistry(max int) *sessionRegistry {
+	return &sessionRegistry{owners: map[string]string{}, max: max}
+}
+
+// claim records userID as the owner of sessionID unless another user
+// already owns it, and reports whether userID owns it now
+func (s *sessionRegistry) claim(sessionID, userID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if owner, ok := s.owners[sessionID]; ok {
+		return owner == userID
+	}
+	if len(s.order) == s.max {
+		delete(s.owners, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.owners[sessionID] = userID
+	s.order = append(s.order, sessionID)
+	return true
+}
+
+// startSession begins a new activity session for user and announces it. Its
+// length comes from rng, the user's seeded movement source.
+func startSession(producer *kafka.Producer, user User, rng *rand.Rand, now time.Time) *Session {
+	activity := user.Activity
+	if activity == "" {
+		activity = defaultActivity
+	}
+
+	session := &Session{
+		ID:        fmt.Sprintf("%s-%s", user.ID, now.UTC().Format("20060102T150405")),
+		Activity:  activity,
+		Remaining: sessionMinPoints + rng.Intn(sessionMaxPoints-sessionMinPoints+1),
+	}
+
+	publishSessionEvent(producer, SessionStart, user, session, now)
+	log.Printf("🏁 Started %s session %s\n", session.Activity, session.ID)
+	return session
+}
+
+// endSession announces that a user's activity session has finished
+func endSession(producer *kafka.Producer, user User, session *Session, now time.Time) {
+	publishSessionEvent(producer, SessionEnd, user, session, now)
+	log.Printf("🏁 Ended session %s\n", session.ID)
+}
+
+// publishSessionEvent produces a session lifecycle event to the sessions topic
+func publishSessionEvent(producer *kafka.Producer, eventType string, user User, session *Session, now time.Time) {
+	sessionOwners.claim(session.ID, user.ID)
+	event := SessionEvent{
+		Type:      eventType,
+		SessionID: session.ID,
+		UserID:    user.ID,
+		Activity:  session.Activity,
+		Timestamp: now.UTC().Format(time.RFC3339),
+	}
+
+	data, err := serializer.Marshal(&event)
+	if err != nil {
+		log.Printf("Error marshaling session event: %v\n", err)
+		return
+	}
+
+	err = produce(producer, &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &cfg.SessionsTopic, Partition: kafka.PartitionAny},
+		Key:            []byte(user.ID),
+		Value:          data,
+	}, nil)
+
+	if err != nil {
+		log.Printf("Error producing session event: %v\n", err)
+	}
+}
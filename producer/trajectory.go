@@ -0,0 +1,146 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	earthRadiusMeters = 6371000.0
+	// maxRoamMeters is how far a simulated user may drift from their base
+	// before the model starts steering them back towards it.
+	maxRoamMeters = 3000.0
+)
+
+// ActivityProfile describes how a simulated user moves for a given activity
+type ActivityProfile struct {
+	MinSpeed    float64 // metres per second
+	MaxSpeed    float64 // metres per second
+	MaxTurnRate float64 // degrees per second
+}
+
+// activityProfiles holds the speed and turning behaviour for each activity type
+var activityProfiles = map[string]ActivityProfile{
+	"walking": {MinSpeed: 1.0, MaxSpeed: 1.8, MaxTurnRate: 6},
+	"running": {MinSpeed: 2.4, MaxSpeed: 4.2, MaxTurnRate: 4},
+	"cycling": {MinSpeed: 4.5, MaxSpeed: 9.0, MaxTurnRate: 2.5},
+}
+
+// defaultActivity is used when a user has no (or an unknown) activity type
+const defaultActivity = "walking"
+
+// Mover holds the movement state of a single simulated user
+type Mover struct {
+	rng     *rand.Rand
+	profile ActivityProfile
+	base    Location
+	pos     Location
+	heading float64 // degrees clockwise from north
+	speed   float64 // metres per second
+	turn    float64 // current turn rate in degrees per second
+}
+
+// NewMover creates a movement model for a user starting at their base location.
+// The model is seeded from seed and the user ID so tracks are reproducible.
+func NewMover(user User, seed int64) *Mover {
+	h := fnv.New64a()
+	h.Write([]byte(user.ID))
+	rng := rand.New(rand.NewSource(seed ^ int64(h.Sum64())))
+
+	profile, ok := activityProfiles[user.Activity]
+	if !ok {
+		profile = activityProfiles[defaultActivity]
+	}
+
+	return &Mover{
+		rng:     rng,
+		profile: profile,
+		base:    user.Base,
+		pos:     user.Base,
+		heading: rng.Float64() * 360,
+		speed:   profile.MinSpeed + rng.Float64()*(profile.MaxSpeed-profile.MinSpeed),
+	}
+}
+
+// Position returns the current position of the mover
+func (m *Mover) Position() Location {
+	return m.pos
+}
+
+// Step advances the movement model by dt and returns the new position
+func (m *Mover) Step(dt time.Duration) Location {
+	secs := dt.Seconds()
+	if secs <= 0 {
+		return m.pos
+	}
+
+	// Turn rate drifts smoothly so paths curve instead of zig-zagging
+	m.turn += m.rng.NormFloat64() * m.profile.MaxTurnRate * 0.3
+	m.turn = clamp(m.turn, -m.profile.MaxTurnRate, m.profile.MaxTurnRate)
+	m.heading += m.turn * secs
+
+	// Steer back towards base once the user has roamed too far
+	if dist := haversine(m.pos, m.base); dist > maxRoamMeters {
+		diff := normalizeAngle(bearing(m.pos, m.base) - m.heading)
+		maxTurn := m.profile.MaxTurnRate * 3 * secs
+		m.heading += clamp(diff, -maxTurn, maxTurn)
+	}
+	m.heading = math.Mod(m.heading+360, 360)
+
+	// Speed relaxes towards a randomly wandering target within the profile
+	target := m.speed + m.rng.NormFloat64()*(m.profile.MaxSpeed-m.profile.MinSpeed)*0.2
+	m.speed = clamp(0.7*m.speed+0.3*target, m.profile.MinSpeed, m.profile.MaxSpeed)
+
+	m.pos = destination(m.pos, m.heading, m.speed*secs)
+	return m.pos
+}
+
+// haversine returns the great-circle distance between two points in metres
+func haversine(a, b Location) float64 {
+	lat1 := a.Lat * math.Pi / 180
+	lat2 := b.Lat * math.Pi / 180
+	dLat := lat2 - lat1
+	dLon := (b.Lon - a.Lon) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Sqrt(h))
+}
+
+// bearing returns the initial bearing from a to b in degrees
+func bearing(a, b Location) float64 {
+	lat1 := a.Lat * math.Pi / 180
+	lat2 := b.Lat * math.Pi / 180
+	dLon := (b.Lon - a.Lon) * math.Pi / 180
+
+	y := math.Sin(dLon) * math.Cos(lat2)
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dLon)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
+
+// destination returns the point reached by travelling dist metres from p on the given heading
+func destination(p Location, heading, dist float64) Location {
+	lat1 := p.Lat * math.Pi / 180
+	lon1 := p.Lon * math.Pi / 180
+	brng := heading * math.Pi / 180
+	d := dist / earthRadiusMeters
+
+	lat2 := math.Asin(math.Sin(lat1)*math.Cos(d) + math.Cos(lat1)*math.Sin(d)*math.Cos(brng))
+	lon2 := lon1 + math.Atan2(math.Sin(brng)*math.Sin(d)*math.Cos(lat1), math.Cos(d)-math.Sin(lat1)*math.Sin(lat2))
+
+	return Location{
+		Lat: lat2 * 180 / math.Pi,
+		Lon: math.Mod(lon2*180/math.Pi+540, 360) - 180,
+	}
+}
+
+// normalizeAngle maps an angle in degrees to the range [-180, 180)
+func normalizeAngle(deg float64) float64 {
+	return math.Mod(math.Mod(deg+180, 360)+360, 360) - 180
+}
+
+func clamp(v, lo, hi float64) float64 {
+	return math.Max(lo, math.Min(hi, v))
+}
@@ -17,12 +17,30 @@ $KAFKA_CMD --create --if-not-exists \
   --partitions 1 \
   --topic locations
 
+# Create sessions topic
+$KAFKA_CMD --create --if-not-exists \
+  --replication-factor 1 \
+  --partitions 1 \
+  --topic sessions
+
 # Create coordinates topic
 $KAFKA_CMD --create --if-not-exists \
   --replication-factor 1 \
   --partitions 1 \
   --topic coordinates
 
+# Create dead-letter topic for messages the consumer cannot process
+$KAFKA_CMD --create --if-not-exists \
+  --replication-factor 1 \
+  --partitions 1 \
+  --topic coordinates.dlq
+
+# Create geofence enter/exit events topic
+$KAFKA_CMD --create --if-not-exists \
+  --replication-factor 1 \
+  --partitions 1 \
+  --topic geofence-events
+
 # List all topics
 echo "\nListing all topics:"
 $KAFKA_CMD --list
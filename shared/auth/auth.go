@@ -0,0 +1,289 @@
+// Package auth authenticates requests to the services' HTTP APIs and
+// applies their CORS policy.
+//
+// Callers present either a JWT signed with HS256 under a locally
+// configured key or a static API key, as "Authorization: Bearer <token>"
+// (or "X-API-Key: <key>"). Both name a user and a role: an admin may act
+// on every user's data, anyone else only on their own. A token is issued
+// to an account, which a service holding the accounts re-reads on every
+// request (see ResolveAccounts), so a changed role or user binding applies
+// to tokens already issued.
+//
+//	authn, err := auth.New(cfg.AuthKey, cfg.TokenTTL, cfg.APIKeys)
+//	http.Handle("/events", authn.Require(getEvents(store)))
+//	http.Handle("/dlq", authn.RequireAdmin(getDLQ(dlq)))
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Roles a caller may hold
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// MinKeyLen is the shortest signing key accepted: HS256 needs at least 256 bits
+const MinKeyLen = 32
+
+var (
+	// ErrNoCredentials is returned for a request that carries no token or key
+	ErrNoCredentials = errors.New("authentication required")
+	// ErrInvalidToken is returned for a malformed token or a bad signature
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrExpiredToken is returned for a token past its expiry
+	ErrExpiredToken = errors.New("token expired")
+	// ErrUnknownKey is returned for an API key that is not configured
+	ErrUnknownKey = errors.New("unknown API key")
+	// ErrRevoked is returned by an account resolver for a token whose
+	// account no longer exists
+	ErrRevoked = errors.New("token revoked")
+)
+
+// tokenHeader is the JOSE header of every token issued
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Principal is the authenticated caller
+type Principal struct {
+	UserID string `json:"user_id"`
+	Role   string `json:"role"`
+	// Account is the login account a token was issued to; empty for API keys
+	Account string `json:"account,omitempty"`
+}
+
+// IsAdmin reports whether the caller holds the admin role
+func (p Principal) IsAdmin() bool {
+	return p.Role == RoleAdmin
+}
+
+// CanAccess reports whether the caller may read or change userID's data
+func (p Principal) CanAccess(userID string) bool {
+	return p.IsAdmin() || p.UserID == userID
+}
+
+// claims is the payload of a token. The subject is the account; tokens
+// issued before accounts were bound to a user_id carry no uid, and their
+// account's user_id was its name.
+type claims struct {
+	Subject   string `json:"sub"`
+	UserID    string `json:"uid,omitempty"`
+	Role      string `json:"role"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// Authenticator issues and verifies tokens and looks up API keys
+type Authenticator struct {
+	key []byte
+	ttl time.Duration
+
+	// apiKeys is keyed by the SHA-256 of each key, so a lookup does not
+	// compare the secret itself byte by byte
+	apiKeys map[[sha256.Size]byte]Principal
+	// resolve re-reads the account of a token, if set
+	resolve Resolver
+}
+
+// Resolver returns the current user_id and role of the account a token was
+// issued to, or ErrRevoked if the account is gone
+type Resolver func(ctx context.Context, p Principal) (Principal, error)
+
+// New creates an authenticator. key signs and verifies tokens, which are
+// issued for ttl; with an empty key only API keys are accepted. apiKeys
+// maps each API key to "user_id" or "user_id:role".
+func New(key string, ttl time.Duration, apiKeys map[string]string) (*Authenticator, error) {
+	if key != "" && len(key) < MinKeyLen {
+		return nil, fmt.Errorf("auth key must be at least %d bytes", MinKeyLen)
+	}
+
+	a := &Authenticator{key: []byte(key), ttl: ttl, apiKeys: make(map[[sha256.Size]byte]Principal, len(apiKeys))}
+	for k, v := range apiKeys {
+		userID, role, _ := strings.Cut(v, ":")
+		if role == "" {
+			role = RoleUser
+		}
+		if userID == "" {
+			return nil, fmt.Errorf("API key for %q names no user", v)
+		}
+		if role != RoleUser && role != RoleAdmin {
+			return nil, fmt.Errorf("API key for %s: role must be %s or %s", userID, RoleUser, RoleAdmin)
+		}
+		a.apiKeys[sha256.Sum256([]byte(k))] = Principal{UserID: userID, Role: role}
+	}
+	return a, nil
+}
+
+// ResolveAccounts makes every request authenticated with a token carry its
+// account's current user_id and role, as returned by resolve, instead of
+// those the token was issued with. Call it before serving requests.
+func (a *Authenticator) ResolveAccounts(resolve Resolver) {
+	a.resolve = resolve
+}
+
+// Issue signs a token for p's account, returning it and its expiry
+func (a *Authenticator) Issue(p Principal) (string, time.Time, error) {
+	if len(a.key) == 0 {
+		return "", time.Time{}, errors.New("no key configured to sign tokens")
+	}
+	if p.Account == "" {
+		return "", time.Time{}, errors.New("tokens are issued to accounts")
+	}
+
+	now := time.Now()
+	expires := now.Add(a.ttl)
+	c := claims{Subject: p.Account, UserID: p.UserID, Role: p.Role, IssuedAt: now.Unix(), ExpiresAt: expires.Unix()}
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	signed := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + a.sign(signed), expires, nil
+}
+
+// Verify checks a token's signature and expiry and returns its caller
+func (a *Authenticator) Verify(token string) (Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(a.key) == 0 || len(parts) != 3 {
+		return Principal{}, ErrInvalidToken
+	}
+
+	// Only HS256 is accepted, whatever the token's header claims
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(data, &header) != nil || header.Alg != "HS256" {
+		return Principal{}, ErrInvalidToken
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(a.sign(parts[0]+"."+parts[1]))) {
+		return Principal{}, ErrInvalidToken
+	}
+
+	var c claims
+	data, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(data, &c) != nil || c.Subject == "" {
+		return Principal{}, ErrInvalidToken
+	}
+	if c.Role != RoleUser && c.Role != RoleAdmin {
+		return Principal{}, ErrInvalidToken
+	}
+	if time.Now().Unix() >= c.ExpiresAt {
+		return Principal{}, ErrExpiredToken
+	}
+	userID := c.UserID
+	if userID == "" {
+		userID = c.Subject
+	}
+	return Principal{UserID: userID, Role: c.Role, Account: c.Subject}, nil
+}
+
+// sign returns the base64url HMAC-SHA256 of a token's header and payload
+func (a *Authenticator) sign(signed string) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Authenticate returns the caller of r from its Authorization or X-API-Key
+// header. A bearer credential is verified as a token if it has the three
+// parts of one and looked up as an API key otherwise.
+func (a *Authenticator) Authenticate(r *http.Request) (Principal, error) {
+	credential := r.Header.Get("X-API-Key")
+	if scheme, value, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		credential = strings.TrimSpace(value)
+	}
+	return a.check(credential)
+}
+
+// check verifies a token or looks up an API key
+func (a *Authenticator) check(credential string) (Principal, error) {
+	if credential == "" {
+		return Principal{}, ErrNoCredentials
+	}
+
+	if strings.Count(credential, ".") == 2 {
+		return a.Verify(credential)
+	}
+	p, ok := a.apiKeys[sha256.Sum256([]byte(credential))]
+	if !ok {
+		return Principal{}, ErrUnknownKey
+	}
+	return p, nil
+}
+
+// Require answers 401 to unauthenticated requests and passes the rest on
+// with their caller in the context
+func (a *Authenticator) Require(next http.Handler) http.Handler {
+	return a.require(next, a.Authenticate)
+}
+
+// RequireStream is Require for event streams. EventSource cannot set
+// headers, so the credential may also be sent as ?access_token=. No other
+// endpoint takes it there, where it ends up in access logs and histories.
+func (a *Authenticator) RequireStream(next http.Handler) http.Handler {
+	return a.require(next, func(r *http.Request) (Principal, error) {
+		p, err := a.Authenticate(r)
+		if err == ErrNoCredentials {
+			return a.check(r.URL.Query().Get("access_token"))
+		}
+		return p, err
+	})
+}
+
+// require answers 401 to requests authenticate rejects or whose account
+// is gone
+func (a *Authenticator) require(next http.Handler, authenticate func(*http.Request) (Principal, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := authenticate(r)
+		if err == nil && p.Account != "" && a.resolve != nil {
+			p, err = a.resolve(r.Context(), p)
+			if err != nil && err != ErrRevoked {
+				http.Error(w, "Error checking credentials", http.StatusInternalServerError)
+				return
+			}
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gps"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), p)))
+	})
+}
+
+// RequireAdmin is Require for endpoints only admins may call, answering 403
+// to everyone else
+func (a *Authenticator) RequireAdmin(next http.Handler) http.Handler {
+	return a.Require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p, _ := FromContext(r.Context()); !p.IsAdmin() {
+			http.Error(w, "admin role required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// principalKey is the context key of the caller
+type principalKey struct{}
+
+// NewContext returns a copy of ctx carrying the caller
+func NewContext(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the caller stored by Require, if any
+func FromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
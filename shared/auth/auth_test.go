@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAccessTokenOnlyOnStreams(t *testing.T) {
+	a, err := New("0123456789abcdef0123456789abcdef", time.Hour, map[string]string{"k1": "alice"})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	token, _, err := a.Issue(Principal{UserID: "alice", Role: RoleUser, Account: "alice"})
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name       string
+		stream     bool
+		target     string
+		header     string
+		wantStatus int
+	}{
+		{"header", false, "/events", "Bearer " + token, http.StatusOK},
+		{"api key header", false, "/events", "Bearer k1", http.StatusOK},
+		{"query token", false, "/events?access_token=" + token, "", http.StatusUnauthorized},
+		{"query api key", false, "/events?access_token=k1", "", http.StatusUnauthorized},
+		{"stream query token", true, "/events/stream?access_token=" + token, "", http.StatusOK},
+		{"stream header", true, "/events/stream", "Bearer " + token, http.StatusOK},
+		{"stream bad query token", true, "/events/stream?access_token=nope", "", http.StatusUnauthorized},
+		{"stream nothing", true, "/events/stream", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := a.Require(ok)
+			if tt.stream {
+				h = a.RequireStream(ok)
+			}
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestResolveAccounts(t *testing.T) {
+	a, err := New("0123456789abcdef0123456789abcdef", time.Hour, map[string]string{"k1": "svc:admin"})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	token, _, err := a.Issue(Principal{UserID: "u-1", Role: RoleAdmin, Account: "alice"})
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	gone, _, err := a.Issue(Principal{UserID: "u-2", Role: RoleUser, Account: "bob"})
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+
+	// alice has since been demoted and bound to another user_id; bob is deleted
+	a.ResolveAccounts(func(ctx context.Context, p Principal) (Principal, error) {
+		if p.Account != "alice" {
+			return Principal{}, ErrRevoked
+		}
+		return Principal{UserID: "runner", Role: RoleUser, Account: "alice"}, nil
+	})
+	var seen Principal
+	h := a.Require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = FromContext(r.Context())
+	}))
+
+	tests := []struct {
+		name       string
+		credential string
+		want       Principal
+		wantStatus int
+	}{
+		{"resolved token", token, Principal{UserID: "runner", Role: RoleUser, Account: "alice"}, http.StatusOK},
+		{"revoked token", gone, Principal{}, http.StatusUnauthorized},
+		{"api key left alone", "k1", Principal{UserID: "svc", Role: RoleAdmin}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen = Principal{}
+			r := httptest.NewRequest(http.MethodGet, "/events", nil)
+			r.Header.Set("Authorization", "Bearer "+tt.credential)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if seen != tt.want {
+				t.Errorf("caller %+v, want %+v", seen, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CORS lets browsers on an allow-list of origins call an API. It answers
+// every preflight itself, before authentication, since browsers send
+// preflights without credentials.
+type CORS struct {
+	origins map[string]bool
+	any     bool
+	expose  string
+}
+
+// NewCORS allows the given origins, such as "http://localhost:3000"; "*"
+// allows any. exposeHeaders lists response headers scripts may read.
+func NewCORS(origins []string, exposeHeaders ...string) (*CORS, error) {
+	c := &CORS{origins: make(map[string]bool, len(origins)), expose: strings.Join(exposeHeaders, ", ")}
+	for _, o := range origins {
+		if o == "*" {
+			c.any = true
+			continue
+		}
+		u, err := url.Parse(o)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return nil, fmt.Errorf("CORS origin %q must be scheme://host[:port]", o)
+		}
+		c.origins[u.Scheme+"://"+u.Host] = true
+	}
+	return c, nil
+}
+
+// Handler adds CORS headers for allowed origins and answers OPTIONS requests
+func (c *CORS) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if origin != "" && (c.any || c.origins[origin]) {
+			h.Set("Access-Control-Allow-Origin", origin)
+			if c.expose != "" {
+				h.Set("Access-Control-Expose-Headers", c.expose)
+			}
+		}
+
+		if r.Method == http.MethodOptions {
+			if h.Get("Access-Control-Allow-Origin") != "" {
+				h.Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE")
+				h.Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-API-Key")
+				h.Set("Access-Control-Max-Age", "600")
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,364 @@
+// Package config binds a service's settings struct to command-line flags,
+// environment variables and an optional JSON/YAML file.
+//
+// Fields opt in with struct tags:
+//
+//	Broker string `json:"broker" env:"KAFKA_BOOTSTRAP" flag:"broker" usage:"Kafka bootstrap servers"`
+//
+// Values are applied in increasing order of precedence: the struct's
+// initial (default) values, the config file, environment variables and
+// finally flags given on the command line. Fields tagged secret:"true" are
+// masked by Print.
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileEnv names the environment variable that may point at a config file
+const FileEnv = "CONFIG_FILE"
+
+// Validator is implemented by settings structs that can check themselves
+type Validator interface {
+	Validate() error
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// field is one configurable struct field
+type field struct {
+	key    string // json key used in config files and Print
+	env    string
+	flag   string
+	secret bool
+	value  reflect.Value
+}
+
+// Loader applies file, environment and flag values to a settings struct
+type Loader struct {
+	cfg         interface{}
+	fields      []field
+	flagValues  map[string]string
+	configFile  *string
+	printConfig *bool
+}
+
+// Register adds a flag for every tagged field of cfg (a pointer to a struct)
+// to fs, plus -config and -print-config. Call Load after fs has been parsed.
+func Register(fs *flag.FlagSet, cfg interface{}) *Loader {
+	rv := reflect.ValueOf(cfg)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		panic("config: Register needs a pointer to a struct")
+	}
+
+	l := &Loader{cfg: cfg, flagValues: map[string]string{}}
+	rv = rv.Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		key := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+
+		f := field{
+			key:    key,
+			env:    sf.Tag.Get("env"),
+			flag:   sf.Tag.Get("flag"),
+			secret: sf.Tag.Get("secret") == "true",
+			value:  rv.Field(i),
+		}
+		l.fields = append(l.fields, f)
+
+		if f.flag != "" {
+			usage := sf.Tag.Get("usage")
+			if f.env != "" {
+				usage += " (env " + f.env + ")"
+			}
+			fv := &flagValue{loader: l, name: f.flag, def: formatValue(f.value, f.secret)}
+			if f.value.Kind() == reflect.Bool {
+				fs.Var(&boolFlagValue{fv}, f.flag, usage)
+			} else {
+				fs.Var(fv, f.flag, usage)
+			}
+		}
+	}
+
+	l.configFile = fs.String("config", "", "optional JSON or YAML config file (env "+FileEnv+")")
+	l.printConfig = fs.Bool("print-config", false, "print the effective configuration and exit")
+	return l
+}
+
+// Load applies the config file, environment and parsed flags, then validates
+func (l *Loader) Load() error {
+	path := *l.configFile
+	if path == "" {
+		path = os.Getenv(FileEnv)
+	}
+	if path != "" {
+		if err := l.loadFile(path); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range l.fields {
+		if f.env == "" {
+			continue
+		}
+		if v, ok := os.LookupEnv(f.env); ok {
+			if err := setValue(f.value, v); err != nil {
+				return fmt.Errorf("config: env %s: %w", f.env, err)
+			}
+		}
+	}
+
+	for _, f := range l.fields {
+		if v, ok := l.flagValues[f.flag]; ok && f.flag != "" {
+			if err := setValue(f.value, v); err != nil {
+				return fmt.Errorf("config: flag -%s: %w", f.flag, err)
+			}
+		}
+	}
+
+	if v, ok := l.cfg.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return fmt.Errorf("config: %w", err)
+		}
+	}
+	return nil
+}
+
+// PrintRequested reports whether -print-config was given
+func (l *Loader) PrintRequested() bool {
+	return *l.printConfig
+}
+
+// Print writes the effective configuration as JSON, masking secrets
+func (l *Loader) Print(w io.Writer) error {
+	out := make(map[string]interface{}, len(l.fields))
+	for _, f := range l.fields {
+		switch {
+		case f.secret:
+			out[f.key] = formatValue(f.value, true)
+		case f.value.Type() == durationType:
+			out[f.key] = f.value.Interface().(time.Duration).String()
+		default:
+			out[f.key] = f.value.Interface()
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// loadFile applies values from a JSON or YAML file keyed by json tag
+func (l *Loader) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+
+	values := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, &values)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	default:
+		return fmt.Errorf("config: unsupported file format %q (want .json, .yaml or .yml)", filepath.Ext(path))
+	}
+	if err != nil {
+		return fmt.Errorf("config: parsing %s: %w", path, err)
+	}
+
+	known := map[string]field{}
+	for _, f := range l.fields {
+		known[f.key] = f
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		f, ok := known[k]
+		if !ok {
+			return fmt.Errorf("config: %s: unknown key %q", path, k)
+		}
+		if err := setValue(f.value, fileValueString(values[k])); err != nil {
+			return fmt.Errorf("config: %s: %s: %w", path, k, err)
+		}
+	}
+	return nil
+}
+
+// fileValueString flattens a decoded file value to the string form used by
+// flags and environment variables
+func fileValueString(v interface{}) string {
+	switch t := v.(type) {
+	case []interface{}:
+		parts := make([]string, len(t))
+		for i, p := range t {
+			parts[i] = fmt.Sprint(p)
+		}
+		return strings.Join(parts, ",")
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		parts := make([]string, len(keys))
+		for i, k := range keys {
+			parts[i] = k + "=" + fmt.Sprint(t[k])
+		}
+		return strings.Join(parts, ",")
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+// setValue parses s into the field according to its type. Lists are comma
+// separated and maps are comma separated key=value pairs.
+func setValue(v reflect.Value, s string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported list type %s", v.Type())
+		}
+		list := []string{}
+		for _, p := range strings.Split(s, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				list = append(list, p)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String || v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported map type %s", v.Type())
+		}
+		m := map[string]string{}
+		for _, p := range strings.Split(s, ",") {
+			if p = strings.TrimSpace(p); p == "" {
+				continue
+			}
+			k, val, ok := strings.Cut(p, "=")
+			if !ok {
+				return fmt.Errorf("expected key=value, got %q", p)
+			}
+			m[strings.TrimSpace(k)] = strings.TrimSpace(val)
+		}
+		v.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// formatValue renders a field's value in flag/env string form
+func formatValue(v reflect.Value, secret bool) string {
+	if secret {
+		if v.Kind() == reflect.String && v.Len() == 0 {
+			return ""
+		}
+		return "******"
+	}
+	if v.Type() == durationType {
+		return v.Interface().(time.Duration).String()
+	}
+
+	switch v.Kind() {
+	case reflect.Slice:
+		parts := make([]string, v.Len())
+		for i := range parts {
+			parts[i] = v.Index(i).String()
+		}
+		return strings.Join(parts, ",")
+	case reflect.Map:
+		keys := make([]string, 0, v.Len())
+		for _, k := range v.MapKeys() {
+			keys = append(keys, k.String())
+		}
+		sort.Strings(keys)
+		parts := make([]string, len(keys))
+		for i, k := range keys {
+			parts[i] = k + "=" + v.MapIndex(reflect.ValueOf(k)).String()
+		}
+		return strings.Join(parts, ",")
+	default:
+		return fmt.Sprint(v.Interface())
+	}
+}
+
+// flagValue records a flag's raw value so it can be applied after the file
+// and environment, giving the command line the last word
+type flagValue struct {
+	loader *Loader
+	name   string
+	def    string
+}
+
+func (f *flagValue) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.def
+}
+
+func (f *flagValue) Set(s string) error {
+	f.loader.flagValues[f.name] = s
+	return nil
+}
+
+// boolFlagValue lets boolean fields be given as -flag without a value
+type boolFlagValue struct {
+	*flagValue
+}
+
+func (b *boolFlagValue) IsBoolFlag() bool { return true }
@@ -0,0 +1,179 @@
+package events
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// avroWriterField is one field of the schema a message was written with
+type avroWriterField struct {
+	name     string
+	typ      string // int, long, string or double
+	nullable bool   // a ["null", typ] union
+}
+
+// parseAvroSchema reads the fields of a record schema produced by avroSchema.
+// Decoding walks the writer's fields and matches them to the reader's by
+// name, so messages written before or after a field was added still decode.
+func parseAvroSchema(schema string) ([]avroWriterField, error) {
+	var record struct {
+		Type   string `json:"type"`
+		Fields []struct {
+			Name string          `json:"name"`
+			Type json.RawMessage `json:"type"`
+		} `json:"fields"`
+	}
+	if err := json.Unmarshal([]byte(schema), &record); err != nil {
+		return nil, fmt.Errorf("avro: parsing schema: %w", err)
+	}
+	if record.Type != "record" {
+		return nil, fmt.Errorf("avro: schema type %q is not a record", record.Type)
+	}
+
+	fields := make([]avroWriterField, 0, len(record.Fields))
+	for _, f := range record.Fields {
+		field := avroWriterField{name: f.Name}
+		var union []string
+		if err := json.Unmarshal(f.Type, &field.typ); err != nil {
+			if err := json.Unmarshal(f.Type, &union); err != nil || len(union) != 2 || union[0] != "null" {
+				return nil, fmt.Errorf("avro: field %s: unsupported type %s", f.Name, f.Type)
+			}
+			field.typ, field.nullable = union[1], true
+		}
+		switch field.typ {
+		case "int", "long", "string", "double":
+		default:
+			return nil, fmt.Errorf("avro: field %s: unsupported type %q", f.Name, field.typ)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// encodeAvro writes e in Avro binary encoding, fields in table order
+func encodeAvro(e Event) []byte {
+	var buf []byte
+	for _, f := range e.fields() {
+		switch v := f.ptr.(type) {
+		case *int:
+			buf = binary.AppendVarint(buf, int64(*v))
+		case *int64:
+			buf = binary.AppendVarint(buf, *v)
+		case *string:
+			buf = binary.AppendVarint(buf, int64(len(*v)))
+			buf = append(buf, *v...)
+		case *float64:
+			buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(*v))
+		case **float64:
+			if *v == nil {
+				buf = binary.AppendVarint(buf, 0)
+			} else {
+				buf = binary.AppendVarint(buf, 1)
+				buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(**v))
+			}
+		}
+	}
+	return buf
+}
+
+// decodeAvro reads a message written with the writer schema into e. Writer
+// fields e does not have are read and dropped; fields e has that the writer
+// did not are left at their zero value.
+func decodeAvro(data []byte, writer []avroWriterField, e Event) error {
+	byName := map[string]fieldRef{}
+	for _, f := range e.fields() {
+		byName[f.name] = f
+	}
+
+	for _, wf := range writer {
+		present := true
+		if wf.nullable {
+			branch, n := binary.Varint(data)
+			if n <= 0 {
+				return fmt.Errorf("avro: field %s: %w", wf.name, errTruncated)
+			}
+			data = data[n:]
+			switch branch {
+			case 0:
+				present = false
+			case 1:
+			default:
+				return fmt.Errorf("avro: field %s: invalid union branch %d", wf.name, branch)
+			}
+		}
+
+		var long int64
+		var double float64
+		var str string
+		if present {
+			switch wf.typ {
+			case "int", "long":
+				v, n := binary.Varint(data)
+				if n <= 0 {
+					return fmt.Errorf("avro: field %s: %w", wf.name, errTruncated)
+				}
+				long, data = v, data[n:]
+			case "string":
+				size, n := binary.Varint(data)
+				if n <= 0 || size < 0 || size > int64(len(data)-n) {
+					return fmt.Errorf("avro: field %s: %w", wf.name, errTruncated)
+				}
+				str, data = string(data[n:n+int(size)]), data[n+int(size):]
+			case "double":
+				if len(data) < 8 {
+					return fmt.Errorf("avro: field %s: %w", wf.name, errTruncated)
+				}
+				double, data = math.Float64frombits(binary.LittleEndian.Uint64(data)), data[8:]
+			}
+		}
+
+		f, ok := byName[wf.name]
+		if !ok {
+			continue
+		}
+		if err := setAvroField(f, wf, present, long, double, str); err != nil {
+			return err
+		}
+	}
+	if len(data) > 0 {
+		return fmt.Errorf("avro: %d trailing bytes", len(data))
+	}
+	return nil
+}
+
+// setAvroField stores a decoded value, checking the writer's type can be
+// read as the reader's
+func setAvroField(f fieldRef, wf avroWriterField, present bool, long int64, double float64, str string) error {
+	if !present {
+		if v, ok := f.ptr.(**float64); ok {
+			*v = nil
+			return nil
+		}
+		return fmt.Errorf("avro: field %s: null for a required field", f.name)
+	}
+
+	ok := false
+	switch v := f.ptr.(type) {
+	case *int:
+		ok = wf.typ == "int"
+		*v = int(long)
+	case *int64:
+		ok = wf.typ == "int" || wf.typ == "long"
+		*v = long
+	case *string:
+		ok = wf.typ == "string"
+		*v = str
+	case *float64:
+		ok = wf.typ == "double"
+		*v = double
+	case **float64:
+		ok = wf.typ == "double"
+		*v = &double
+	}
+	if !ok {
+		return fmt.Errorf("avro: field %s: cannot read %s as %T", f.name, wf.typ, f.ptr)
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+// Package events defines the messages exchanged over Kafka by the producer
+// and consumer, and the rules every message must satisfy.
+//
+// Each event carries a schema_version. The JSON Schema for each type lives
+// in schema/ and is served by the consumer under /schemas/; Validate mirrors
+// those schemas so both services reject the same messages.
+//
+// Compatibility policy:
+//
+//   - Adding an optional field (as ele was added for elevation, or a future
+//     speed) is backwards compatible and does not change SchemaVersion. Old
+//     readers ignore fields they do not know, and new readers must treat the
+//     field as absent in older messages, so new fields are pointers or have
+//     omitempty and a meaningful zero value.
+//   - Removing or renaming a field, changing its type or units, or tightening
+//     validation is a breaking change: bump SchemaVersion, and deploy
+//     consumers that understand the new version before producers emit it.
+//   - Readers reject messages with a schema_version newer than they know.
+//     Messages without one predate versioning and are read as version 1.
+package events
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// SchemaVersion is the version of the event contract this package writes
+const SchemaVersion = 1
+
+// Session event types
+const (
+	SessionStart = "session_start"
+	SessionEnd   = "session_end"
+)
+
+// Geofence event types
+const (
+	GeofenceEnter = "enter"
+	GeofenceExit  = "exit"
+)
+
+// User event types
+const (
+	UserRegistered      = "user_registered"
+	UserUpdated         = "user_updated"
+	UserLocationSaved   = "location_saved"
+	UserLocationRemoved = "location_removed"
+)
+
+// Schemas holds the JSON Schema documents for each event type
+//
+//go:embed schema/*.json
+var Schemas embed.FS
+
+// Event is implemented by every message type in the contract
+type Event interface {
+	// Validate reports every field that breaks the contract
+	Validate() error
+
+	version() *int
+	record() string
+	fields() []fieldRef
+}
+
+// CoordinateEvent is a single GPS fix
+type CoordinateEvent struct {
+	SchemaVersion int     `json:"schema_version,omitempty"`
+	UserID        string  `json:"user_id"`
+	SessionID     string  `json:"session_id,omitempty"`
+	Lat           float64 `json:"lat"`
+	Lon           float64 `json:"lon"`
+	Timestamp     string  `json:"timestamp"`
+
+	// Ele is the elevation in metres, when the source provides one
+	Ele *float64 `json:"ele,omitempty"`
+}
+
+// LocationEvent is a check-in at a named place
+type LocationEvent struct {
+	SchemaVersion int     `json:"schema_version,omitempty"`
+	UserID        string  `json:"user_id"`
+	SessionID     string  `json:"session_id,omitempty"`
+	Location      string  `json:"location"`
+	Lat           float64 `json:"lat"`
+	Lon           float64 `json:"lon"`
+	Timestamp     string  `json:"timestamp"`
+}
+
+// SessionEvent marks the start or end of an activity session
+type SessionEvent struct {
+	SchemaVersion int    `json:"schema_version,omitempty"`
+	Type          string `json:"type"`
+	SessionID     string `json:"session_id"`
+	UserID        string `json:"user_id"`
+	Activity      string `json:"activity"`
+	Timestamp     string `json:"timestamp"`
+}
+
+// GeofenceEvent records a user entering or leaving a geofence
+type GeofenceEvent struct {
+	SchemaVersion int     `json:"schema_version,omitempty"`
+	Type          string  `json:"type"`
+	GeofenceID    int64   `json:"geofence_id"`
+	GeofenceName  string  `json:"geofence_name"`
+	UserID        string  `json:"user_id"`
+	SessionID     string  `json:"session_id,omitempty"`
+	Lat           float64 `json:"lat"`
+	Lon           float64 `json:"lon"`
+	Timestamp     string  `json:"timestamp"`
+}
+
+// UserEvent records a change to a user account. It names what changed but
+// carries no profile data, so services that need the profile read it from
+// the consumer's API.
+type UserEvent struct {
+	SchemaVersion int    `json:"schema_version,omitempty"`
+	Type          string `json:"type"`
+	UserID        string `json:"user_id"`
+	// Changed lists the profile fields a user_updated event changed, comma-separated
+	Changed string `json:"changed,omitempty"`
+	// LocationID is the saved location of a location_saved or location_removed event
+	LocationID string `json:"location_id,omitempty"`
+	Timestamp  string `json:"timestamp"`
+}
+
+func (e *CoordinateEvent) version() *int { return &e.SchemaVersion }
+func (e *LocationEvent) version() *int   { return &e.SchemaVersion }
+func (e *SessionEvent) version() *int    { return &e.SchemaVersion }
+func (e *GeofenceEvent) version() *int   { return &e.SchemaVersion }
+func (e *UserEvent) version() *int       { return &e.SchemaVersion }
+
+// FieldError describes one field that failed validation
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every field of an event that failed validation
+type ValidationError []FieldError
+
+func (v ValidationError) Error() string {
+	msgs := make([]string, len(v))
+	for i, f := range v {
+		msgs[i] = f.Field + ": " + f.Message
+	}
+	return "invalid event: " + strings.Join(msgs, "; ")
+}
+
+// fieldErrors collects FieldErrors while validating
+type fieldErrors ValidationError
+
+func (f *fieldErrors) add(field, format string, args ...interface{}) {
+	*f = append(*f, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// err returns nil when nothing failed, so callers can compare against nil
+func (f fieldErrors) err() error {
+	if len(f) == 0 {
+		return nil
+	}
+	return ValidationError(f)
+}
+
+func (f *fieldErrors) required(field, value string) {
+	if strings.TrimSpace(value) == "" {
+		f.add(field, "is required")
+	}
+}
+
+func (f *fieldErrors) position(lat, lon float64) {
+	if math.IsNaN(lat) || lat < -90 || lat > 90 {
+		f.add("lat", "must be between -90 and 90")
+	}
+	if math.IsNaN(lon) || lon < -180 || lon > 180 {
+		f.add("lon", "must be between -180 and 180")
+	}
+}
+
+func (f *fieldErrors) timestamp(value string) {
+	if value == "" {
+		f.add("timestamp", "is required")
+	} else if _, err := time.Parse(time.RFC3339, value); err != nil {
+		f.add("timestamp", "must be an RFC3339 time")
+	}
+}
+
+func (f *fieldErrors) version(v int) {
+	if v < 0 || v > SchemaVersion {
+		f.add("schema_version", "unsupported version %d (this build understands up to %d)", v, SchemaVersion)
+	}
+}
+
+// Validate checks the fix has a user, a position on the globe and a timestamp
+func (e *CoordinateEvent) Validate() error {
+	var f fieldErrors
+	f.version(e.SchemaVersion)
+	f.required("user_id", e.UserID)
+	f.position(e.Lat, e.Lon)
+	f.timestamp(e.Timestamp)
+	if e.Ele != nil && (math.IsNaN(*e.Ele) || math.IsInf(*e.Ele, 0)) {
+		f.add("ele", "must be a finite number")
+	}
+	return f.err()
+}
+
+// Validate checks the check-in names a place and has a position and timestamp
+func (e *LocationEvent) Validate() error {
+	var f fieldErrors
+	f.version(e.SchemaVersion)
+	f.required("user_id", e.UserID)
+	f.required("location", e.Location)
+	f.position(e.Lat, e.Lon)
+	f.timestamp(e.Timestamp)
+	return f.err()
+}
+
+// Validate checks the event starts or ends an identified session
+func (e *SessionEvent) Validate() error {
+	var f fieldErrors
+	f.version(e.SchemaVersion)
+	if e.Type != SessionStart && e.Type != SessionEnd {
+		f.add("type", "must be %q or %q", SessionStart, SessionEnd)
+	}
+	f.required("session_id", e.SessionID)
+	f.required("user_id", e.UserID)
+	f.timestamp(e.Timestamp)
+	return f.err()
+}
+
+// Validate checks the event enters or exits an identified fence
+func (e *GeofenceEvent) Validate() error {
+	var f fieldErrors
+	f.version(e.SchemaVersion)
+	if e.Type != GeofenceEnter && e.Type != GeofenceExit {
+		f.add("type", "must be %q or %q", GeofenceEnter, GeofenceExit)
+	}
+	if e.GeofenceID <= 0 {
+		f.add("geofence_id", "must be positive")
+	}
+	f.required("user_id", e.UserID)
+	f.position(e.Lat, e.Lon)
+	f.timestamp(e.Timestamp)
+	return f.err()
+}
+
+// Validate checks the event names a known change to an identified user
+func (e *UserEvent) Validate() error {
+	var f fieldErrors
+	f.version(e.SchemaVersion)
+	switch e.Type {
+	case UserRegistered, UserUpdated:
+	case UserLocationSaved, UserLocationRemoved:
+		f.required("location_id", e.LocationID)
+	default:
+		f.add("type", "must be %q, %q, %q or %q", UserRegistered, UserUpdated, UserLocationSaved, UserLocationRemoved)
+	}
+	f.required("user_id", e.UserID)
+	f.timestamp(e.Timestamp)
+	return f.err()
+}
+
+// TimestampLayout is the fixed-width UTC form of an RFC3339 time. Timestamps
+// in this form sort as strings in time order and start with their date.
+const TimestampLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+// NormalizeTimestamp rewrites an RFC3339 time in TimestampLayout, keeping
+// its sub-second precision
+func NormalizeTimestamp(value string) (string, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", err
+	}
+	return t.UTC().Format(TimestampLayout), nil
+}
+
+// Marshal stamps e with the current SchemaVersion, validates it and encodes it as JSON
+func Marshal(e Event) ([]byte, error) {
+	*e.version() = SchemaVersion
+	if err := e.Validate(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(e)
+}
+
+// Unmarshal decodes a JSON message into e and validates it. Unknown fields
+// are ignored so that readers accept messages from newer minor revisions.
+func Unmarshal(data []byte, e Event) error {
+	if err := json.Unmarshal(data, e); err != nil {
+		return err
+	}
+	return finish(e)
+}
+
+// finish validates a decoded event
+func finish(e Event) error {
+	if *e.version() == 0 {
+		// Written before events were versioned
+		*e.version() = 1
+	}
+	return e.Validate()
+}
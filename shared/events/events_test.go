@@ -0,0 +1,59 @@
+package events
+
+import "testing"
+
+func TestNormalizeTimestamp(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"utc", "2026-10-16T23:30:00Z", "2026-10-16T23:30:00.000000000Z", false},
+		{"negative offset crosses midnight", "2026-10-16T23:30:00-05:00", "2026-10-17T04:30:00.000000000Z", false},
+		{"positive offset", "2026-10-17T01:00:00+02:00", "2026-10-16T23:00:00.000000000Z", false},
+		{"fractional seconds kept", "2026-10-16T10:00:00.987654Z", "2026-10-16T10:00:00.987654000Z", false},
+		{"not rfc3339", "2026-10-16 10:00:00", "", true},
+		{"missing", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizeTimestamp(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NormalizeTimestamp() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("NormalizeTimestamp() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizedTimestampsSortInTimeOrder(t *testing.T) {
+	earlier, _ := NormalizeTimestamp("2026-10-16T10:00:00Z")
+	later, _ := NormalizeTimestamp("2026-10-16T10:00:00.5Z")
+	if earlier >= later {
+		t.Errorf("%q sorts after %q", earlier, later)
+	}
+}
+
+func TestValidateLeavesTimestamp(t *testing.T) {
+	const ts = "2026-10-16T23:30:00.5-05:00"
+	e := CoordinateEvent{UserID: "u1", Lat: 1, Lon: 2, Timestamp: ts}
+	if err := e.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if e.Timestamp != ts {
+		t.Errorf("timestamp = %q, want it unchanged", e.Timestamp)
+	}
+
+	var s SessionEvent
+	err := Unmarshal([]byte(`{"type":"session_start","session_id":"s1","user_id":"u1","timestamp":"`+ts+`"}`), &s)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if s.Timestamp != ts {
+		t.Errorf("unmarshalled timestamp = %q, want it unchanged", s.Timestamp)
+	}
+}
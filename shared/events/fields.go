@@ -0,0 +1,165 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// namespace qualifies the Protobuf package and Avro record names
+const namespace = "gps.events"
+
+// fieldRef binds one field of an event to its wire description. ptr is a
+// *int, *int64, *string, *float64 or **float64 (an optional double).
+// Protobuf field numbers and Avro field order come from this table, so new
+// fields go at the end with a new number and are never reused.
+type fieldRef struct {
+	number int
+	name   string
+	ptr    interface{}
+}
+
+func (e *CoordinateEvent) record() string { return "CoordinateEvent" }
+func (e *LocationEvent) record() string   { return "LocationEvent" }
+func (e *SessionEvent) record() string    { return "SessionEvent" }
+func (e *GeofenceEvent) record() string   { return "GeofenceEvent" }
+func (e *UserEvent) record() string       { return "UserEvent" }
+
+func (e *CoordinateEvent) fields() []fieldRef {
+	return []fieldRef{
+		{1, "schema_version", &e.SchemaVersion},
+		{2, "user_id", &e.UserID},
+		{3, "session_id", &e.SessionID},
+		{4, "lat", &e.Lat},
+		{5, "lon", &e.Lon},
+		{6, "timestamp", &e.Timestamp},
+		{7, "ele", &e.Ele},
+	}
+}
+
+func (e *LocationEvent) fields() []fieldRef {
+	return []fieldRef{
+		{1, "schema_version", &e.SchemaVersion},
+		{2, "user_id", &e.UserID},
+		{3, "session_id", &e.SessionID},
+		{4, "location", &e.Location},
+		{5, "lat", &e.Lat},
+		{6, "lon", &e.Lon},
+		{7, "timestamp", &e.Timestamp},
+	}
+}
+
+func (e *SessionEvent) fields() []fieldRef {
+	return []fieldRef{
+		{1, "schema_version", &e.SchemaVersion},
+		{2, "type", &e.Type},
+		{3, "session_id", &e.SessionID},
+		{4, "user_id", &e.UserID},
+		{5, "activity", &e.Activity},
+		{6, "timestamp", &e.Timestamp},
+	}
+}
+
+func (e *GeofenceEvent) fields() []fieldRef {
+	return []fieldRef{
+		{1, "schema_version", &e.SchemaVersion},
+		{2, "type", &e.Type},
+		{3, "geofence_id", &e.GeofenceID},
+		{4, "geofence_name", &e.GeofenceName},
+		{5, "user_id", &e.UserID},
+		{6, "session_id", &e.SessionID},
+		{7, "lat", &e.Lat},
+		{8, "lon", &e.Lon},
+		{9, "timestamp", &e.Timestamp},
+	}
+}
+
+func (e *UserEvent) fields() []fieldRef {
+	return []fieldRef{
+		{1, "schema_version", &e.SchemaVersion},
+		{2, "type", &e.Type},
+		{3, "user_id", &e.UserID},
+		{4, "changed", &e.Changed},
+		{5, "location_id", &e.LocationID},
+		{6, "timestamp", &e.Timestamp},
+	}
+}
+
+// allEvents returns an empty instance of every event type, in the order
+// their schemas are registered. New types go at the end so the IDs of the
+// existing schemas do not change.
+func allEvents() []Event {
+	return []Event{&CoordinateEvent{}, &LocationEvent{}, &SessionEvent{}, &GeofenceEvent{}, &UserEvent{}}
+}
+
+// subject names the registry subject of an event type, following
+// Confluent's RecordNameStrategy so it does not depend on the topic
+func subject(e Event) string {
+	return namespace + "." + e.record()
+}
+
+// protoSchema renders the proto3 definition of an event type
+func protoSchema(e Event) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "syntax = \"proto3\";\n\npackage %s;\n\nmessage %s {\n", namespace, e.record())
+	for _, f := range e.fields() {
+		var typ string
+		switch f.ptr.(type) {
+		case *int:
+			typ = "int32"
+		case *int64:
+			typ = "int64"
+		case *string:
+			typ = "string"
+		case *float64:
+			typ = "double"
+		case **float64:
+			typ = "optional double"
+		default:
+			panic(fmt.Sprintf("events: unsupported field type %T", f.ptr))
+		}
+		fmt.Fprintf(&b, "  %s %s = %d;\n", typ, f.name, f.number)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// avroSchema renders the Avro record schema of an event type
+func avroSchema(e Event) string {
+	type avroField struct {
+		Name    string      `json:"name"`
+		Type    interface{} `json:"type"`
+		Default interface{} `json:"default,omitempty"`
+	}
+	fields := []avroField{}
+	for _, f := range e.fields() {
+		field := avroField{Name: f.name}
+		switch f.ptr.(type) {
+		case *int:
+			field.Type = "int"
+		case *int64:
+			field.Type = "long"
+		case *string:
+			field.Type = "string"
+		case *float64:
+			field.Type = "double"
+		case **float64:
+			field.Type = []string{"null", "double"}
+			field.Default = json.RawMessage("null")
+		default:
+			panic(fmt.Sprintf("events: unsupported field type %T", f.ptr))
+		}
+		fields = append(fields, field)
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"type":      "record",
+		"name":      e.record(),
+		"namespace": namespace,
+		"fields":    fields,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return string(data)
+}
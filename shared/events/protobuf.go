@@ -0,0 +1,145 @@
+package events
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Protobuf wire types used by the event messages
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("truncated message")
+
+// encodeProto writes e as a proto3 message. Scalars holding their zero value
+// are omitted, as proto3 does; optional fields are written whenever set.
+func encodeProto(e Event) []byte {
+	var buf []byte
+	for _, f := range e.fields() {
+		switch v := f.ptr.(type) {
+		case *int:
+			if *v != 0 {
+				buf = appendTag(buf, f.number, wireVarint)
+				buf = binary.AppendUvarint(buf, uint64(int64(*v)))
+			}
+		case *int64:
+			if *v != 0 {
+				buf = appendTag(buf, f.number, wireVarint)
+				buf = binary.AppendUvarint(buf, uint64(*v))
+			}
+		case *string:
+			if *v != "" {
+				buf = appendTag(buf, f.number, wireBytes)
+				buf = binary.AppendUvarint(buf, uint64(len(*v)))
+				buf = append(buf, *v...)
+			}
+		case *float64:
+			if *v != 0 {
+				buf = appendTag(buf, f.number, wireFixed64)
+				buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(*v))
+			}
+		case **float64:
+			if *v != nil {
+				buf = appendTag(buf, f.number, wireFixed64)
+				buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(**v))
+			}
+		}
+	}
+	return buf
+}
+
+func appendTag(buf []byte, number, wireType int) []byte {
+	return binary.AppendUvarint(buf, uint64(number)<<3|uint64(wireType))
+}
+
+// decodeProto reads a proto3 message into e. Fields e does not know are
+// skipped, so messages from newer revisions of the schema still decode.
+func decodeProto(data []byte, e Event) error {
+	byNumber := map[int]fieldRef{}
+	for _, f := range e.fields() {
+		byNumber[f.number] = f
+	}
+
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fmt.Errorf("protobuf: %w", errTruncated)
+		}
+		data = data[n:]
+		number, wireType := int(tag>>3), int(tag&7)
+
+		// Read the raw value according to its wire type
+		var varint uint64
+		var raw []byte
+		switch wireType {
+		case wireVarint:
+			if varint, n = binary.Uvarint(data); n <= 0 {
+				return fmt.Errorf("protobuf: field %d: %w", number, errTruncated)
+			}
+		case wireFixed64:
+			n = 8
+		case wireBytes:
+			size, m := binary.Uvarint(data)
+			if m <= 0 || size > uint64(len(data)-m) {
+				return fmt.Errorf("protobuf: field %d: %w", number, errTruncated)
+			}
+			raw = data[m : m+int(size)]
+			n = m + int(size)
+		case wireFixed32:
+			n = 4
+		default:
+			return fmt.Errorf("protobuf: field %d: unsupported wire type %d", number, wireType)
+		}
+		if n > len(data) {
+			return fmt.Errorf("protobuf: field %d: %w", number, errTruncated)
+		}
+		if wireType == wireFixed64 {
+			varint = binary.LittleEndian.Uint64(data)
+		}
+		data = data[n:]
+
+		f, ok := byNumber[number]
+		if !ok {
+			continue
+		}
+		if err := setProtoField(f, wireType, varint, raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setProtoField stores a decoded value, checking the wire type matches the field
+func setProtoField(f fieldRef, wireType int, varint uint64, raw []byte) error {
+	want := wireVarint
+	switch f.ptr.(type) {
+	case *string:
+		want = wireBytes
+	case *float64, **float64:
+		want = wireFixed64
+	}
+	if wireType != want {
+		return fmt.Errorf("protobuf: field %s: wire type %d, want %d", f.name, wireType, want)
+	}
+
+	switch v := f.ptr.(type) {
+	case *int:
+		*v = int(int32(varint))
+	case *int64:
+		*v = int64(varint)
+	case *string:
+		*v = string(raw)
+	case *float64:
+		*v = math.Float64frombits(varint)
+	case **float64:
+		d := math.Float64frombits(varint)
+		*v = &d
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Schema types, as named by the Confluent Schema Registry
+const (
+	SchemaTypeProtobuf = "PROTOBUF"
+	SchemaTypeAvro     = "AVRO"
+)
+
+// ErrSchemaNotFound is returned for a schema ID the registry does not hold
+var ErrSchemaNotFound = errors.New("schema not found")
+
+// Schema is one registered version of a subject's schema
+type Schema struct {
+	ID         int    `json:"id"`
+	Subject    string `json:"subject"`
+	Version    int    `json:"version"`
+	SchemaType string `json:"schemaType"`
+	Schema     string `json:"schema"`
+}
+
+// Registry is a stand-in for the Confluent Schema Registry: it assigns
+// schema IDs and versions per subject without an external service. With a
+// path it is kept in a JSON file, so services sharing the file agree on IDs;
+// without one it lives in memory.
+//
+// The file is re-read before every registration and whenever an unknown ID
+// is looked up, which lets a reader find schemas another process registered
+// after it started. Concurrent registrations from different processes are
+// not locked against each other, so point only one writer at a fresh file.
+type Registry struct {
+	mu      sync.Mutex
+	path    string
+	schemas []Schema
+}
+
+// OpenRegistry loads the registry kept at path, or creates an in-memory one
+// if path is empty. A missing file is created on the first registration.
+func OpenRegistry(path string) (*Registry, error) {
+	r := &Registry{path: path}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load replaces the in-memory schemas with the file's contents
+func (r *Registry) load() error {
+	if r.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("schema registry: %w", err)
+	}
+
+	var schemas []Schema
+	if err := json.Unmarshal(data, &schemas); err != nil {
+		return fmt.Errorf("schema registry: parsing %s: %w", r.path, err)
+	}
+	r.schemas = schemas
+	return nil
+}
+
+// save writes the schemas to a temporary file and renames it into place, so
+// readers never see a partial registry
+func (r *Registry) save() error {
+	if r.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(r.schemas, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), filepath.Base(r.path)+".*")
+	if err != nil {
+		return fmt.Errorf("schema registry: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("schema registry: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("schema registry: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), r.path); err != nil {
+		return fmt.Errorf("schema registry: %w", err)
+	}
+	return nil
+}
+
+// Register returns the registered schema matching subject, type and text,
+// adding it as the subject's next version if it is new
+func (r *Registry) Register(subject, schemaType, schema string) (Schema, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.load(); err != nil {
+		return Schema{}, err
+	}
+
+	id, version := 0, 0
+	for _, s := range r.schemas {
+		if s.Subject == subject && s.SchemaType == schemaType && s.Schema == schema {
+			return s, nil
+		}
+		if s.ID > id {
+			id = s.ID
+		}
+		if s.Subject == subject && s.Version > version {
+			version = s.Version
+		}
+	}
+
+	s := Schema{ID: id + 1, Subject: subject, Version: version + 1, SchemaType: schemaType, Schema: schema}
+	r.schemas = append(r.schemas, s)
+	if err := r.save(); err != nil {
+		r.schemas = r.schemas[:len(r.schemas)-1]
+		return Schema{}, err
+	}
+	return s, nil
+}
+
+// ByID returns the schema registered under id
+func (r *Registry) ByID(id int) (Schema, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if s, ok := r.find(id); ok {
+		return s, nil
+	}
+	// Another process may have registered it since we last looked
+	if err := r.load(); err != nil {
+		return Schema{}, err
+	}
+	if s, ok := r.find(id); ok {
+		return s, nil
+	}
+	return Schema{}, fmt.Errorf("schema id %d: %w", id, ErrSchemaNotFound)
+}
+
+func (r *Registry) find(id int) (Schema, bool) {
+	for _, s := range r.schemas {
+		if s.ID == id {
+			return s, true
+		}
+	}
+	return Schema{}, false
+}
+
+// Subjects lists the registered subjects in name order
+func (r *Registry) Subjects() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	seen := map[string]bool{}
+	subjects := []string{}
+	for _, s := range r.schemas {
+		if !seen[s.Subject] {
+			seen[s.Subject] = true
+			subjects = append(subjects, s.Subject)
+		}
+	}
+	sort.Strings(subjects)
+	return subjects
+}
+
+// Versions returns every version of a subject, oldest first
+func (r *Registry) Versions(subject string) []Schema {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	versions := []Schema{}
+	for _, s := range r.schemas {
+		if s.Subject == subject {
+			versions = append(versions, s)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	return versions
+}
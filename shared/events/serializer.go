@@ -0,0 +1,194 @@
+package events
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Wire formats a Serializer can write
+const (
+	FormatJSON     = "json"
+	FormatProtobuf = "protobuf"
+	FormatAvro     = "avro"
+)
+
+// Formats lists every supported wire format
+var Formats = []string{FormatJSON, FormatProtobuf, FormatAvro}
+
+// magicByte starts every message in the Confluent wire format, followed by
+// the 4-byte big-endian schema ID
+const magicByte = 0
+
+// Serializer encodes events in a configured wire format and decodes
+// messages in any of them.
+//
+// JSON is written as a plain document, as before formats were selectable.
+// Protobuf and Avro are framed in the Confluent wire format: a zero magic
+// byte, the schema ID from the registry and, for Protobuf, the message
+// index list, which is always the single first message. Readers tell the
+// framing apart by the first byte, since a JSON object starts with '{', so
+// producers can switch format without coordinating with consumers.
+type Serializer struct {
+	format   string
+	registry *Registry
+	ids      map[string]int // writer schema ID by record name
+
+	mu   sync.Mutex
+	avro map[int][]avroWriterField // parsed writer schemas by ID
+}
+
+// ValidFormat reports whether format names a supported wire format
+func ValidFormat(format string) bool {
+	for _, f := range Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// NewSerializer registers the Protobuf and Avro schemas of every event type
+// in registry and returns a serializer writing format. Both binary formats
+// are always registered, in a fixed order, so services using separate
+// in-memory registries still assign the same IDs.
+func NewSerializer(format string, registry *Registry) (*Serializer, error) {
+	if !ValidFormat(format) {
+		return nil, fmt.Errorf("unknown event format %q (want %s, %s or %s)", format, FormatJSON, FormatProtobuf, FormatAvro)
+	}
+
+	s := &Serializer{
+		format:   format,
+		registry: registry,
+		ids:      map[string]int{},
+		avro:     map[int][]avroWriterField{},
+	}
+	for _, e := range allEvents() {
+		schemas := []struct{ typ, text string }{
+			{SchemaTypeProtobuf, protoSchema(e)},
+			{SchemaTypeAvro, avroSchema(e)},
+		}
+		for _, sc := range schemas {
+			registered, err := registry.Register(subject(e), sc.typ, sc.text)
+			if err != nil {
+				return nil, fmt.Errorf("registering %s %s schema: %w", e.record(), sc.typ, err)
+			}
+			if (sc.typ == SchemaTypeProtobuf && format == FormatProtobuf) || (sc.typ == SchemaTypeAvro && format == FormatAvro) {
+				s.ids[e.record()] = registered.ID
+			}
+		}
+	}
+	return s, nil
+}
+
+// Format returns the wire format the serializer writes
+func (s *Serializer) Format() string {
+	return s.format
+}
+
+// Marshal stamps e with the current SchemaVersion, validates it and encodes
+// it in the serializer's format
+func (s *Serializer) Marshal(e Event) ([]byte, error) {
+	if s.format == FormatJSON {
+		return Marshal(e)
+	}
+
+	*e.version() = SchemaVersion
+	if err := e.Validate(); err != nil {
+		return nil, err
+	}
+
+	buf := []byte{magicByte}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(s.ids[e.record()]))
+	if s.format == FormatProtobuf {
+		// Message index list [0]: the first message in the schema
+		buf = append(buf, 0)
+		return append(buf, encodeProto(e)...), nil
+	}
+	return append(buf, encodeAvro(e)...), nil
+}
+
+// Unmarshal decodes a message in any supported format into e and validates it
+func (s *Serializer) Unmarshal(data []byte, e Event) error {
+	if len(data) == 0 || data[0] != magicByte {
+		return Unmarshal(data, e)
+	}
+	if len(data) < 5 {
+		return fmt.Errorf("wire format: %w", errTruncated)
+	}
+
+	id := int(binary.BigEndian.Uint32(data[1:5]))
+	schema, err := s.registry.ByID(id)
+	if err != nil {
+		return err
+	}
+	if schema.Subject != subject(e) {
+		return fmt.Errorf("schema id %d is for %s, not %s", id, schema.Subject, subject(e))
+	}
+
+	payload := data[5:]
+	switch schema.SchemaType {
+	case SchemaTypeProtobuf:
+		if payload, err = skipMessageIndexes(payload); err != nil {
+			return err
+		}
+		err = decodeProto(payload, e)
+	case SchemaTypeAvro:
+		var writer []avroWriterField
+		if writer, err = s.avroWriter(schema); err == nil {
+			err = decodeAvro(payload, writer, e)
+		}
+	default:
+		err = fmt.Errorf("schema id %d has unsupported type %q", id, schema.SchemaType)
+	}
+	if err != nil {
+		return err
+	}
+	return finish(e)
+}
+
+// avroWriter returns the parsed fields of an Avro writer schema, caching them by ID
+func (s *Serializer) avroWriter(schema Schema) ([]avroWriterField, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if fields, ok := s.avro[schema.ID]; ok {
+		return fields, nil
+	}
+	fields, err := parseAvroSchema(schema.Schema)
+	if err != nil {
+		return nil, err
+	}
+	s.avro[schema.ID] = fields
+	return fields, nil
+}
+
+// skipMessageIndexes consumes the Protobuf message index list, accepting
+// only the first top-level message since each schema defines exactly one
+func skipMessageIndexes(data []byte) ([]byte, error) {
+	count, n := binary.Varint(data)
+	if n <= 0 {
+		return nil, fmt.Errorf("wire format: message indexes: %w", errTruncated)
+	}
+	data = data[n:]
+	if count < 0 {
+		return nil, fmt.Errorf("wire format: negative message index count %d", count)
+	}
+	if count == 0 {
+		// Shorthand for [0]
+		return data, nil
+	}
+
+	for i := int64(0); i < count; i++ {
+		index, n := binary.Varint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("wire format: message indexes: %w", errTruncated)
+		}
+		data = data[n:]
+		if i > 0 || index != 0 {
+			return nil, errors.New("wire format: message indexes do not name the schema's only message")
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,84 @@
+package events
+
+import (
+	"reflect"
+	"testing"
+)
+
+func newSerializer(t *testing.T, format string) *Serializer {
+	t.Helper()
+	reg, err := OpenRegistry("")
+	if err != nil {
+		t.Fatalf("OpenRegistry: %v", err)
+	}
+	s, err := NewSerializer(format, reg)
+	if err != nil {
+		t.Fatalf("NewSerializer(%q): %v", format, err)
+	}
+	return s
+}
+
+func TestSerializerRoundTrip(t *testing.T) {
+	ele := 35.5
+	events := []struct {
+		name  string
+		event Event
+		empty func() Event
+	}{
+		{"coordinate", &CoordinateEvent{UserID: "u1", SessionID: "s1", Lat: 51.5074, Lon: -0.1278, Timestamp: "2026-10-16T10:00:00Z", Ele: &ele},
+			func() Event { return &CoordinateEvent{} }},
+		{"coordinate without elevation", &CoordinateEvent{UserID: "u1", Lat: -33.8688, Lon: 151.2093, Timestamp: "2026-10-16T10:00:00Z"},
+			func() Event { return &CoordinateEvent{} }},
+		{"location", &LocationEvent{UserID: "u1", SessionID: "s1", Location: "Café Zürich", Lat: 47.3769, Lon: 8.5417, Timestamp: "2026-10-16T10:00:00Z"},
+			func() Event { return &LocationEvent{} }},
+		{"session", &SessionEvent{Type: SessionStart, SessionID: "s1", UserID: "u1", Activity: "running", Timestamp: "2026-10-16T10:00:00Z"},
+			func() Event { return &SessionEvent{} }},
+		{"geofence", &GeofenceEvent{Type: GeofenceExit, GeofenceID: 1 << 40, GeofenceName: "Park", UserID: "u1", Lat: 51.5, Lon: -0.1, Timestamp: "2026-10-16T10:00:00Z"},
+			func() Event { return &GeofenceEvent{} }},
+		{"user", &UserEvent{Type: UserUpdated, UserID: "u1", Changed: "email,bio", Timestamp: "2026-10-16T10:00:00Z"},
+			func() Event { return &UserEvent{} }},
+	}
+
+	for _, format := range Formats {
+		// Messages are read by another service, with a registry of its own
+		writer, reader := newSerializer(t, format), newSerializer(t, FormatJSON)
+
+		for _, tt := range events {
+			t.Run(format+"/"+tt.name, func(t *testing.T) {
+				data, err := writer.Marshal(tt.event)
+				if err != nil {
+					t.Fatalf("Marshal: %v", err)
+				}
+				if binary := data[0] == magicByte; binary != (format != FormatJSON) {
+					t.Errorf("first byte %#x for %s", data[0], format)
+				}
+
+				got := tt.empty()
+				if err := reader.Unmarshal(data, got); err != nil {
+					t.Fatalf("Unmarshal: %v", err)
+				}
+				if !reflect.DeepEqual(got, tt.event) {
+					t.Errorf("decoded %+v, want %+v", got, tt.event)
+				}
+			})
+		}
+	}
+}
+
+func TestSerializerRejectsWrongSubject(t *testing.T) {
+	for _, format := range []string{FormatProtobuf, FormatAvro} {
+		t.Run(format, func(t *testing.T) {
+			s := newSerializer(t, format)
+			data, err := s.Marshal(&SessionEvent{Type: SessionEnd, SessionID: "s1", UserID: "u1", Activity: "running", Timestamp: "2026-10-16T10:00:00Z"})
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+			if err := s.Unmarshal(data, &CoordinateEvent{}); err == nil {
+				t.Errorf("decoded a session message as a coordinate")
+			}
+			if err := s.Unmarshal(data[:3], &SessionEvent{}); err == nil {
+				t.Errorf("decoded a truncated message")
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+// Package health serves liveness and readiness endpoints.
+//
+// /healthz only reports that the process is serving HTTP. /readyz runs every
+// registered check and answers 503 unless all of them pass, so orchestrators
+// stop routing traffic to an instance that lost its broker or database.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Check returns nil when a dependency is usable. It should respect ctx's deadline.
+type Check func(ctx context.Context) error
+
+// namedCheck is one registered readiness check
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker runs a set of readiness checks
+type Checker struct {
+	timeout time.Duration
+	mu      sync.Mutex
+	checks  []namedCheck
+}
+
+// NewChecker creates a checker whose checks each get timeout to complete
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{timeout: timeout}
+}
+
+// Add registers a readiness check under name
+func (c *Checker) Add(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, namedCheck{name: name, check: check})
+}
+
+// Report is the JSON body of /readyz
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Run executes every check concurrently and reports whether all passed
+func (c *Checker) Run(ctx context.Context) (Report, bool) {
+	c.mu.Lock()
+	checks := append([]namedCheck(nil), c.checks...)
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	results := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i, nc := range checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			results[i] = check(ctx)
+		}(i, nc.check)
+	}
+	wg.Wait()
+
+	report := Report{Status: "ready", Checks: make(map[string]string, len(checks))}
+	ok := true
+	for i, nc := range checks {
+		if results[i] != nil {
+			report.Checks[nc.name] = results[i].Error()
+			ok = false
+		} else {
+			report.Checks[nc.name] = "ok"
+		}
+	}
+	if !ok {
+		report.Status = "not ready"
+	}
+	return report, ok
+}
+
+// Readyz handles the readiness endpoint
+func (c *Checker) Readyz() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, ok := c.Run(r.Context())
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// Healthz handles the liveness endpoint: answering at all means the process is alive
+func Healthz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte("ok\n"))
+}
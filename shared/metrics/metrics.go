@@ -0,0 +1,389 @@
+// Package metrics is a small, dependency-free implementation of the
+// Prometheus text exposition format: counters, gauges and histograms with
+// labels, plus middleware that times HTTP requests.
+//
+// Metrics are registered on a Registry and served by its Handler:
+//
+//	reg := metrics.NewRegistry()
+//	stored := reg.NewCounter("gps_consumer_messages_stored_total", "Messages stored.", "topic")
+//	stored.Inc("coordinates")
+//	http.Handle("/metrics", reg.Handler())
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefBuckets are histogram buckets, in seconds, suited to HTTP request latency
+var DefBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// collector writes one metric family in text format
+type collector interface {
+	write(w io.Writer)
+}
+
+// Registry holds the metrics exposed by one process
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteText writes every registered metric in Prometheus text format
+func (r *Registry) WriteText(w io.Writer) {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// Handler serves the registry in Prometheus text format
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		r.WriteText(bw)
+		bw.Flush()
+	})
+}
+
+// desc is the name, help text and label names shared by every metric type
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d *desc) header(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.ReplaceAll(d.help, "\n", " "))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, kind)
+}
+
+// key identifies one labelled series; it panics on a label count mismatch
+// as that is a programming error
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelString renders {a="x",b="y"}, with extra appended pairs (for "le")
+func (d *desc) labelString(values []string, extra ...string) string {
+	if len(d.labels) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range d.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%q", name, escape(values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%q", extra[i], escape(extra[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// escape prepares a label value for %q, which already escapes backslashes,
+// quotes and newlines the way the text format expects; anything else
+// non-printable is replaced so %q never emits Go-specific escapes
+func escape(v string) string {
+	return strings.Map(func(r rune) rune {
+		if r != '\n' && (r < 0x20 || r == 0x7f) {
+			return '?'
+		}
+		return r
+	}, v)
+}
+
+// series is one set of label values and its current value
+type series struct {
+	values []string
+	value  float64
+}
+
+// vector is the labelled storage behind counters and gauges
+type vector struct {
+	desc
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func (v *vector) get(values []string) *series {
+	k := v.key(values)
+	s, ok := v.series[k]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		v.series[k] = s
+	}
+	return s
+}
+
+func (v *vector) writeSeries(w io.Writer, kind string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.header(w, kind)
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := v.series[k]
+		fmt.Fprintf(w, "%s%s %s\n", v.name, v.labelString(s.values), formatFloat(s.value))
+	}
+}
+
+// Counter is a monotonically increasing value per label set
+type Counter struct {
+	vector
+}
+
+// NewCounter registers a counter with the given label names
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{vector{desc: desc{name, help, labels}, series: map[string]*series{}}}
+	if len(labels) == 0 {
+		c.series[""] = &series{}
+	}
+	r.register(c)
+	return c
+}
+
+// Inc adds one to the series with the given label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds delta, which must not be negative, to the series with the given label values
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	c.mu.Lock()
+	c.get(labelValues).value += delta
+	c.mu.Unlock()
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.writeSeries(w, "counter")
+}
+
+// Gauge is a value per label set that can go up and down
+type Gauge struct {
+	vector
+}
+
+// NewGauge registers a gauge with the given label names
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{vector{desc: desc{name, help, labels}, series: map[string]*series{}}}
+	if len(labels) == 0 {
+		g.series[""] = &series{}
+	}
+	r.register(g)
+	return g
+}
+
+// Set replaces the value of the series with the given label values
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.mu.Lock()
+	g.get(labelValues).value = value
+	g.mu.Unlock()
+}
+
+// Delete removes the series with the given label values
+func (g *Gauge) Delete(labelValues ...string) {
+	g.mu.Lock()
+	delete(g.series, g.key(labelValues))
+	g.mu.Unlock()
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.writeSeries(w, "gauge")
+}
+
+// gaugeFunc is a gauge whose series are produced on every scrape
+type gaugeFunc struct {
+	desc
+	collect func(emit func(value float64, labelValues ...string))
+}
+
+// NewGaugeFunc registers a gauge computed at scrape time. collect calls emit
+// once per series; it runs on the scraping goroutine.
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, collect func(emit func(value float64, labelValues ...string))) {
+	r.register(&gaugeFunc{desc: desc{name, help, labels}, collect: collect})
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	g.header(w, "gauge")
+	g.collect(func(value float64, labelValues ...string) {
+		g.key(labelValues) // validates the label count
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labelString(labelValues), formatFloat(value))
+	})
+}
+
+// histSeries is the bucket counts of one labelled histogram series
+type histSeries struct {
+	values []string
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// Histogram counts observations into cumulative buckets per label set
+type Histogram struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histSeries
+}
+
+// NewHistogram registers a histogram with the given upper bucket bounds,
+// which must be sorted ascending; +Inf is implicit
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic("metrics: histogram buckets must be sorted")
+	}
+	h := &Histogram{
+		desc:    desc{name, help, labels},
+		buckets: append([]float64(nil), buckets...),
+		series:  map[string]*histSeries{},
+	}
+	r.register(h)
+	return h
+}
+
+// Observe records one value in the series with the given label values
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	k := h.key(labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[k]
+	if !ok {
+		s = &histSeries{
+			values: append([]string(nil), labelValues...),
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.series[k] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.header(w, "histogram")
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := h.series[k]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(s.values, "le", formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(s.values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(s.values), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(s.values), s.count)
+	}
+}
+
+// formatFloat renders a sample value the way Prometheus expects
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush keeps streaming handlers (Server-Sent Events) working through the wrapper
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// InstrumentMux times every request served by mux into h, which must take
+// the labels handler, method and code. The handler label is the mux pattern
+// that matched, so path parameters do not create new series.
+func InstrumentMux(h *Histogram, mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		mux.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		h.Observe(time.Since(start).Seconds(), pattern, r.Method, strconv.Itoa(rec.status))
+	})
+}